@@ -1,7 +1,12 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"runtime/debug"
@@ -10,9 +15,13 @@ import (
 	"github.com/dgraph-io/badger/v4"
 	"github.com/pmoieni/rmx/internal/config"
 	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+	"github.com/pmoieni/rmx/internal/net/websocket2"
 	"github.com/pmoieni/rmx/internal/oauth"
 	"github.com/pmoieni/rmx/internal/oauth/github"
 	"github.com/pmoieni/rmx/internal/oauth/google"
+	"github.com/pmoieni/rmx/internal/oauth/oidc"
 	"github.com/pmoieni/rmx/internal/services/jam"
 	"github.com/pmoieni/rmx/internal/services/user"
 	"github.com/pmoieni/rmx/internal/store"
@@ -23,6 +32,16 @@ import (
 	"github.com/lmittmann/tint"
 )
 
+const (
+	// spectators of a jam on top of its capacity, when the config doesn't set it
+	defaultMaxSpectators = 100
+	defaultKeyring       = "rmx.keyring.json"
+	defaultErrorPath     = "/auth/error"
+	tokenCacheGCInterval = 10 * time.Minute
+)
+
+var defaultFrontendOrigins = []string{"http://localhost:5173", "http://127.0.0.1:5173"}
+
 func main() {
 	// Logger
 	var slogHandler = tint.NewHandler(os.Stdout, &tint.Options{TimeFormat: time.Kitchen, AddSource: true, Level: slog.LevelDebug})
@@ -47,9 +66,11 @@ func main() {
 	exit(err)
 
 	// Store
-	dbHandle, err := store.NewDB(context.Background(), cfg.DSN)
+	pool, err := store.NewPool(context.Background(), cfg.DSN)
 	exit(err)
 
+	dbHandle := store.NewDB(pool)
+
 	// verify DB connection
 	_, err = dbHandle.Exec("SELECT 1")
 	exit(err)
@@ -57,36 +78,203 @@ func main() {
 	cache, err := badger.Open(badger.DefaultOptions("/tmp/badger/rmx"))
 	exit(err)
 
+	// Backplane
+	var bp backplane.Backplane = backplane.NewMemory()
+	if cfg.Backplane == "postgres" {
+		bp, err = backplane.NewPostgres(context.Background(), pool)
+		exit(err)
+	}
+
+	// Auth
+	keys := make([]user.SigningKey, 0, len(cfg.Keys))
+	for _, k := range cfg.Keys {
+		keys = append(keys, user.SigningKey(k))
+	}
+
+	keyring, err := user.NewKeyring(cmp.Or(cfg.Keyring, defaultKeyring), keys...)
+	exit(err)
+
+	userRepo := userStore.NewUserRepo(dbHandle)
+	tokenRepo := userStore.NewTokenRepo(cache)
+	auth := user.NewAuth(userRepo, tokenRepo, keyring)
+
+	gcCtx, stopGC := context.WithCancel(context.Background())
+	go tokenRepo.RunGC(gcCtx, tokenCacheGCInterval)
+
 	// Jam Service
 	jamRepo := jamStore.NewJamRepo(dbHandle)
 
-	jamService, err := jam.NewService(jamRepo)
+	recordingsDir := cfg.RecordingsDir
+	if recordingsDir == "" {
+		recordingsDir = "recordings"
+	}
+
+	var np *websocket.Netpoll
+	if cfg.Netpoll {
+		np, err = websocket.NewNetpoll(int(cfg.NetpollWorkers))
+		if errors.Is(err, websocket.ErrNetpollUnsupported) {
+			slog.Warn("netpoll is not supported, using a goroutine per connection")
+		} else {
+			exit(err)
+		}
+	}
+
+	limits, err := wsLimits(cfg)
+	exit(err)
+
+	hubs := websocket.NewHubStore(bp, &websocket.HubOptions{
+		Netpoll:       np,
+		Limits:        limits,
+		MaxSpectators: cmp.Or(cfg.MaxSpectators, defaultMaxSpectators),
+	})
+
+	jamService, err := jam.NewService(jamRepo, hubs, recordingsDir, auth)
 	exit(err)
 
 	// User Service
-	userRepo := userStore.NewUserRepo(dbHandle)
 	connectionRepo := userStore.NewConnectionRepo(dbHandle)
-	tokenRepo := userStore.NewTokenRepo(cache)
 
-	clientStore := oauth.NewClientStore()
+	stateKey, err := oauthStateKey(cfg)
+	exit(err)
 
-	clientStore.AddProvider("google",
-		google.NewOIDC(context.Background(), cfg.OAuth.Google.ClientID, cfg.OAuth.Google.ClientSecret, cfg.OAuth.Google.RedirectURL))
+	clientStore := oauth.NewClientStore(stateKey)
+
+	// google isn't added unless it's configured, it's discovered by its first request
+	if cfg.OAuth.Google.ClientID != "" {
+		googleProvider, err := google.NewOIDC(cfg.OAuth.Google.ClientID, cfg.OAuth.Google.ClientSecret, cfg.OAuth.Google.RedirectURL)
+		exit(err)
+
+		clientStore.AddProvider("google", googleProvider)
+	}
 	clientStore.AddProvider("github",
 		github.NewOAuth2(context.Background(), cfg.OAuth.GitHub.ClientID, cfg.OAuth.GitHub.ClientSecret, cfg.OAuth.GitHub.RedirectURL))
 
-	userService, err := user.NewService(userRepo, connectionRepo, tokenRepo, clientStore)
+	for _, c := range cfg.OAuth.OIDC {
+		if _, err := clientStore.GetProvider(c.Name); err == nil {
+			exit(fmt.Errorf("oidc: duplicate provider %q", c.Name))
+		}
+
+		provider, err := oidc.New(oidc.Config{
+			Name:         c.Name,
+			IssuerURL:    c.IssuerURL,
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL:  c.RedirectURL,
+			Scopes:       c.Scopes,
+			Claims:       oidc.Claims(c.Claims),
+		})
+		exit(err)
+
+		clientStore.AddProvider(c.Name, provider)
+	}
+
+	frontendOrigins := cfg.FrontendOrigins
+	if len(frontendOrigins) == 0 {
+		frontendOrigins = defaultFrontendOrigins
+	}
+
+	frontend, err := user.NewFrontend(frontendOrigins, cmp.Or(cfg.FrontendErrorPath, defaultErrorPath))
+	exit(err)
+
+	userService, err := user.NewService(userRepo, connectionRepo, tokenRepo, clientStore, keyring, auth, frontend)
 	exit(err)
 
 	// Server
 	srv := net.NewServer(&net.ServerFlags{
-		Host: cfg.ServerHost,
-		Port: cfg.ServerPort,
-	}, userService, jamService)
+		Host:            cfg.ServerHost,
+		Port:            cfg.ServerPort,
+		ShutdownTimeout: time.Duration(cfg.ShutdownTimeout) * time.Second,
+		ReconnectDelay:  time.Duration(cfg.ReconnectDelay) * time.Second,
+		AllowedOrigins:  frontendOrigins,
+	}, userService, user.NewKeysService(keyring), jamService)
+
+	srv.OnShutdown(
+		np.Close,
+		// the backplane uses the pool, close it first
+		bp.Close,
+		dbHandle.Close,
+		func() error {
+			pool.Close()
+			return nil
+		},
+		func() error {
+			stopGC()
+			return nil
+		},
+		cache.Close,
+	)
 
 	exit(srv.Run("", ""))
 }
 
+// oauthStateKey returns the key of the OAuth states in cfg, or a random one if it's not set.
+func oauthStateKey(cfg *config.Config) ([]byte, error) {
+	if cfg.OAuth.StateKey == "" {
+		slog.Warn("oauth state key is not set, the authorizations in progress fail after a restart or on other instances")
+
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		return key, err
+	}
+
+	key, err := hex.DecodeString(cfg.OAuth.StateKey)
+	if err != nil {
+		return nil, fmt.Errorf("oauth state key: %w", err)
+	}
+	if len(key) < 32 {
+		return nil, errors.New("oauth state key: shorter than 32 bytes")
+	}
+
+	return key, nil
+}
+
+// wsLimits returns the default websocket limits overridden by the ones set in cfg.
+func wsLimits(cfg *config.Config) (*websocket.Limits, error) {
+	limits := websocket.DefaultLimits()
+	l := cfg.Limits
+
+	limits.MaxFrameSize = cmp.Or(l.MaxFrameSize, limits.MaxFrameSize)
+	limits.MaxMessageSize = cmp.Or(l.MaxMessageSize, limits.MaxMessageSize)
+	limits.MaxFragments = cmp.Or(l.MaxFragments, limits.MaxFragments)
+	limits.MaxStrikes = cmp.Or(l.MaxStrikes, limits.MaxStrikes)
+	if l.Rate != 0 {
+		limits.Rate = wsRate(l.Rate, l.Burst)
+	}
+
+	for name, r := range l.TypeRates {
+		typ, ok := msg.LookupName(name)
+		if !ok {
+			return nil, fmt.Errorf("limits: unknown message type %q", name)
+		}
+
+		limits.TypeRates[typ] = wsRate(r.Rate, r.Burst)
+	}
+	for name, r := range l.UserRates {
+		typ, ok := msg.LookupName(name)
+		if !ok {
+			return nil, fmt.Errorf("limits: unknown message type %q", name)
+		}
+
+		limits.UserRates[typ] = wsRate(r.Rate, r.Burst)
+	}
+
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+// wsRate returns the rate with its burst defaulting to a second worth of
+// messages, and at least one so slow rates let messages through.
+func wsRate(perSecond float64, burst int) websocket.Rate {
+	if burst == 0 {
+		burst = max(1, int(perSecond))
+	}
+
+	return websocket.Rate{PerSecond: perSecond, Burst: burst}
+}
+
 func exit(err error) {
 	if err != nil {
 		slog.Error(err.Error())
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -12,8 +13,62 @@ type Config struct {
 	ServerPort uint   `json:"serverPort"`
 	DSN        string `json:"dsn"`
 	Dev        bool   `json:"dev"`
-	OAuth      struct {
-		Google struct {
+	// Backplane is either "memory" (default) or "postgres",
+	// postgres is required to run more than one instance.
+	Backplane string `json:"backplane"`
+	// ShutdownTimeout and ReconnectDelay are in seconds
+	ShutdownTimeout uint `json:"shutdownTimeout"`
+	ReconnectDelay  uint `json:"reconnectDelay"`
+	// RecordingsDir is where jam recordings are written, defaults to ./recordings
+	RecordingsDir string `json:"recordingsDir"`
+	// Netpoll serves the websocket connections with epoll and a pool of
+	// NetpollWorkers (0 is a few per CPU), it's only supported on linux.
+	Netpoll        bool `json:"netpoll"`
+	NetpollWorkers uint `json:"netpollWorkers"`
+	// MaxSpectators of a jam on top of its capacity, defaults to 100.
+	MaxSpectators uint `json:"maxSpectators"`
+	// Limits of the messages sent by a websocket connection, the zero values
+	// keep the defaults. Sizes are in bytes and rates in messages per second.
+	Limits struct {
+		MaxFrameSize   int64   `json:"maxFrameSize"`
+		MaxMessageSize int64   `json:"maxMessageSize"`
+		MaxFragments   int     `json:"maxFragments"`
+		Rate           float64 `json:"rate"`
+		Burst          int     `json:"burst"`
+		// TypeRates are keyed by the name of the message type, e.g. "midi".
+		TypeRates map[string]struct {
+			Rate  float64 `json:"rate"`
+			Burst int     `json:"burst"`
+		} `json:"typeRates"`
+		// UserRates are shared by the connections of a member, e.g. "chat".
+		UserRates map[string]struct {
+			Rate  float64 `json:"rate"`
+			Burst int     `json:"burst"`
+		} `json:"userRates"`
+		MaxStrikes int `json:"maxStrikes"`
+	} `json:"limits"`
+	// FrontendOrigins are allowed by CORS and are where the browsers are sent
+	// back after signing in, defaults to the dev server on localhost:5173.
+	FrontendOrigins []string `json:"frontendOrigins"`
+	// FrontendErrorPath is the page of the frontend showing the reason of a failed
+	// sign in, defaults to /auth/error.
+	FrontendErrorPath string `json:"frontendErrorPath"`
+	// Keyring is the file of the keys signing the tokens, defaults to ./rmx.keyring.json.
+	// It's created with a new key if it doesn't exist, keys are rotated by adding a newer one.
+	Keyring string `json:"keyring"`
+	// Keys signing the tokens, the Keyring file isn't used when they're set. The
+	// newest signs the tokens and the others only verify them. Seeds are hex encoded.
+	Keys []struct {
+		ID        string    `json:"kid"`
+		Seed      string    `json:"seed"`
+		CreatedAt time.Time `json:"createdAt"`
+	} `json:"keys"`
+	OAuth struct {
+		// StateKey signs the state of the authorizations, it's hex encoded and at
+		// least 32 bytes. The instances behind a load balancer must share it, a random
+		// one is used if it's not set.
+		StateKey string `json:"stateKey"`
+		Google   struct {
 			ClientID     string `json:"clientID"`
 			ClientSecret string `json:"clientSecret"`
 			RedirectURL  string `json:"redirectURL"`
@@ -23,6 +78,22 @@ type Config struct {
 			ClientSecret string `json:"clientSecret"`
 			RedirectURL  string `json:"redirectURL"`
 		}
+		// OIDC providers like Keycloak, Authentik or GitLab, Name is the provider
+		// in the auth endpoints. Scopes default to profile and email, the empty
+		// Claims to the standard ones (sub, email and email_verified).
+		OIDC []struct {
+			Name         string   `json:"name"`
+			IssuerURL    string   `json:"issuerURL"`
+			ClientID     string   `json:"clientID"`
+			ClientSecret string   `json:"clientSecret"`
+			RedirectURL  string   `json:"redirectURL"`
+			Scopes       []string `json:"scopes"`
+			Claims       struct {
+				Subject       string `json:"subject"`
+				Email         string `json:"email"`
+				EmailVerified string `json:"emailVerified"`
+			} `json:"claims"`
+		} `json:"oidc"`
 	} `json:"oauth"`
 }
 
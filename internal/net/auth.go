@@ -0,0 +1,126 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// AccessTokenCookie is the cookie holding the access token of the browsers.
+const AccessTokenCookie = "rmx_at"
+
+// ErrUnauthenticated is returned when a request has no valid access token or its user doesn't exist.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID   uuid.UUID
+	Username string
+	Email    string
+	// Guest users have no email, they're upgraded to full users when they sign in.
+	Guest bool
+	// AccessToken the request was authenticated with, from the header or the cookie.
+	AccessToken string
+}
+
+// TokenVerifier returns the id of the user an access token was issued to,
+// or an error if the token is invalid or expired.
+type TokenVerifier func(token string) (uuid.UUID, error)
+
+// PrincipalLoader returns the principal of a user, ErrUnauthenticated if there's none.
+type PrincipalLoader func(ctx context.Context, userID uuid.UUID) (*Principal, error)
+
+// Auth authenticates requests with the access token in the Authorization
+// header as a Bearer token, or in the AccessTokenCookie.
+type Auth struct {
+	verify TokenVerifier
+	load   PrincipalLoader
+}
+
+func NewAuth(verify TokenVerifier, load PrincipalLoader) *Auth {
+	return &Auth{verify, load}
+}
+
+type principalCtxKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// PrincipalFrom returns the principal put in ctx by RequireAuth or OptionalAuth.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalCtxKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// RequireAuth responds with 401 to the requests that aren't authenticated,
+// next finds the principal of the others in their context.
+func (a *Auth) RequireAuth(next http.Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, err := a.authenticate(r)
+		if err != nil {
+			if errors.Is(err, ErrUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				return HandlerError{Err: err, Msg: err.Error(), Code: http.StatusUnauthorized}
+			}
+
+			return err
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		return nil
+	}
+}
+
+// OptionalAuth puts the principal in the context of the authenticated requests,
+// the others are served anonymously.
+func (a *Auth) OptionalAuth(next http.Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, err := a.authenticate(r)
+		switch {
+		case err == nil:
+			r = r.WithContext(WithPrincipal(r.Context(), p))
+		case !errors.Is(err, ErrUnauthenticated):
+			return err
+		}
+
+		next.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+func (a *Auth) authenticate(r *http.Request) (*Principal, error) {
+	token := accessToken(r)
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	userID, err := a.verify(token)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	p, err := a.load(r.Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	p.AccessToken = token
+
+	return p, nil
+}
+
+// accessToken returns the Bearer token of r, or the one in its cookie.
+func accessToken(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	if c, err := r.Cookie(AccessTokenCookie); err == nil {
+		return c.Value
+	}
+
+	return ""
+}
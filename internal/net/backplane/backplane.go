@@ -0,0 +1,158 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrRoomFull = errors.New("backplane: room is full")
+	ErrClosed   = errors.New("backplane: closed")
+)
+
+// Message is what travels between hubs of the same room.
+// Origin identifies the hub that published it so the hub can skip its own messages.
+type Message struct {
+	Room   string `json:"room"`
+	Origin string `json:"origin"`
+	Data   []byte `json:"data"`
+}
+
+// Backplane connects the hubs of a room across rmx instances.
+//
+// Join and Leave keep the member count of a room consistent across instances,
+// so capacity is enforced globally instead of per process.
+type Backplane interface {
+	Publish(ctx context.Context, m *Message) error
+	// Subscribe registers fn for every message published to room.
+	// The returned function removes the subscription.
+	Subscribe(ctx context.Context, room string, fn func(*Message)) (func(), error)
+
+	// Join reserves a slot for member in room, ErrRoomFull is returned if the room has
+	// reached capacity. A capacity of 0 means unlimited.
+	Join(ctx context.Context, room, member string, capacity uint) error
+	Leave(ctx context.Context, room, member string) error
+	// Len returns the number of members in room across all instances.
+	Len(ctx context.Context, room string) (int, error)
+
+	Close() error
+}
+
+var _ Backplane = (*Memory)(nil)
+
+// Memory is an in-process Backplane, it's enough for a single rmx instance.
+type Memory struct {
+	sync.RWMutex
+
+	subs    map[string]map[*subscription]struct{}
+	members map[string]map[string]struct{}
+	closed  bool
+}
+
+type subscription struct {
+	fn func(*Message)
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subs:    make(map[string]map[*subscription]struct{}),
+		members: make(map[string]map[string]struct{}),
+	}
+}
+
+func (b *Memory) Publish(ctx context.Context, m *Message) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	for s := range b.subs[m.Room] {
+		s.fn(m)
+	}
+
+	return nil
+}
+
+func (b *Memory) Subscribe(ctx context.Context, room string, fn func(*Message)) (func(), error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	s := &subscription{fn: fn}
+	if _, ok := b.subs[room]; !ok {
+		b.subs[room] = make(map[*subscription]struct{})
+	}
+	b.subs[room][s] = struct{}{}
+
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+
+		delete(b.subs[room], s)
+		if len(b.subs[room]) == 0 {
+			delete(b.subs, room)
+		}
+	}, nil
+}
+
+func (b *Memory) Join(ctx context.Context, room, member string, capacity uint) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	members, ok := b.members[room]
+	if !ok {
+		members = make(map[string]struct{})
+		b.members[room] = members
+	}
+
+	if _, ok := members[member]; ok {
+		return nil
+	}
+
+	if capacity > 0 && len(members) >= int(capacity) {
+		return ErrRoomFull
+	}
+
+	members[member] = struct{}{}
+	return nil
+}
+
+func (b *Memory) Leave(ctx context.Context, room, member string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.members[room], member)
+	if len(b.members[room]) == 0 {
+		delete(b.members, room)
+	}
+
+	return nil
+}
+
+func (b *Memory) Len(ctx context.Context, room string) (int, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.members[room]), nil
+}
+
+func (b *Memory) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+	b.subs = make(map[string]map[*subscription]struct{})
+	b.members = make(map[string]map[string]struct{})
+
+	return nil
+}
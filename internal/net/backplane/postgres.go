@@ -0,0 +1,379 @@
+package backplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	pgChannel = "rmx_backplane"
+	// NOTIFY payloads are limited to 8000 bytes, the base64 encoded data and the
+	// JSON wrapper have to fit in it. The bigger messages are kept in the
+	// backplane_payloads table and only their id is sent.
+	pgMaxPayload = 8000
+	// spilled payloads are deleted once every instance had the time to read them
+	payloadTTL = time.Minute
+
+	// members of an instance that stops heartbeating are not counted anymore
+	heartbeatPeriod = 10 * time.Second
+	memberTTL       = 3 * heartbeatPeriod
+
+	// the listening connection is reopened with an exponential backoff
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+
+	// notifications queued for each subscriber, the ones of a slow subscriber
+	// are dropped once it's full so it doesn't hold up the other rooms
+	subscriberQueue = 256
+)
+
+var _ Backplane = (*Postgres)(nil)
+
+// Postgres is a Backplane built on LISTEN/NOTIFY, every instance listens on a
+// single channel and dispatches messages to the local subscribers of a room.
+// The listening connection is reopened when it's lost, the notifications sent
+// in the meantime are missed.
+//
+// Room members are kept in the room_members table and the messages too big
+// for NOTIFY in the backplane_payloads table, see the migrations.
+type Postgres struct {
+	pool     *pgxpool.Pool
+	instance string
+
+	mu   sync.RWMutex
+	subs map[string]map[*pgSubscription]struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// pgSubscription delivers the messages of a room to fn from a goroutine of its own.
+type pgSubscription struct {
+	fn    func(*Message)
+	queue chan *Message
+	stop  chan struct{}
+}
+
+func (s *pgSubscription) run() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case m := <-s.queue:
+			s.fn(m)
+		}
+	}
+}
+
+func NewPostgres(ctx context.Context, pool *pgxpool.Pool) (*Postgres, error) {
+	// the first connection fails fast, the next ones are retried
+	conn, err := pgListen(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Postgres{
+		pool:     pool,
+		instance: uuid.NewString(),
+		subs:     make(map[string]map[*pgSubscription]struct{}),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go b.listen(ctx, conn)
+	go b.heartbeat(ctx)
+
+	return b, nil
+}
+
+// pgListen returns a connection of the pool listening on the channel, it's
+// taken out of the pool for good.
+func pgListen(ctx context.Context, pool *pgxpool.Pool) (*pgx.Conn, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the connection is in LISTEN state, don't put it back in the pool
+	pgc := conn.Hijack()
+	if _, err := pgc.Exec(ctx, "LISTEN "+pgx.Identifier{pgChannel}.Sanitize()); err != nil {
+		pgc.Close(context.Background())
+		return nil, err
+	}
+
+	return pgc, nil
+}
+
+// listen dispatches the notifications until ctx is done, the connection is
+// reopened whenever it fails.
+func (b *Postgres) listen(ctx context.Context, pgc *pgx.Conn) {
+	defer close(b.done)
+
+	delay := minReconnectDelay
+	for {
+		if pgc != nil {
+			err := b.dispatch(ctx, pgc)
+			pgc.Close(context.Background())
+			pgc = nil
+
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error(fmt.Errorf("backplane: wait for notification: %w", err).Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		var err error
+		if pgc, err = pgListen(ctx, b.pool); err != nil {
+			if ctx.Err() == nil {
+				slog.Error(fmt.Errorf("backplane: listen: %w", err).Error(), "retry", delay)
+			}
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+		delay = minReconnectDelay
+	}
+}
+
+// dispatch queues the notifications received by pgc for the subscribers of
+// their room until it fails.
+func (b *Postgres) dispatch(ctx context.Context, pgc *pgx.Conn) error {
+	for {
+		n, err := pgc.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var pn pgNotification
+		if err := json.Unmarshal([]byte(n.Payload), &pn); err != nil {
+			slog.Error(fmt.Errorf("backplane: unmarshal notification: %w", err).Error())
+			continue
+		}
+
+		if pn.Ref != "" {
+			if err := b.spilled(ctx, &pn); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				slog.Error(fmt.Errorf("backplane: read payload: %w", err).Error(), "ref", pn.Ref)
+				continue
+			}
+		}
+
+		b.deliver(&pn.Message)
+	}
+}
+
+// pgNotification is the payload of a notification, either the message or the
+// id of the message in backplane_payloads.
+type pgNotification struct {
+	Message
+	Ref string `json:"ref,omitempty"`
+}
+
+// spilled reads the message pn refers to.
+func (b *Postgres) spilled(ctx context.Context, pn *pgNotification) error {
+	var data []byte
+	query := `SELECT data FROM backplane_payloads WHERE id = $1`
+	if err := b.pool.QueryRow(ctx, query, pn.Ref).Scan(&data); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &pn.Message)
+}
+
+// deliver queues m for the subscribers of its room without waiting on them.
+func (b *Postgres) deliver(m *Message) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs[m.Room] {
+		select {
+		case s.queue <- m:
+		default:
+			slog.Error("backplane: subscriber is too slow, message dropped", "room", m.Room)
+		}
+	}
+}
+
+func (b *Postgres) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			query := `UPDATE room_members
+                SET seen_at = now()
+                WHERE instance = $1`
+			if _, err := b.pool.Exec(ctx, query, b.instance); err != nil && ctx.Err() == nil {
+				slog.Error(fmt.Errorf("backplane: heartbeat: %w", err).Error())
+			}
+
+			query = `DELETE FROM backplane_payloads
+                WHERE created_at < now() - $1::interval`
+			if _, err := b.pool.Exec(ctx, query, payloadTTL); err != nil && ctx.Err() == nil {
+				slog.Error(fmt.Errorf("backplane: delete payloads: %w", err).Error())
+			}
+		}
+	}
+}
+
+func (b *Postgres) Publish(ctx context.Context, m *Message) error {
+	bs, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if len(bs) < pgMaxPayload {
+		_, err = b.pool.Exec(ctx, "SELECT pg_notify($1, $2)", pgChannel, string(bs))
+		return err
+	}
+
+	// the notification is sent once the payload is committed
+	query := `WITH p AS (
+            INSERT INTO backplane_payloads (data) VALUES ($2) RETURNING id
+        )
+        SELECT pg_notify($1, json_build_object('ref', p.id)::text) FROM p`
+	_, err = b.pool.Exec(ctx, query, pgChannel, bs)
+	return err
+}
+
+func (b *Postgres) Subscribe(ctx context.Context, room string, fn func(*Message)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	s := &pgSubscription{fn: fn, queue: make(chan *Message, subscriberQueue), stop: make(chan struct{})}
+	if _, ok := b.subs[room]; !ok {
+		b.subs[room] = make(map[*pgSubscription]struct{})
+	}
+	b.subs[room][s] = struct{}{}
+	go s.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			// Close already stopped it
+			if _, ok := b.subs[room][s]; !ok {
+				return
+			}
+
+			delete(b.subs[room], s)
+			if len(b.subs[room]) == 0 {
+				delete(b.subs, room)
+			}
+			close(s.stop)
+		})
+	}, nil
+}
+
+func (b *Postgres) Join(ctx context.Context, room, member string, capacity uint) error {
+	tx, err := b.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// serialize joins of the same room across instances
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", room); err != nil {
+		return err
+	}
+
+	query := `DELETE FROM room_members
+        WHERE room = $1
+        AND seen_at < now() - make_interval(secs => $2)`
+	if _, err := tx.Exec(ctx, query, room, memberTTL.Seconds()); err != nil {
+		return err
+	}
+
+	var count int
+	query = `SELECT count(*) FROM room_members
+        WHERE room = $1
+        AND member <> $2`
+	if err := tx.QueryRow(ctx, query, room, member).Scan(&count); err != nil {
+		return err
+	}
+
+	if capacity > 0 && count >= int(capacity) {
+		return ErrRoomFull
+	}
+
+	query = `INSERT INTO room_members
+        (room, member, instance)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (room, member) DO UPDATE
+        SET instance = EXCLUDED.instance, seen_at = now()`
+	if _, err := tx.Exec(ctx, query, room, member, b.instance); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (b *Postgres) Leave(ctx context.Context, room, member string) error {
+	query := `DELETE FROM room_members
+        WHERE room = $1
+        AND member = $2`
+	_, err := b.pool.Exec(ctx, query, room, member)
+
+	return err
+}
+
+func (b *Postgres) Len(ctx context.Context, room string) (int, error) {
+	var count int
+	query := `SELECT count(*) FROM room_members
+        WHERE room = $1
+        AND seen_at >= now() - make_interval(secs => $2)`
+	if err := b.pool.QueryRow(ctx, query, room, memberTTL.Seconds()).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Close stops listening and removes the members of this instance.
+// The pool is owned by the caller and is left open.
+func (b *Postgres) Close() error {
+	b.cancel()
+	<-b.done
+
+	b.mu.Lock()
+	for _, subs := range b.subs {
+		for s := range subs {
+			close(s.stop)
+		}
+	}
+	b.subs = make(map[string]map[*pgSubscription]struct{})
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := b.pool.Exec(ctx, "DELETE FROM room_members WHERE instance = $1", b.instance)
+	return err
+}
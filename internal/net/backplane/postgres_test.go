@@ -0,0 +1,171 @@
+package backplane
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// newPool migrates a schema of its own in the database of RMX_TEST_DSN, the
+// tests are skipped without one.
+func newPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv("RMX_TEST_DSN")
+	if dsn == "" {
+		t.Skip("RMX_TEST_DSN isn't set")
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("rmx_test_%d", time.Now().UnixNano())
+
+	admin, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(admin.Close)
+
+	if _, err := admin.Exec(ctx, `CREATE SCHEMA "`+schema+`"`); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(context.Background(), `DROP SCHEMA "`+schema+`" CASCADE`) })
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	migrations, err := filepath.Glob("../../store/migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		bs, err := os.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.Exec(ctx, string(bs)); err != nil {
+			t.Fatalf("migrating %s: %v", filepath.Base(m), err)
+		}
+	}
+
+	return pool
+}
+
+func newPostgres(t *testing.T) (*Postgres, *pgxpool.Pool) {
+	t.Helper()
+
+	pool := newPool(t)
+	b, err := NewPostgres(context.Background(), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	return b, pool
+}
+
+// subscribe returns the messages published to a room of its own.
+func subscribe(t *testing.T, b Backplane) (string, <-chan *Message) {
+	t.Helper()
+
+	room := fmt.Sprintf("room-%d", time.Now().UnixNano())
+	received := make(chan *Message, subscriberQueue)
+	unsubscribe, err := b.Subscribe(context.Background(), room, func(m *Message) {
+		received <- m
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+
+	return room, received
+}
+
+func TestPostgresSlowSubscriber(t *testing.T) {
+	b := &Postgres{subs: make(map[string]map[*pgSubscription]struct{}), done: make(chan struct{})}
+
+	// the subscriber of the slow room never returns
+	stuck := make(chan struct{})
+	defer close(stuck)
+	if _, err := b.Subscribe(context.Background(), "slow", func(*Message) { <-stuck }); err != nil {
+		t.Fatal(err)
+	}
+	room, received := subscribe(t, b)
+
+	for range 2 * subscriberQueue {
+		b.deliver(&Message{Room: "slow"})
+	}
+	b.deliver(&Message{Room: room})
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("a slow room held up the other rooms")
+	}
+}
+
+func TestPostgresLargeMessage(t *testing.T) {
+	b, _ := newPostgres(t)
+	room, received := subscribe(t, b)
+
+	// as big as a websocket frame, far over the NOTIFY limit
+	data := bytes.Repeat([]byte("a"), 64<<10)
+	if err := b.Publish(context.Background(), &Message{Room: room, Origin: "hub", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-received:
+		if !bytes.Equal(m.Data, data) {
+			t.Errorf("received %d bytes, want the %d published", len(m.Data), len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the large message wasn't received")
+	}
+}
+
+func TestPostgresReconnect(t *testing.T) {
+	b, pool := newPostgres(t)
+	room, received := subscribe(t, b)
+	ctx := context.Background()
+
+	// drop the listening connection as a restart of the database would
+	query := `SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+        WHERE query LIKE 'LISTEN %' AND pid <> pg_backend_pid()`
+	if _, err := pool.Exec(ctx, query); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages sent before it listens again are missed
+	deadline := time.After(10 * time.Second)
+	for {
+		if err := b.Publish(ctx, &Message{Room: room, Data: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-received:
+			if _, err := b.Subscribe(ctx, room, func(*Message) {}); err != nil {
+				t.Errorf("subscribing once reconnected: %v", err)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no message received once the connection was lost")
+		}
+	}
+}
@@ -2,6 +2,7 @@ package net
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -20,13 +21,32 @@ type Service interface {
 	MountPath() string
 }
 
+// Drainer is implemented by the services holding long lived connections
+// which aren't closed by http.Server.Shutdown, e.g. hijacked websocket connections.
+type Drainer interface {
+	// Drain asks the clients to reconnect after retry and closes their connections.
+	Drain(ctx context.Context, retry time.Duration) error
+}
+
 type Server struct {
-	http *http.Server
+	http       *http.Server
+	services   []Service
+	onShutdown []func() error
+
+	shutdownTimeout time.Duration
+	reconnectDelay  time.Duration
 }
 
 type ServerFlags struct {
 	Host string
 	Port uint
+
+	// ShutdownTimeout is how long connections are given to close on shutdown.
+	ShutdownTimeout time.Duration
+	// ReconnectDelay is what clients of drained connections are told to wait before reconnecting.
+	ReconnectDelay time.Duration
+	// AllowedOrigins of the CORS requests.
+	AllowedOrigins []string
 }
 
 func NewServer(flags *ServerFlags, services ...Service) *Server {
@@ -34,15 +54,26 @@ func NewServer(flags *ServerFlags, services ...Service) *Server {
 	setupControllers(mux, services...)
 
 	corsCfg := cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173", "http://127.0.0.1:5173"}, // ? band-aid, needs to change to a flag
+		AllowedOrigins:   flags.AllowedOrigins,
 		AllowCredentials: true,
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete},
 		AllowedHeaders:   []string{"Origin", "Content-Type", "Accept", "Authorization"},
 		ExposedHeaders:   []string{"Location"},
 		Debug:            true,
 	}
 
+	if flags.ShutdownTimeout == 0 {
+		flags.ShutdownTimeout = 20 * time.Second // no idea how much timeout is needed
+	}
+
+	if flags.ReconnectDelay == 0 {
+		flags.ReconnectDelay = 5 * time.Second
+	}
+
 	return &Server{
+		services:        services,
+		shutdownTimeout: flags.ShutdownTimeout,
+		reconnectDelay:  flags.ReconnectDelay,
 		http: &http.Server{
 			Addr:         flags.Host + ":" + fmt.Sprintf("%d", flags.Port),
 			Handler:      cors.New(corsCfg).Handler(mux),
@@ -68,34 +99,76 @@ func (s *Server) Run(certPath, keyPath string) error {
 	eg.Go(func() error {
 		slog.LogAttrs(sCtx, slog.LevelInfo, "server running", slog.String("addr", s.http.Addr))
 
+		var err error
 		if certPath != "" || keyPath != "" {
-			return s.http.ListenAndServeTLS(certPath, keyPath)
+			err = s.http.ListenAndServeTLS(certPath, keyPath)
 		} else {
-			return s.http.ListenAndServe()
+			err = s.http.ListenAndServe()
 		}
+
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+
+		return err
 	})
 
 	eg.Go(func() error {
 		<-egCtx.Done()
 		// if context.Background is "Done" or the timeout is exceeded, it'll cause an immediate shutdown
-		return s.Shutdown(context.Background(), 20*time.Second) // no idea how much timeout is needed
+		return s.Shutdown(context.Background(), s.shutdownTimeout)
 	})
 
 	return eg.Wait()
 }
 
+// OnShutdown registers fns to be called in order once the server and its services are shut down,
+// it's meant for closing the resources shared by the services, like the database.
+func (s *Server) OnShutdown(fns ...func() error) {
+	s.onShutdown = append(s.onShutdown, fns...)
+}
+
 func (s *Server) Shutdown(ctx context.Context, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	err := s.http.Shutdown(ctx)
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		slog.LogAttrs(ctx, slog.LevelError, "server shutdown", slog.String("addr", s.http.Addr))
-		slog.Error(fmt.Errorf("server shutdown: %w", err).Error())
-		return err
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		err := s.http.Shutdown(egCtx)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.LogAttrs(ctx, slog.LevelError, "server shutdown", slog.String("addr", s.http.Addr))
+			return fmt.Errorf("server shutdown: %w", err)
+		}
+
+		return nil
+	})
+
+	// hijacked connections are left alone by http.Server.Shutdown
+	for _, service := range s.services {
+		if d, ok := service.(Drainer); ok {
+			eg.Go(func() error {
+				if err := d.Drain(ctx, s.reconnectDelay); err != nil {
+					return fmt.Errorf("%s drain: %w", service.MountPath(), err)
+				}
+
+				return nil
+			})
+		}
+	}
+
+	err := eg.Wait()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	for _, fn := range s.onShutdown {
+		if err := fn(); err != nil {
+			slog.Error(fmt.Errorf("server shutdown: %w", err).Error())
+		}
 	}
 
-	return nil
+	return err
 }
 
 func setupControllers(mux *http.ServeMux, services ...Service) {
@@ -117,10 +190,9 @@ type Handler func(w http.ResponseWriter, r *http.Request) error
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := h(w, r); err != nil {
-		var handlerError *HandlerError
+		var handlerError HandlerError
 		if errors.As(err, &handlerError) {
-			err := err.(HandlerError)
-			http.Error(w, err.Msg, err.Code)
+			http.Error(w, handlerError.Msg, handlerError.Code)
 			return
 		}
 
@@ -128,3 +200,11 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unexpected error", http.StatusInternalServerError)
 	}
 }
+
+// WriteJSON writes v as the JSON body of the response with the status code.
+func WriteJSON(w http.ResponseWriter, code int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	return json.NewEncoder(w).Encode(v)
+}
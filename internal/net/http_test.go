@@ -0,0 +1,208 @@
+package net_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	gonet "net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+	websocket "github.com/pmoieni/rmx/internal/net/websocket2"
+)
+
+// countingBackplane counts the subscriptions of the hubs, they're removed
+// once the hubs are stopped.
+type countingBackplane struct {
+	*backplane.Memory
+
+	mu   sync.Mutex
+	subs int
+	// subscriptions left when the backplane was closed
+	leftAtClose int
+	closed      bool
+}
+
+func (b *countingBackplane) Subscribe(ctx context.Context, room string, fn func(*backplane.Message)) (func(), error) {
+	unsubscribe, err := b.Memory.Subscribe(ctx, room, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.subs++
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+
+			b.mu.Lock()
+			b.subs--
+			b.mu.Unlock()
+		})
+	}, nil
+}
+
+func (b *countingBackplane) Close() error {
+	b.mu.Lock()
+	b.leftAtClose, b.closed = b.subs, true
+	b.mu.Unlock()
+
+	return b.Memory.Close()
+}
+
+// jams serves the hubs of a HubStore by room.
+type jams struct {
+	hubs *websocket.HubStore
+}
+
+func (j *jams) MountPath() string { return "jams" }
+
+func (j *jams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hub, err := j.hubs.GetOrCreate(r.URL.Query().Get("room"), &websocket.HubOptions{Capacity: 5})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hub.ServeHTTP(w, r)
+}
+
+func (j *jams) Drain(ctx context.Context, retry time.Duration) error {
+	return j.hubs.Drain(ctx, retry)
+}
+
+func TestShutdownDrain(t *testing.T) {
+	bp := &countingBackplane{Memory: backplane.NewMemory()}
+	svc := &jams{hubs: websocket.NewHubStore(bp, &websocket.HubOptions{})}
+
+	srv := net.NewServer(&net.ServerFlags{Host: "127.0.0.1", ReconnectDelay: 3 * time.Second}, svc)
+	srv.OnShutdown(bp.Close)
+
+	// the websocket connections are hijacked, they're served on their own
+	ts := httptest.NewServer(svc)
+	defer ts.Close()
+
+	var conns []*wsConn
+	for _, room := range []string{"a", "a", "b"} {
+		conns = append(conns, dial(t, ts.URL+"?room="+room))
+	}
+
+	// every member got its presence snapshot, they're all registered
+	for _, c := range conns {
+		if _, err := c.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := srv.Shutdown(context.Background(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range conns {
+		retryAfter, code := c.untilClose(t)
+		if code != 1012 {
+			t.Errorf("connection %d closed with %d, want 1012", i, code)
+		}
+		if retryAfter != 3 {
+			t.Errorf("connection %d was told to reconnect in %d s, want 3", i, retryAfter)
+		}
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if !bp.closed {
+		t.Fatal("the backplane wasn't closed")
+	}
+	if bp.leftAtClose != 0 {
+		t.Errorf("the backplane was closed with %d hubs subscribed", bp.leftAtClose)
+	}
+}
+
+// wsConn reads what the handshake buffered first.
+type wsConn struct {
+	gonet.Conn
+	r *bufio.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if c.r != nil {
+		return c.r.Read(p)
+	}
+
+	return c.Conn.Read(p)
+}
+
+func dial(t *testing.T, url string) *wsConn {
+	t.Helper()
+
+	conn, br, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(url, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &wsConn{conn, br}
+}
+
+// next returns the next envelope, or a wsutil.ClosedError with the status of
+// the close frame. wsutil rejects 1012 (service restart), the frames are read as they are.
+func (c *wsConn) next() (msg.Envelope, error) {
+	var env msg.Envelope
+
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		f, err := ws.ReadFrame(c)
+		if err != nil {
+			return env, err
+		}
+
+		switch f.Header.OpCode {
+		case ws.OpClose:
+			code, reason := ws.ParseCloseFrameData(f.Payload)
+			return env, wsutil.ClosedError{Code: code, Reason: reason}
+		case ws.OpBinary:
+			return env, env.UnmarshalBinary(f.Payload)
+		}
+	}
+}
+
+// untilClose reads until the close frame, it returns the RetryAfter of the
+// restart notice and the status of the close frame.
+func (c *wsConn) untilClose(t *testing.T) (int, ws.StatusCode) {
+	t.Helper()
+
+	retryAfter := 0
+	for {
+		env, err := c.next()
+
+		var closed wsutil.ClosedError
+		if errors.As(err, &closed) {
+			return retryAfter, closed.Code
+		}
+		if err != nil {
+			t.Fatalf("waiting for the close frame: %v", err)
+		}
+
+		if env.Typ == msg.Notice {
+			var notice msg.NoticePayload
+			if err := json.Unmarshal(env.Payload, &notice); err != nil {
+				t.Fatal(err)
+			}
+			retryAfter = notice.RetryAfter
+		}
+	}
+}
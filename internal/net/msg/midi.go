@@ -0,0 +1,97 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+MIDI payload layout, all integers are big endian:
+
+	header, 20 bytes
+		[0]     flags, see MIDIQuantize
+		[1:4]   reserved
+		[4:20]  source, the connection id of the sender, filled in by the server
+	events, 12 bytes each
+		[0]     status, the MIDI status byte including the channel
+		[1]     data1
+		[2]     data2
+		[3]     reserved
+		[4:12]  time in nanoseconds
+
+Clients send the time of each event relative to when the message is sent,
+the server replaces it with the server clock time in unix nanoseconds.
+*/
+type MIDIPayload []byte
+
+const (
+	MIDIHeaderSize = 20
+	MIDIEventSize  = 12
+
+	// MIDIQuantize asks the server to snap the events to the BPM grid of the jam.
+	MIDIQuantize byte = 0x1
+)
+
+const (
+	NoteOff       byte = 0x80
+	NoteOn        byte = 0x90
+	ControlChange byte = 0xB0
+	PitchBend     byte = 0xE0
+)
+
+var (
+	errMIDITooShort     = errors.New("midi: payload too short")
+	errMIDIBadLength    = errors.New("midi: events are not 12 bytes each")
+	errMIDIUnsupported  = errors.New("midi: unsupported status")
+	errMIDIInvalidValue = errors.New("midi: data bytes must be 7 bit")
+)
+
+func (p MIDIPayload) Validate() error {
+	if len(p) < MIDIHeaderSize+MIDIEventSize {
+		return errMIDITooShort
+	}
+
+	if (len(p)-MIDIHeaderSize)%MIDIEventSize != 0 {
+		return errMIDIBadLength
+	}
+
+	for i := range p.Len() {
+		e := p.Event(i)
+
+		switch e.Kind() {
+		case NoteOff, NoteOn, ControlChange, PitchBend:
+		default:
+			return errMIDIUnsupported
+		}
+
+		if e[1]&0x80 != 0 || e[2]&0x80 != 0 {
+			return errMIDIInvalidValue
+		}
+	}
+
+	return nil
+}
+
+func (p MIDIPayload) Flags() byte { return p[0] }
+
+func (p MIDIPayload) SetSource(id [16]byte) { copy(p[4:MIDIHeaderSize], id[:]) }
+
+// Len returns the number of events.
+func (p MIDIPayload) Len() int { return (len(p) - MIDIHeaderSize) / MIDIEventSize }
+
+// Event returns the i-th event, it shares the memory of p.
+func (p MIDIPayload) Event(i int) MIDIEvent {
+	off := MIDIHeaderSize + i*MIDIEventSize
+	return MIDIEvent(p[off : off+MIDIEventSize])
+}
+
+type MIDIEvent []byte
+
+// Kind returns the status without the channel.
+func (e MIDIEvent) Kind() byte { return e[0] & 0xF0 }
+
+func (e MIDIEvent) Channel() byte { return e[0] & 0x0F }
+
+func (e MIDIEvent) Time() int64 { return int64(binary.BigEndian.Uint64(e[4:12])) }
+
+func (e MIDIEvent) SetTime(t int64) { binary.BigEndian.PutUint64(e[4:12], uint64(t)) }
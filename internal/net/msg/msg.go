@@ -2,7 +2,9 @@ package msg
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"unicode/utf8"
 )
 
 type Version uint8
@@ -13,11 +15,8 @@ const (
 
 	V1 Version = 0x1
 
-	msgTypeMask = 0xFC
-
-	Binary MsgType = 0x1
-	TEXT   MsgType = 0x2
-	JSON   MsgType = 0x3
+	// MaxPayloadSize is the size of the largest payload of an Envelope.
+	MaxPayloadSize = 0xFFFF
 )
 
 type Envelope struct {
@@ -26,6 +25,20 @@ type Envelope struct {
 	Payload []byte
 }
 
+func New(typ MsgType, payload []byte) *Envelope {
+	return &Envelope{Ver: V1, Typ: typ, Payload: payload}
+}
+
+// NewJSON returns an Envelope with v encoded as JSON as its payload.
+func NewJSON(typ MsgType, v any) (*Envelope, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(typ, bs), nil
+}
+
 func (e *Envelope) MarshalBinary() ([]byte, error) {
 	header := make([]byte, 4)
 	header[0] = byte(e.Ver)
@@ -57,12 +70,32 @@ func (e *Envelope) UnmarshalBinary(bs []byte) error {
 	return nil
 }
 
+// MarshalJSON encodes e for the transports that can't carry binary frames.
+// JSON payloads are embedded as is, text as a string and the others are base64 encoded.
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	info, _ := Lookup(e.Typ)
+
+	var payload any = e.Payload
+	switch {
+	case info.JSON && json.Valid(e.Payload):
+		payload = json.RawMessage(e.Payload)
+	case e.Typ == TEXT && utf8.Valid(e.Payload):
+		payload = string(e.Payload)
+	}
+
+	return json.Marshal(struct {
+		Ver     Version `json:"ver"`
+		Type    string  `json:"type"`
+		Payload any     `json:"payload"`
+	}{e.Ver, info.Name, payload})
+}
+
 func validate(bs []byte) error {
 	if len(bs) < 4 {
 		return errors.New("missing header")
 	}
 
-	if len(bs[4:])&^0xFFFF != 0 {
+	if len(bs[4:]) > MaxPayloadSize {
 		return errors.New("payload too big")
 	}
 
@@ -70,10 +103,9 @@ func validate(bs []byte) error {
 		return errors.New("unsupported version")
 	}
 
-	if bs[1]&msgTypeMask != 0 {
+	if _, ok := Lookup(MsgType(bs[1])); !ok {
 		return errors.New("unsupported type")
 	}
 
 	return nil
 }
-
@@ -0,0 +1,61 @@
+package msg
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TypeInfo describes how the hub treats a MsgType.
+type TypeInfo struct {
+	Name string
+	// FromServer types can't be sent by clients.
+	FromServer bool
+	// Ephemeral types are relayed but never persisted or replayed.
+	Ephemeral bool
+	// Routable types can be wrapped in a Route envelope.
+	Routable bool
+	// JSON types have a JSON encoded payload, see Envelope.MarshalJSON.
+	JSON bool
+	// Passive types don't change the state of the room, spectators can send them.
+	Passive bool
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[MsgType]TypeInfo)
+)
+
+// Register adds typ to the envelope registry, envelopes of unregistered types are rejected.
+// It panics if typ is already registered.
+func Register(typ MsgType, info TypeInfo) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[typ]; ok {
+		panic(fmt.Sprintf("msg: type %d is already registered", typ))
+	}
+
+	registry[typ] = info
+}
+
+func Lookup(typ MsgType) (TypeInfo, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	info, ok := registry[typ]
+	return info, ok
+}
+
+// LookupName returns the type registered with name.
+func LookupName(name string) (MsgType, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	for typ, info := range registry {
+		if info.Name == name {
+			return typ, true
+		}
+	}
+
+	return 0, false
+}
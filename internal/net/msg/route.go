@@ -0,0 +1,65 @@
+package msg
+
+import "errors"
+
+/*
+Route payload layout:
+
+	[0]      target kind, see RouteMember, RouteRole and RouteTopic
+	[1]      length of the target
+	[2:2+n]  target
+	[2+n:]   envelope delivered to the recipients
+*/
+type RoutePayload []byte
+
+const (
+	// RouteMember targets a single connection by id.
+	RouteMember byte = 0x1
+	// RouteRole targets every member with a role, e.g. "editor".
+	RouteRole byte = 0x2
+	// RouteTopic targets the members subscribed to a topic, e.g. "track:<id>".
+	RouteTopic byte = 0x3
+
+	MaxTargetLength = 0xFF
+)
+
+var (
+	errRouteTooShort = errors.New("route: payload too short")
+	errRouteKind     = errors.New("route: unsupported target kind")
+	errRouteTarget   = errors.New("route: invalid target")
+)
+
+func NewRoute(kind byte, target string, envelope []byte) (RoutePayload, error) {
+	if len(target) == 0 || len(target) > MaxTargetLength {
+		return nil, errRouteTarget
+	}
+
+	p := make([]byte, 0, 2+len(target)+len(envelope))
+	p = append(p, kind, byte(len(target)))
+	p = append(p, target...)
+	p = append(p, envelope...)
+
+	return p, nil
+}
+
+// Parse returns the target of the route and the envelope to deliver,
+// the envelope shares the memory of p.
+func (p RoutePayload) Parse() (kind byte, target string, envelope []byte, err error) {
+	if len(p) < 2 {
+		return 0, "", nil, errRouteTooShort
+	}
+
+	kind = p[0]
+	switch kind {
+	case RouteMember, RouteRole, RouteTopic:
+	default:
+		return 0, "", nil, errRouteKind
+	}
+
+	n := int(p[1])
+	if n == 0 || len(p) < 2+n {
+		return 0, "", nil, errRouteTarget
+	}
+
+	return kind, string(p[2 : 2+n]), p[2+n:], nil
+}
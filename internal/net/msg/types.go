@@ -0,0 +1,238 @@
+package msg
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	Binary MsgType = 0x1
+	TEXT   MsgType = 0x2
+	JSON   MsgType = 0x3
+
+	// Notice is sent by the server, the payload is a JSON encoded NoticePayload.
+	Notice MsgType = 0x4
+	// Presence is sent by the server with a JSON encoded PresencePayload,
+	// clients send a JSON encoded PresenceUpdate.
+	Presence MsgType = 0x5
+	// Awareness is sent by the server with a JSON encoded AwarenessPayload,
+	// clients send their state as JSON.
+	Awareness MsgType = 0x6
+	// MIDI carries timestamped MIDI events, see MIDIPayload.
+	MIDI MsgType = 0x7
+	// Signal carries WebRTC signaling between two members, the payload is a JSON encoded SignalPayload.
+	Signal MsgType = 0x8
+	// Route delivers the envelope it wraps to a member, a role or a topic, see RoutePayload.
+	Route MsgType = 0x9
+	// Subscribe changes the topics of a connection, the payload is a JSON encoded SubscribePayload.
+	Subscribe MsgType = 0xA
+	// Error is sent by the server when a message of the client was dropped,
+	// the payload is a JSON encoded ErrorPayload.
+	Error MsgType = 0xB
+	// Promote is sent by a spectator to become a player, it has no payload.
+	// The presence of the member is updated if a slot was free, otherwise an
+	// Error with ErrorRoomFull is sent back.
+	Promote MsgType = 0xC
+	// Lobby is sent by the server to the members waiting for a slot, the
+	// payload is a JSON encoded LobbyPayload.
+	Lobby MsgType = 0xD
+	// Admit is sent by the owner to let a waiting member in or turn them away,
+	// the payload is a JSON encoded AdmitPayload.
+	Admit MsgType = 0xE
+	// Moderate is sent by owners and editors to act on a member or the room,
+	// the server sends it to the room once applied. The payload is a JSON
+	// encoded ModeratePayload.
+	Moderate MsgType = 0xF
+	// Chat carries the text chat of the room, the payload is a JSON encoded ChatPayload.
+	Chat MsgType = 0x10
+)
+
+func init() {
+	Register(Binary, TypeInfo{Name: "binary", Routable: true})
+	Register(TEXT, TypeInfo{Name: "text", Routable: true})
+	Register(JSON, TypeInfo{Name: "json", Routable: true, JSON: true})
+	Register(Notice, TypeInfo{Name: "notice", FromServer: true, Ephemeral: true, JSON: true})
+	Register(Presence, TypeInfo{Name: "presence", Ephemeral: true, JSON: true})
+	Register(Awareness, TypeInfo{Name: "awareness", Ephemeral: true, JSON: true})
+	Register(MIDI, TypeInfo{Name: "midi", Routable: true})
+	Register(Signal, TypeInfo{Name: "signal", Ephemeral: true, JSON: true, Passive: true})
+	Register(Route, TypeInfo{Name: "route", Ephemeral: true})
+	Register(Subscribe, TypeInfo{Name: "subscribe", Ephemeral: true, JSON: true, Passive: true})
+	Register(Error, TypeInfo{Name: "error", FromServer: true, Ephemeral: true, JSON: true})
+	Register(Promote, TypeInfo{Name: "promote", Ephemeral: true, Passive: true})
+	Register(Lobby, TypeInfo{Name: "lobby", FromServer: true, Ephemeral: true, JSON: true})
+	Register(Admit, TypeInfo{Name: "admit", Ephemeral: true, JSON: true})
+	Register(Moderate, TypeInfo{Name: "moderate", Ephemeral: true, JSON: true})
+	// chat is persisted on its own, it's not part of the recordings
+	Register(Chat, TypeInfo{Name: "chat", Ephemeral: true, JSON: true})
+}
+
+const (
+	NoticeRestart = "restart"
+)
+
+type NoticePayload struct {
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+	// RetryAfter is the number of seconds the client should wait before reconnecting.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+const (
+	ErrorRateLimited = "rate_limited"
+	ErrorTooLarge    = "too_large"
+	// ErrorForbidden is sent to spectators for the messages only players can send.
+	ErrorForbidden = "forbidden"
+	ErrorRoomFull  = "room_full"
+	ErrorInvalid   = "invalid"
+)
+
+type ErrorPayload struct {
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+	// Type of the dropped message if it could be read.
+	Type MsgType `json:"type,omitempty"`
+	// RetryAfter is the number of milliseconds before the client can send again.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+const (
+	PresenceOpSnapshot = "snapshot"
+	PresenceOpJoin     = "join"
+	PresenceOpUpdate   = "update"
+	PresenceOpLeave    = "leave"
+	// PresenceOpSync is sent between hubs when a room is opened on a new instance,
+	// the other hubs answer with their members.
+	PresenceOpSync = "sync"
+)
+
+// MemberPresence is the state of a connection in a room.
+type MemberPresence struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId,omitempty"`
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	Instrument string    `json:"instrument,omitempty"`
+	Muted      bool      `json:"muted"`
+	Soloed     bool      `json:"soloed"`
+	Idle       bool      `json:"idle"`
+	LastActive time.Time `json:"lastActive"`
+	// WaitingSince is set while the member waits in the lobby for a slot.
+	WaitingSince *time.Time `json:"waitingSince,omitempty"`
+	// Silenced members were muted by a moderator, their messages are dropped.
+	Silenced bool `json:"silenced,omitempty"`
+}
+
+type PresencePayload struct {
+	Op      string           `json:"op"`
+	Members []MemberPresence `json:"members,omitempty"`
+}
+
+// PresenceUpdate is sent by clients, nil fields are left unchanged.
+type PresenceUpdate struct {
+	Instrument *string `json:"instrument,omitempty"`
+	Muted      *bool   `json:"muted,omitempty"`
+	Soloed     *bool   `json:"soloed,omitempty"`
+}
+
+const (
+	// LobbyWaiting is sent when the position of the member in the waitlist changes.
+	LobbyWaiting  = "waiting"
+	LobbyAdmitted = "admitted"
+	LobbyDenied   = "denied"
+)
+
+type LobbyPayload struct {
+	Op string `json:"op"`
+	// Position in the waitlist, starting at 1.
+	Position int `json:"position,omitempty"`
+	// Approval is set when the owner has to let the member in.
+	Approval bool `json:"approval,omitempty"`
+}
+
+type AdmitPayload struct {
+	// ID is the connection id of the waiting member.
+	ID   string `json:"id"`
+	Deny bool   `json:"deny,omitempty"`
+}
+
+const (
+	ModerateKick   = "kick"
+	ModerateBan    = "ban"
+	ModerateMute   = "mute"
+	ModerateUnmute = "unmute"
+	ModerateLock   = "lock"
+	ModerateUnlock = "unlock"
+)
+
+// ModeratePayload is a moderation of a member or the room, clients set Action,
+// Target and Reason and the server fills the rest in.
+type ModeratePayload struct {
+	Action string `json:"action"`
+	// Target is the connection id of the member, empty for lock and unlock.
+	Target       string `json:"target,omitempty"`
+	TargetUserID string `json:"targetUserId,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	// ActorID is the connection id of the moderator, empty for the moderations made over HTTP.
+	ActorID     string `json:"actorId,omitempty"`
+	ActorUserID string `json:"actorUserId,omitempty"`
+	ActorName   string `json:"actorName,omitempty"`
+}
+
+const (
+	ChatSend   = "send"
+	ChatEdit   = "edit"
+	ChatDelete = "delete"
+	// ChatHistory is sent by the server with the last messages of the room when a member joins.
+	ChatHistory = "history"
+)
+
+type ChatMessage struct {
+	ID string `json:"id"`
+	// AuthorID is the connection id of the author.
+	AuthorID     string     `json:"authorId"`
+	AuthorUserID string     `json:"authorUserId,omitempty"`
+	AuthorName   string     `json:"authorName"`
+	Text         string     `json:"text"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	EditedAt     *time.Time `json:"editedAt,omitempty"`
+}
+
+// ChatPayload is sent by clients with Op and the ID and Text it needs, the
+// server sends the Message that was sent or edited, the ID of a deleted one
+// or the Messages of the history.
+type ChatPayload struct {
+	Op       string        `json:"op"`
+	ID       string        `json:"id,omitempty"`
+	Text     string        `json:"text,omitempty"`
+	Message  *ChatMessage  `json:"message,omitempty"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+}
+
+type AwarenessPayload struct {
+	ID    string          `json:"id"`
+	State json.RawMessage `json:"state"`
+}
+
+const (
+	SignalOffer     = "offer"
+	SignalAnswer    = "answer"
+	SignalCandidate = "candidate"
+	// SignalBye tells the peer the connection is closed.
+	SignalBye = "bye"
+)
+
+type SignalPayload struct {
+	Kind string `json:"kind"`
+	// From is set by the server to the connection id of the sender.
+	From string `json:"from,omitempty"`
+	// To is the connection id of the recipient.
+	To        string          `json:"to"`
+	SDP       string          `json:"sdp,omitempty"`
+	Candidate json.RawMessage `json:"candidate,omitempty"`
+}
+
+type SubscribePayload struct {
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+const (
+	// messages sent to the members when they join
+	defaultChatHistory = 50
+	maxChatLength      = 2000
+	// chat messages of the room waiting to be persisted
+	chatQueueSize = 256
+	// room left in the history envelopes for the fields around the messages
+	chatHistoryOverhead = 64
+)
+
+var (
+	ErrChatDisabled        = errors.New("chat is disabled in this room")
+	ErrChatMessageNotFound = errors.New("chat message not found")
+	errChatText            = errors.New("chat message should be 1-2000 characters long")
+)
+
+// ChatAuthor is who edits or deletes a message, signed in members are known
+// by their user id and the others by their connection.
+type ChatAuthor struct {
+	ConnID string
+	UserID string
+}
+
+// ChatStore persists the chat of a room.
+type ChatStore interface {
+	// LastMessages returns the last n messages, oldest first.
+	LastMessages(ctx context.Context, n int) ([]msg.ChatMessage, error)
+	SaveMessage(ctx context.Context, m *msg.ChatMessage) error
+	// EditMessage and DeleteMessage return ErrChatMessageNotFound if the
+	// message doesn't exist or wasn't sent by author.
+	EditMessage(ctx context.Context, id string, author ChatAuthor, text string) (*msg.ChatMessage, error)
+	DeleteMessage(ctx context.Context, id string, author ChatAuthor) error
+}
+
+// chatTask is a chat message sent by conn waiting to be persisted.
+type chatTask struct {
+	conn *TransportHandler
+	cp   msg.ChatPayload
+}
+
+// handleChat queues a chat message sent by conn, it's persisted and sent to
+// the room by the chatWriter so the reader of conn never waits on the
+// ChatStore. Called by the reader of conn.
+func (cli *Hub) handleChat(conn *TransportHandler, payload []byte) {
+	var cp msg.ChatPayload
+	if err := json.Unmarshal(payload, &cp); err != nil {
+		slog.Debug("chat unmarshal", "err", err)
+		return
+	}
+
+	if cli.Chat == nil {
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorInvalid, Msg: ErrChatDisabled.Error(), Type: msg.Chat})
+		return
+	}
+
+	select {
+	case cli.chatq <- chatTask{conn: conn, cp: cp}:
+	default:
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorRateLimited, Msg: "too many chat messages in the room", Type: msg.Chat})
+	}
+}
+
+// chatWriter persists the queued chat messages in order and sends them to the room.
+func (cli *Hub) chatWriter() {
+	for {
+		select {
+		case <-cli.done:
+			return
+		case t := <-cli.chatq:
+			cli.persistChat(t.conn, &t.cp)
+		}
+	}
+}
+
+// persistChat applies cp sent by conn to the ChatStore and sends the result to the room.
+func (cli *Hub) persistChat(conn *TransportHandler, cp *msg.ChatPayload) {
+	out, err := cli.chat(conn, cp)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrChatDisabled), errors.Is(err, ErrChatMessageNotFound), errors.Is(err, errChatText):
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorInvalid, Msg: err.Error(), Type: msg.Chat})
+		return
+	default:
+		slog.Error("chat", "err", err)
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorInvalid, Msg: "unexpected error", Type: msg.Chat})
+		return
+	}
+
+	env, err := msg.NewJSON(msg.Chat, out)
+	if err != nil {
+		slog.Error("chat marshal", "err", err)
+		return
+	}
+	m := newMessage(env)
+
+	cli.do(func() {
+		if m != nil {
+			cli.emit(m)
+		}
+		cli.applyChat(out)
+	})
+}
+
+// chat applies cp to the ChatStore and returns what's sent to the room.
+func (cli *Hub) chat(conn *TransportHandler, cp *msg.ChatPayload) (*msg.ChatPayload, error) {
+	if cli.Chat == nil {
+		return nil, ErrChatDisabled
+	}
+
+	ctx := context.Background()
+	author := ChatAuthor{ConnID: conn.id, UserID: conn.member.UserID}
+
+	switch cp.Op {
+	case msg.ChatSend:
+		text, err := chatText(cp.Text)
+		if err != nil {
+			return nil, err
+		}
+
+		m := &msg.ChatMessage{
+			ID:           uuid.NewString(),
+			AuthorID:     conn.id,
+			AuthorUserID: conn.member.UserID,
+			AuthorName:   conn.member.Name,
+			Text:         text,
+			CreatedAt:    time.Now().UTC(),
+		}
+		if err := cli.Chat.SaveMessage(ctx, m); err != nil {
+			return nil, err
+		}
+
+		return &msg.ChatPayload{Op: msg.ChatSend, Message: m}, nil
+	case msg.ChatEdit:
+		text, err := chatText(cp.Text)
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := cli.Chat.EditMessage(ctx, cp.ID, author, text)
+		if err != nil {
+			return nil, err
+		}
+
+		return &msg.ChatPayload{Op: msg.ChatEdit, Message: m}, nil
+	case msg.ChatDelete:
+		if err := cli.Chat.DeleteMessage(ctx, cp.ID, author); err != nil {
+			return nil, err
+		}
+
+		return &msg.ChatPayload{Op: msg.ChatDelete, ID: cp.ID}, nil
+	}
+
+	return nil, ErrChatMessageNotFound
+}
+
+func chatText(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || utf8.RuneCountInString(s) > maxChatLength {
+		return "", errChatText
+	}
+
+	return s, nil
+}
+
+// applyChat keeps the last messages of the room up to date. Called from the listen goroutine.
+func (cli *Hub) applyChat(cp *msg.ChatPayload) {
+	switch cp.Op {
+	case msg.ChatSend:
+		if cp.Message == nil {
+			return
+		}
+
+		cli.chatHistory = append(cli.chatHistory, *cp.Message)
+		if n := len(cli.chatHistory) - cli.ChatHistory; n > 0 {
+			cli.chatHistory = slices.Delete(cli.chatHistory, 0, n)
+		}
+	case msg.ChatEdit:
+		if cp.Message == nil {
+			return
+		}
+
+		if i := cli.chatIndex(cp.Message.ID); i >= 0 {
+			cli.chatHistory[i] = *cp.Message
+		}
+	case msg.ChatDelete:
+		if i := cli.chatIndex(cp.ID); i >= 0 {
+			cli.chatHistory = slices.Delete(cli.chatHistory, i, i+1)
+		}
+	}
+}
+
+func (cli *Hub) chatIndex(id string) int {
+	return slices.IndexFunc(cli.chatHistory, func(m msg.ChatMessage) bool {
+		return m.ID == id
+	})
+}
+
+// handleRemoteChat keeps the last messages in sync with the other instances before delivering m.
+func (cli *Hub) handleRemoteChat(m *wsutil.Message, payload []byte) {
+	var cp msg.ChatPayload
+	if err := json.Unmarshal(payload, &cp); err != nil {
+		slog.Debug("remote chat unmarshal", "err", err)
+		return
+	}
+
+	cli.applyChat(&cp)
+	cli.deliver(m)
+}
+
+// sendChatHistory sends the last messages of the room to conn. Called from the listen goroutine.
+func (cli *Hub) sendChatHistory(conn *TransportHandler) {
+	for _, m := range cli.chatHistoryMessages() {
+		cli.sendTo(conn, m)
+	}
+}
+
+// chatHistoryMessages returns the last messages of the chat oldest first, split
+// in as many envelopes as it takes to fit them. Called from the listen goroutine.
+func (cli *Hub) chatHistoryMessages() []*wsutil.Message {
+	var (
+		ms          []*wsutil.Message
+		start, size int
+	)
+	flush := func(end int) {
+		if end == start {
+			return
+		}
+
+		env, err := msg.NewJSON(msg.Chat, &msg.ChatPayload{Op: msg.ChatHistory, Messages: cli.chatHistory[start:end]})
+		if err != nil {
+			slog.Error("chat marshal", "err", err)
+			return
+		}
+		if m := newMessage(env); m != nil {
+			ms = append(ms, m)
+		}
+	}
+
+	for i := range cli.chatHistory {
+		bs, err := json.Marshal(&cli.chatHistory[i])
+		if err != nil {
+			slog.Error("chat marshal", "err", err)
+			continue
+		}
+
+		// and the comma between the messages
+		n := len(bs) + 1
+		if size+n > msg.MaxPayloadSize-chatHistoryOverhead {
+			flush(i)
+			start, size = i, 0
+		}
+		size += n
+	}
+	flush(len(cli.chatHistory))
+
+	return ms
+}
+
+// loadChat loads the last messages of the room from the ChatStore, the ones
+// sent since the hub was created are kept.
+func (cli *Hub) loadChat() {
+	messages, err := cli.Chat.LastMessages(context.Background(), cli.ChatHistory)
+	if err != nil {
+		slog.Error("chat load", "err", err)
+		return
+	}
+
+	cli.do(func() {
+		loaded := make([]msg.ChatMessage, 0, len(messages)+len(cli.chatHistory))
+		for _, m := range messages {
+			if cli.chatIndex(m.ID) < 0 {
+				loaded = append(loaded, m)
+			}
+		}
+
+		cli.chatHistory = append(loaded, cli.chatHistory...)
+		if n := len(cli.chatHistory) - cli.ChatHistory; n > 0 {
+			cli.chatHistory = slices.Delete(cli.chatHistory, 0, n)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// memoryChat keeps the messages of the room in memory.
+type memoryChat struct {
+	mu       sync.Mutex
+	messages []msg.ChatMessage
+}
+
+func (c *memoryChat) LastMessages(_ context.Context, n int) ([]msg.ChatMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.messages[max(0, len(c.messages)-n):]), nil
+}
+
+func (c *memoryChat) SaveMessage(_ context.Context, m *msg.ChatMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messages = append(c.messages, *m)
+	return nil
+}
+
+func (c *memoryChat) EditMessage(context.Context, string, ChatAuthor, string) (*msg.ChatMessage, error) {
+	return nil, ErrChatMessageNotFound
+}
+
+func (c *memoryChat) DeleteMessage(context.Context, string, ChatAuthor) error {
+	return ErrChatMessageNotFound
+}
+
+// blockingChat saves the messages once they're released.
+type blockingChat struct {
+	memoryChat
+	release chan struct{}
+}
+
+func (c *blockingChat) SaveMessage(ctx context.Context, m *msg.ChatMessage) error {
+	<-c.release
+	return c.memoryChat.SaveMessage(ctx, m)
+}
+
+func TestChatUserRate(t *testing.T) {
+	limits := DefaultLimits()
+	limits.UserRates[msg.Chat] = Rate{PerSecond: 0.01, Burst: 1}
+
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 5, Chat: &memoryChat{}, Limits: limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	bob, _ := join(t, srv, "n=bob&u=bob-id")
+	bob.send(msg.Chat, &msg.ChatPayload{Op: msg.ChatSend, Text: "hello"})
+	bob.expect(msg.Chat)
+
+	// another connection of bob shares the bucket
+	again, _ := join(t, srv, "n=bob&u=bob-id")
+	again.send(msg.Chat, &msg.ChatPayload{Op: msg.ChatSend, Text: "hello again"})
+
+	var ep msg.ErrorPayload
+	again.expectJSON(msg.Error, &ep)
+	if ep.Code != msg.ErrorRateLimited || ep.Type != msg.Chat {
+		t.Errorf("the second connection of bob got %+v, want to be rate limited", ep)
+	}
+
+	// the anonymous members have one each
+	carol, _ := join(t, srv, "n=carol")
+	carol.send(msg.Chat, &msg.ChatPayload{Op: msg.ChatSend, Text: "hi"})
+
+	// after the history sent when carol joined
+	var cp msg.ChatPayload
+	for cp.Op != msg.ChatSend {
+		carol.expectJSON(msg.Chat, &cp)
+	}
+	if cp.Message == nil || cp.Message.Text != "hi" {
+		t.Errorf("carol got %+v, want their message", cp)
+	}
+}
+
+func TestChatAsync(t *testing.T) {
+	chat := &blockingChat{release: make(chan struct{})}
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 5, Chat: chat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	alice, _ := join(t, srv, "n=alice")
+	bob, _ := join(t, srv, "n=bob")
+	alice.expect(msg.Presence)
+
+	// the reader of alice doesn't wait for the message to be saved
+	alice.send(msg.Chat, &msg.ChatPayload{Op: msg.ChatSend, Text: "hello"})
+	alice.send(msg.Presence, &msg.PresenceUpdate{})
+	if env, err := bob.next(); err != nil || env.Typ != msg.Presence {
+		t.Fatalf("bob got %v (%v), want the presence of alice first", env.Typ, err)
+	}
+
+	close(chat.release)
+
+	var cp msg.ChatPayload
+	bob.expectJSON(msg.Chat, &cp)
+	if cp.Op != msg.ChatSend || cp.Message == nil || cp.Message.Text != "hello" {
+		t.Errorf("bob got %+v, want the message of alice once saved", cp)
+	}
+}
+
+func TestChatHistorySize(t *testing.T) {
+	// the longest messages, escaped by the JSON encoder
+	chat := &memoryChat{}
+	for i := range defaultChatHistory {
+		chat.messages = append(chat.messages, msg.ChatMessage{
+			ID:         strconv.Itoa(i),
+			AuthorName: "alice",
+			Text:       strings.Repeat("<", maxChatLength),
+			CreatedAt:  time.Now().UTC(),
+		})
+	}
+
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 5, Chat: chat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	bob, _ := join(t, srv, "n=bob")
+
+	var got []msg.ChatMessage
+	envelopes := 0
+	for len(got) < defaultChatHistory {
+		var p msg.ChatPayload
+		bob.expectJSON(msg.Chat, &p)
+		if p.Op != msg.ChatHistory {
+			t.Fatalf("bob got the chat %s, want the history", p.Op)
+		}
+
+		got = append(got, p.Messages...)
+		envelopes++
+	}
+
+	if envelopes < 2 {
+		t.Errorf("the history was sent in %d envelopes, want it split", envelopes)
+	}
+	for i, m := range got {
+		if m.ID != strconv.Itoa(i) {
+			t.Fatalf("message %d of the history is %s, want them in order", i, m.ID)
+		}
+	}
+}
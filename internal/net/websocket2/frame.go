@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// frames larger than this aren't put back in the pool so a few big messages
+// don't pin memory for the lifetime of the process
+const maxPooledFrame = 64 << 10
+
+var framePool = sync.Pool{
+	New: func() any { return new(frame) },
+}
+
+// frame is a websocket frame encoded once, header and payload, and shared by
+// every connection it's sent to. It goes back to the pool once the last
+// reference is released.
+type frame struct {
+	buf  bytes.Buffer
+	refs atomic.Int32
+}
+
+// newFrame encodes m into a pooled frame holding a single reference.
+func newFrame(m *wsutil.Message) (*frame, error) {
+	f := framePool.Get().(*frame)
+	f.buf.Reset()
+	f.refs.Store(1)
+
+	if err := ws.WriteFrame(&f.buf, ws.NewFrame(m.OpCode, true, m.Payload)); err != nil {
+		f.release()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *frame) retain() *frame {
+	f.refs.Add(1)
+	return f
+}
+
+func (f *frame) release() {
+	switch refs := f.refs.Add(-1); {
+	case refs > 0:
+		return
+	case refs < 0:
+		panic("websocket: frame released too many times")
+	}
+
+	if f.buf.Cap() <= maxPooledFrame {
+		framePool.Put(f)
+	}
+}
+
+func (f *frame) bytes() []byte { return f.buf.Bytes() }
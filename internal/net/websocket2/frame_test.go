@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+var benchListeners = []int{10, 100, 500}
+
+func benchMessage() *wsutil.Message {
+	return &wsutil.Message{OpCode: ws.OpBinary, Payload: bytes.Repeat([]byte{0xA}, 512)}
+}
+
+// benchHub returns a hub with n connections, the frames queued on them are
+// written and released by flush as the write goroutines would.
+func benchHub(n int) (cli *Hub, flush func()) {
+	cli = &Hub{connections: make(map[*TransportHandler]bool, n)}
+	for range n {
+		cli.connections[&TransportHandler{send: make(chan *frame, 1)}] = true
+	}
+
+	return cli, func() {
+		for conn := range cli.connections {
+			f := <-conn.send
+			_, _ = io.Discard.Write(f.bytes())
+			f.release()
+		}
+	}
+}
+
+func BenchmarkDeliver(b *testing.B) {
+	m := benchMessage()
+
+	for _, n := range benchListeners {
+		b.Run(fmt.Sprintf("listeners=%d", n), func(b *testing.B) {
+			cli, flush := benchHub(n)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				cli.deliver(m)
+				flush()
+			}
+		})
+	}
+}
+
+// BenchmarkEncodePerConn is the cost deliver avoids, a frame encoded for every connection.
+func BenchmarkEncodePerConn(b *testing.B) {
+	m := benchMessage()
+
+	for _, n := range benchListeners {
+		b.Run(fmt.Sprintf("listeners=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				for range n {
+					_ = ws.WriteFrame(io.Discard, ws.NewFrame(m.OpCode, true, m.Payload))
+				}
+			}
+		})
+	}
+}
+
+func TestFrameRelease(t *testing.T) {
+	f, err := newFrame(benchMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ws.ReadHeader(bytes.NewReader(f.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != ws.OpBinary || !h.Fin || h.Length != 512 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	f.retain()
+	f.release()
+	f.release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("releasing a released frame should panic")
+		}
+	}()
+	f.release()
+}
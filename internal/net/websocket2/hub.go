@@ -1,81 +1,218 @@
 package websocket
 
 import (
-	"encoding/json"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net/backplane"
 	"github.com/pmoieni/rmx/internal/net/msg"
 )
 
 func read(conn *TransportHandler, cli *Hub) {
 	defer func() {
-		cli.unregister <- conn
-		err := conn.rwc.Close()
-		if err != nil {
-			slog.Error("conn close: %v", err)
-		}
+		cli.disconnect(conn)
 		slog.Debug("read: conn closed")
 	}()
 
 	if err := conn.setReadDeadLine(pongWait); err != nil {
-		slog.Info("setReadDeadLine: %v\n", err)
+		slog.Info("setReadDeadLine", "err", err)
 		return
 	}
 
 	for {
 		wsMsg, err := conn.read()
+
+		var perr *protocolError
+		if errors.As(err, &perr) {
+			cli.violation(conn, perr)
+			if perr.fatal {
+				// the writer closes the connection once the error is sent
+				_, _ = io.Copy(io.Discard, conn.rwc)
+				return
+			}
+			continue
+		}
 		if err != nil {
 			// TODO: handle error
-			slog.Error("read err: %v\n", err)
+			slog.Error("read", "err", err)
 			break
 		}
 
-		// TODO: add a way use custom read validation here unsure how yet
-		var envelope msg.Envelope
-		slog.Info("read msg: OpCode: %v\n\n", wsMsg.OpCode)
-		if err := json.Unmarshal(wsMsg.Payload, &envelope); err != nil {
-			slog.Error("wsMsg unmarshal: %v", err)
-		} else {
-			slog.Error("read msg:\nType: %d\nID: %s\nUserID: %s\n\n", envelope.Typ, envelope.ID, envelope.UserID)
+		if !cli.handle(conn, wsMsg) {
+			return
+		}
+	}
+}
+
+// handle relays a message read from conn. It reports false once the hub is stopped.
+func (cli *Hub) handle(conn *TransportHandler, wsMsg *wsutil.Message) bool {
+	receivedAt := time.Now()
+	conn.touch()
+
+	if cli.ReadOnly || conn.limiter.out || conn.role() == RoleWaiting {
+		return true
+	}
+
+	if perr := conn.limiter.allow(receivedAt); perr != nil {
+		cli.violation(conn, perr)
+		return true
+	}
+
+	// TODO: add a way use custom read validation here unsure how yet
+	var envelope msg.Envelope
+	slog.Debug("read msg", "opCode", wsMsg.OpCode)
+	if err := envelope.UnmarshalBinary(wsMsg.Payload); err != nil {
+		slog.Debug("wsMsg unmarshal", "err", err)
+
+		// only envelopes are relayed, broken clients are disconnected after MaxStrikes
+		cli.violation(conn, &protocolError{code: msg.ErrorInvalid, msg: "malformed envelope"})
+		return true
+	}
+
+	slog.Debug("read msg", "version", envelope.Ver, "type", envelope.Typ)
+
+	info, _ := msg.Lookup(envelope.Typ)
+	if info.FromServer {
+		return true
+	}
+
+	if perr := conn.limiter.allowType(envelope.Typ, receivedAt); perr != nil {
+		cli.violation(conn, perr)
+		return true
+	}
+	if perr := cli.users.allow(conn, envelope.Typ, receivedAt); perr != nil {
+		cli.violation(conn, perr)
+		return true
+	}
+
+	if !info.Passive && conn.role() == RoleSpectator {
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorForbidden, Msg: "spectators can't send this message", Type: envelope.Typ})
+		return true
+	}
+	if !info.Passive && conn.silenced.Load() {
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorForbidden, Msg: "muted by a moderator", Type: envelope.Typ})
+		return true
+	}
+
+	switch envelope.Typ {
+	case msg.Presence:
+		cli.updatePresence(conn, envelope.Payload)
+		return true
+	case msg.Awareness:
+		cli.updateAwareness(conn, envelope.Payload)
+		return true
+	case msg.Signal:
+		cli.relaySignal(conn, envelope.Payload)
+		return true
+	case msg.Route:
+		cli.route(conn, wsMsg, envelope.Payload, receivedAt)
+		return true
+	case msg.Subscribe:
+		cli.updateSubscriptions(conn, envelope.Payload)
+		return true
+	case msg.Promote:
+		cli.promote(conn)
+		return true
+	case msg.Admit:
+		cli.handleAdmit(conn, wsMsg, envelope.Payload)
+		return true
+	case msg.Moderate:
+		cli.handleModerate(conn, envelope.Payload)
+		return true
+	case msg.Chat:
+		cli.handleChat(conn, envelope.Payload)
+		return true
+	case msg.MIDI:
+		// rewritten in place, wsMsg is relayed without copying
+		if err := cli.stampMIDI(conn, envelope.Payload, receivedAt); err != nil {
+			slog.Debug("midi", "err", err)
+			return true
+		}
+	}
+
+	select {
+	case cli.broadcast <- wsMsg:
+	case <-cli.done:
+		return false
+	}
+
+	// members connected to other instances
+	cli.publish(wsMsg)
+	return true
+}
+
+// disconnect stops reading conn and removes it from the hub and the room,
+// it's safe to call more than once.
+func (cli *Hub) disconnect(conn *TransportHandler) {
+	if conn.disconnected.Swap(true) {
+		return
+	}
+
+	// before the connection is closed, its descriptor may be reused
+	if d := conn.desc.Swap(nil); d != nil {
+		if err := cli.netpoll.poller.stop(d); err != nil {
+			slog.Error("netpoll stop", "err", err)
 		}
+	}
 
-		cli.broadcast <- wsMsg
+	select {
+	case cli.unregister <- conn:
+	case <-cli.done:
+	}
+	err := conn.rwc.Close()
+	if err != nil {
+		slog.Error("conn close", "err", err)
+	}
+	cli.leaveSeat(conn)
+
+	// the admitter was woken up by unregister before the slot was given up
+	if conn.role() != RoleSpectator && conn.role() != RoleWaiting {
+		cli.signalAdmit()
 	}
 }
 
-func write(conn *TransportHandler) {
+func write(conn *TransportHandler, cli *Hub) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		cli.writers.Done()
 		ticker.Stop()
 		slog.Debug("write: conn closed")
 		if err := conn.rwc.Close(); err != nil {
-			slog.Error("error closing connection: %v", err)
+			slog.Error("error closing connection", "err", err)
 		}
 	}()
 
 	for {
 		select {
-		case msg, ok := <-conn.send:
+		case f, ok := <-conn.send:
 			_ = conn.setWriteDeadLine(writeWait)
 			if !ok {
-				slog.Error("<-conn.send not ok")
-				_ = conn.write(&wsutil.Message{OpCode: ws.OpClose, Payload: []byte{}})
+				slog.Debug("<-conn.send not ok")
+				_ = conn.write(&wsutil.Message{OpCode: ws.OpClose, Payload: conn.closeBody()})
 				return
 			}
 
-			if err := conn.write(msg); err != nil {
-				slog.Error("msg err: %v\n", err)
+			_, err := conn.rwc.Write(f.bytes())
+			f.release()
+			if err != nil {
+				slog.Error("msg", "err", err)
 				return
 			}
 		case <-ticker.C:
 			_ = conn.setWriteDeadLine(writeWait)
 			if err := conn.write(&wsutil.Message{OpCode: ws.OpPing, Payload: nil}); err != nil {
-				slog.Error("ticker err: %v\n", err)
+				slog.Error("ticker", "err", err)
 				return
 			}
 		}
@@ -83,15 +220,112 @@ func write(conn *TransportHandler) {
 }
 
 type Hub struct {
+	// id is unique to this hub, room is shared by the hubs of all instances
+	id, room    string
+	bp          backplane.Backplane
+	unsubscribe func()
+
 	register, unregister chan *TransportHandler
-	broadcast            chan *wsutil.Message
+	broadcast, remote    chan *wsutil.Message
+	tasks                chan func()
+	outbox               chan *wsutil.Message
 	lock                 *sync.Mutex
 	connections          map[*TransportHandler]bool
 	upgrader             *ws.HTTPUpgrader
 
+	// presence of the members of the room on every instance, keyed by connection id.
+	// Owned by the listen goroutine.
+	presence map[string]*msg.MemberPresence
+	// local connections by id and the WebRTC mesh of the room, owned by the listen goroutine.
+	byID map[string]*TransportHandler
+	mesh map[peerLink]string
+	// muted members by muteKey, owned by the listen goroutine. They stay muted
+	// when they reconnect.
+	muted map[string]bool
+
+	// seq is the sequence number of the last delivered message, recorder is set
+	// while the room is recorded. Both are owned by the listen goroutine.
+	seq      uint64
+	recorder *recorder
+	// history of the sequenced messages and the SSE listeners, owned by the listen goroutine.
+	history   history
+	listeners map[*listener]struct{}
+	// connections waiting for a slot in order, owned by the listen goroutine.
+	// admitc wakes the admitter up, see lobby.go
+	waitlist []*TransportHandler
+	admitc   chan struct{}
+	// last messages of the chat, owned by the listen goroutine. chatq queues
+	// the ones to persist, see chatWriter.
+	chatHistory []msg.ChatMessage
+	chatq       chan chatTask
+	// buckets of the UserRates, shared by the readers
+	users *userLimiter
+
+	replayStarted bool
+	onStop        func()
+	// empty fires once the hub has had no connections nor listeners for
+	// emptyGrace, see updateEmpty. Owned by the listen goroutine.
+	empty    *time.Timer
+	wasEmpty bool
+
+	// netpoll serves the connections with its workers when set, see Netpoll
+	netpoll *Netpoll
+
+	// writers tracks the write goroutines, they're done once the close frame is sent
+	writers   sync.WaitGroup
+	draining  atomic.Bool
+	locked    atomic.Bool
+	done      chan struct{}
+	closeOnce sync.Once
+
 	// Capacity of the send channel.
 	// If capacity is 0, the send channel is unbuffered.
 	Capacity uint
+	// MaxListeners is the number of SSE listeners of the room, 0 is unlimited.
+	MaxListeners uint
+	// MaxSpectators is the number of spectators of the room on top of Capacity, 0 is unlimited.
+	MaxSpectators uint
+	// BPM of the jam, MIDI events are quantized to it.
+	BPM uint
+	// ReadOnly rooms drop every message sent by their members.
+	ReadOnly bool
+	// Approval rooms only admit the waiting members approved by the owner.
+	Approval bool
+	// Replay is streamed into the room once the first member joins.
+	Replay *Replay
+	// Limits of the messages sent by each connection.
+	Limits *Limits
+	// Moderator is called with the moderations of the room, see Moderate.
+	Moderator Moderator
+	// Chat persists the chat of the room, it's disabled if nil. The last
+	// ChatHistory messages are sent to the members when they join.
+	Chat        ChatStore
+	ChatHistory int
+}
+
+type HubOptions struct {
+	Capacity      uint
+	MaxListeners  uint
+	MaxSpectators uint
+	BPM           uint
+	ReadOnly      bool
+	Approval      bool
+	Replay        *Replay
+	// Local hubs aren't connected to the other instances.
+	Local bool
+	// Netpoll serves the connections instead of a read and a write goroutine each.
+	Netpoll *Netpoll
+	// Limits of the messages sent by each connection, DefaultLimits if nil.
+	Limits *Limits
+	// Locked rooms only accept the connections of their owners.
+	Locked    bool
+	Moderator Moderator
+	// Chat is disabled if nil, ChatHistory defaults to 50 messages.
+	Chat        ChatStore
+	ChatHistory int
+
+	// onStop is called once the hub is stopped, see HubStore.
+	onStop func()
 }
 
 // Len returns the number of connections.
@@ -101,92 +335,597 @@ func (cli *Hub) Len() int {
 	return len(cli.connections)
 }
 
-// TODO -- should be able to close all connections via their own channels
+// Close sends a close frame to every connection and stops the hub without
+// waiting for the queued messages to be written, see Drain.
 func (cli *Hub) Close() error {
-	defer func() {
-		slog.Info("cli.Close()")
-		// close channels
-		close(cli.register)
-		close(cli.unregister)
-		close(cli.broadcast)
-	}()
+	if !cli.startDrain() {
+		cli.closeAll(ws.StatusGoingAway, "", nil)
+	}
+	cli.stop()
 
-	cli.broadcast <- &wsutil.Message{OpCode: ws.OpClose, Payload: []byte{}} // broadcast close
+	slog.Info("cli.Close()")
 	return nil
 }
 
+// Drain tells every connection to reconnect after retry, flushes their queues
+// and sends a close frame with status 1012 (service restart).
+// It waits until every close frame is written or ctx is done, whichever comes first.
+func (cli *Hub) Drain(ctx context.Context, retry time.Duration) error {
+	if cli.startDrain() {
+		return nil
+	}
+	defer cli.stop()
+
+	notice, err := msg.NewJSON(msg.Notice, &msg.NoticePayload{
+		Code:       msg.NoticeRestart,
+		Msg:        fmt.Sprintf("server restarting, reconnect in %d s", int(retry.Seconds())),
+		RetryAfter: int(retry.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+
+	bs, err := notice.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	cli.closeAll(statusServiceRestart, "server restarting", &wsutil.Message{OpCode: ws.OpBinary, Payload: bs})
+
+	flushed := make(chan struct{})
+	go func() {
+		cli.writers.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		// give up on the slow connections
+		cli.lock.Lock()
+		for conn := range cli.connections {
+			_ = conn.rwc.Close()
+		}
+		cli.lock.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// startDrain marks the hub as draining and reports whether it already was.
+// Connections register a writer with addWriter, none is added once it's draining
+// so Drain can wait for them.
+func (cli *Hub) startDrain() bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+
+	return cli.draining.Swap(true)
+}
+
+// addWriter adds the writer of a new connection unless the hub is draining.
+func (cli *Hub) addWriter() bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+
+	if cli.draining.Load() {
+		return false
+	}
+	cli.writers.Add(1)
+	return true
+}
+
+// closeAll queues last and a close frame on every connection.
+func (cli *Hub) closeAll(code ws.StatusCode, reason string, last *wsutil.Message) {
+	closed := make(chan struct{})
+	task := func() {
+		defer close(closed)
+
+		var f *frame
+		if last != nil {
+			var err error
+			if f, err = newFrame(last); err != nil {
+				slog.Error("frame encode", "err", err)
+			} else {
+				defer f.release()
+			}
+		}
+
+		for conn := range cli.connections {
+			if conn.closed {
+				continue
+			}
+
+			if f != nil {
+				select {
+				case conn.send <- f.retain():
+				default:
+					f.release()
+				}
+			}
+
+			conn.closeCode, conn.closeReason = code, reason
+			cli.closeSend(conn)
+		}
+
+		for l := range cli.listeners {
+			if last != nil {
+				select {
+				case l.events <- event{m: last}:
+				default:
+				}
+			}
+
+			cli.closeListener(l)
+		}
+	}
+
+	select {
+	case cli.tasks <- task:
+		<-closed
+	case <-cli.done:
+	}
+}
+
+// stop is safe to call from the listen goroutine, the backplane doesn't wait
+// on receive once done is closed.
+// stopped reports whether the hub is stopped.
+func (cli *Hub) stopped() bool {
+	select {
+	case <-cli.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cli *Hub) stop() {
+	cli.closeOnce.Do(func() {
+		close(cli.done)
+		cli.unsubscribe()
+
+		if cli.onStop != nil {
+			cli.onStop()
+		}
+	})
+}
+
 /*
 NewClient instantiates a new websocket client.
 
-NOTE: these may be useful to set: Capacity, ReadBufferSize, ReadTimeout, WriteTimeout
+Messages are relayed through bp to the hubs of the same room on other instances,
+and the capacity is enforced across all of them.
+
+NOTE: these may be useful to set: ReadBufferSize, ReadTimeout, WriteTimeout
 */
-func NewHub(cap uint) *Hub {
+func NewHub(room string, bp backplane.Backplane, opts *HubOptions) (*Hub, error) {
+	if opts.Local {
+		bp = backplane.NewMemory()
+	}
+
 	cli := &Hub{
+		id:          uuid.NewString(),
+		room:        room,
+		bp:          bp,
 		register:    make(chan *TransportHandler),
 		unregister:  make(chan *TransportHandler),
 		broadcast:   make(chan *wsutil.Message),
+		remote:      make(chan *wsutil.Message),
+		tasks:       make(chan func()),
+		outbox:      make(chan *wsutil.Message, 256),
+		done:        make(chan struct{}),
+		presence:    make(map[string]*msg.MemberPresence),
+		byID:        make(map[string]*TransportHandler),
+		mesh:        make(map[peerLink]string),
+		muted:       make(map[string]bool),
 		lock:        &sync.Mutex{},
 		connections: make(map[*TransportHandler]bool),
+		listeners:   make(map[*listener]struct{}),
+		admitc:      make(chan struct{}, 1),
+		empty:       time.NewTimer(emptyGrace),
+		wasEmpty:    true,
 		upgrader:    &ws.HTTPUpgrader{
 			// TODO: may be fields here that worth setting
 		},
-		Capacity: cap,
+		Capacity:      opts.Capacity,
+		MaxListeners:  opts.MaxListeners,
+		MaxSpectators: opts.MaxSpectators,
+		BPM:           opts.BPM,
+		ReadOnly:      opts.ReadOnly || opts.Replay != nil,
+		Approval:      opts.Approval,
+		Moderator:     opts.Moderator,
+		Chat:          opts.Chat,
+		ChatHistory:   cmp.Or(opts.ChatHistory, defaultChatHistory),
+		Replay:        opts.Replay,
+		Limits:        cmp.Or(opts.Limits, DefaultLimits()),
+		netpoll:       opts.Netpoll,
+		onStop:        opts.onStop,
 	}
 
+	cli.locked.Store(opts.Locked)
+	cli.users = newUserLimiter(cli.Limits.UserRates)
+
+	unsubscribe, err := bp.Subscribe(context.Background(), room, cli.receive)
+	if err != nil {
+		return nil, err
+	}
+	cli.unsubscribe = unsubscribe
+
 	go cli.listen()
-	return cli
+	go cli.publisher()
+	go cli.admitter()
+	if cli.Chat != nil {
+		cli.chatq = make(chan chatTask, chatQueueSize)
+		go cli.loadChat()
+		go cli.chatWriter()
+	}
+
+	// learn about the members connected to other instances
+	if m := newPresenceMessage(msg.PresenceOpSync); m != nil {
+		cli.publish(m)
+	}
+
+	return cli, nil
+}
+
+// publish queues a message for the other instances.
+func (cli *Hub) publish(m *wsutil.Message) {
+	select {
+	case cli.outbox <- m:
+	case <-cli.done:
+	}
+}
+
+// publisher sends the queued messages to the other instances,
+// the first byte of the data is the OpCode of the frame.
+//
+// It's separate from listen so the listen goroutine never waits on the backplane.
+func (cli *Hub) publisher() {
+	for {
+		select {
+		case <-cli.done:
+			return
+		case m := <-cli.outbox:
+			data := make([]byte, 0, len(m.Payload)+1)
+			data = append(data, byte(m.OpCode))
+			data = append(data, m.Payload...)
+
+			if err := cli.bp.Publish(context.Background(), &backplane.Message{
+				Room:   cli.room,
+				Origin: cli.id,
+				Data:   data,
+			}); err != nil {
+				slog.Error("backplane publish", "err", err)
+			}
+		}
+	}
+}
+
+// do runs fn on the listen goroutine.
+func (cli *Hub) do(fn func()) {
+	select {
+	case cli.tasks <- fn:
+	case <-cli.done:
+	}
+}
+
+// emit sends a message created by the hub to the local connections and the other instances.
+// Called from the listen goroutine.
+func (cli *Hub) emit(m *wsutil.Message) {
+	cli.deliver(m)
+	cli.publish(m)
+}
+
+// sendTo sends m to a single local connection. Called from the listen goroutine.
+func (cli *Hub) sendTo(conn *TransportHandler, m *wsutil.Message) {
+	f, err := newFrame(m)
+	if err != nil {
+		slog.Error("frame encode", "err", err)
+		return
+	}
+	defer f.release()
+
+	cli.sendFrame(conn, f)
+}
+
+// sendFrame queues a reference to f on conn. Called from the listen goroutine.
+func (cli *Hub) sendFrame(conn *TransportHandler, f *frame) {
+	if conn.closed {
+		return
+	}
+
+	select {
+	case conn.send <- f.retain():
+		cli.wake(conn)
+	default:
+		// From Gorilla WS
+		// https://github.com/gorilla/websocket/tree/master/examples/chat#hub
+		// If the client’s send buffer is full, then the hub assumes that the client is dead or stuck. In this case, the hub unregisters the client and closes the websocket
+		f.release()
+		slog.Debug("conn.send channel buffer possible full")
+		cli.closeSend(conn)
+	}
+}
+
+// closeSend closes conn.send, its writer sends a close frame once the queued
+// frames are written. Called from the listen goroutine.
+func (cli *Hub) closeSend(conn *TransportHandler) {
+	conn.closed = true
+	close(conn.send)
+	cli.wake(conn)
+}
+
+// receive handles the messages published by the hubs of other instances.
+func (cli *Hub) receive(m *backplane.Message) {
+	if m.Origin == cli.id || len(m.Data) == 0 {
+		return
+	}
+
+	select {
+	case cli.remote <- &wsutil.Message{OpCode: ws.OpCode(m.Data[0]), Payload: m.Data[1:]}:
+	case <-cli.done:
+	}
+}
+
+// handleRemote keeps the room state in sync with the other instances before
+// delivering their message. Called from the listen goroutine.
+func (cli *Hub) handleRemote(m *wsutil.Message) {
+	var envelope msg.Envelope
+	if err := envelope.UnmarshalBinary(m.Payload); err == nil {
+		switch envelope.Typ {
+		case msg.Presence:
+			if !cli.applyRemotePresence(envelope.Payload) {
+				return
+			}
+		case msg.Signal:
+			cli.handleRemoteSignal(m, envelope.Payload)
+			return
+		case msg.Route:
+			cli.handleRemoteRoute(m, envelope.Payload)
+			return
+		case msg.Admit:
+			cli.handleRemoteAdmit(envelope.Payload)
+			return
+		case msg.Moderate:
+			cli.handleRemoteModerate(m, envelope.Payload)
+			return
+		case msg.Chat:
+			cli.handleRemoteChat(m, envelope.Payload)
+			return
+		}
+	}
+
+	cli.deliver(m)
 }
 
 func (cli *Hub) listen() {
+	idle := time.NewTicker(idleCheckPeriod)
+	defer idle.Stop()
+
+	awareness := time.NewTicker(awarenessPeriod)
+	defer awareness.Stop()
+
+	// polled connections have no write goroutine to ping them
+	var ping <-chan time.Time
+	if cli.netpoll != nil {
+		t := time.NewTicker(pingPeriod)
+		defer t.Stop()
+		ping = t.C
+	}
+
+	defer cli.empty.Stop()
+
+	defer func() {
+		if cli.recorder != nil {
+			if err := cli.recorder.stop(); err != nil {
+				slog.Error("recorder stop", "err", err)
+			}
+			cli.recorder = nil
+		}
+	}()
+
 	for {
 		select {
+		case <-cli.done:
+			return
+		case task := <-cli.tasks:
+			task()
+			// tasks add and remove the listeners
+			cli.updateEmpty()
 		case conn := <-cli.register:
 			cli.lock.Lock()
 			cli.connections[conn] = true
 			cli.lock.Unlock()
+			cli.byID[conn.id] = conn
+			// registered after closeAll, it's closed right away
+			if cli.draining.Load() {
+				conn.closeCode, conn.closeReason = statusServiceRestart, "server restarting"
+				cli.closeSend(conn)
+				continue
+			}
+			if conn.member.Muted || cli.muted[muteKey(conn.member.UserID, conn.id)] {
+				conn.silenced.Store(true)
+			}
+			if conn.role() == RoleWaiting {
+				cli.enqueue(conn)
+			} else {
+				cli.joinPresence(conn)
+				cli.sendChatHistory(conn)
+			}
+
+			if cli.Replay != nil && !cli.replayStarted {
+				cli.replayStarted = true
+				go cli.replay(context.Background())
+			}
+			cli.updateEmpty()
 		case conn := <-cli.unregister:
 			slog.Debug("unregister channel handler")
+			cli.lock.Lock()
 			delete(cli.connections, conn)
-			close(conn.send)
-		case msg := <-cli.broadcast:
-			for conn := range cli.connections {
-				select {
-				case conn.send <- msg:
-				default:
-					// From Gorilla WS
-					// https://github.com/gorilla/websocket/tree/master/examples/chat#hub
-					// If the client’s send buffer is full, then the hub assumes that the client is dead or stuck. In this case, the hub unregisters the client and closes the websocket
-					slog.Debug("conn.send channel buffer possible full\n")
-					slog.Debug("broadcast channel handler: default case:\nopCode: %d\npayload: %+v\n", msg.OpCode, msg.Payload)
-					close(conn.send)
-					delete(cli.connections, conn)
-				}
+			cli.lock.Unlock()
+			delete(cli.byID, conn.id)
+			if !conn.closed {
+				cli.closeSend(conn)
 			}
+			if !cli.dequeue(conn) && conn.role() != RoleSpectator {
+				cli.signalAdmit()
+			}
+			cli.leavePresence(conn)
+			cli.forgetPeer(conn.id)
+			cli.updateEmpty()
+		case msg := <-cli.broadcast:
+			cli.deliver(msg)
+		case msg := <-cli.remote:
+			cli.handleRemote(msg)
+		case <-idle.C:
+			cli.checkIdle()
+		case <-awareness.C:
+			cli.flushAwareness()
+		case <-ping:
+			cli.pingPolled()
+		case <-cli.empty.C:
+			// nothing can join in between, registrations are handled here
+			cli.stop()
+			return
 		}
 	}
 }
 
+// updateEmpty arms the empty timer when the last connection or listener
+// leaves and disarms it when one joins. Called from the listen goroutine.
+func (cli *Hub) updateEmpty() {
+	empty := len(cli.connections) == 0 && len(cli.listeners) == 0
+	if empty == cli.wasEmpty {
+		return
+	}
+
+	cli.wasEmpty = empty
+	if empty {
+		cli.empty.Reset(emptyGrace)
+	} else {
+		cli.empty.Stop()
+	}
+}
+
+// deliver sends msg to every local connection. The frame is encoded once and
+// the same bytes are written to every connection. Called from the listen goroutine.
+func (cli *Hub) deliver(msg *wsutil.Message) {
+	cli.seq++
+	cli.record(cli.seq, msg)
+	cli.history.add(event{seq: cli.seq, m: msg})
+	cli.deliverListeners(event{seq: cli.seq, m: msg})
+
+	f, err := newFrame(msg)
+	if err != nil {
+		slog.Error("frame encode", "err", err)
+		return
+	}
+	defer f.release()
+
+	for conn := range cli.connections {
+		if conn.waiting {
+			continue
+		}
+
+		cli.sendFrame(conn, f)
+	}
+}
+
 func (cli *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// TODO check capacity
-	if cli.Capacity > 0 && cli.Len() >= int(cli.Capacity) {
-		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+	if cli.draining.Load() {
+		http.Error(w, "server restarting", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn := &TransportHandler{
+		id:      uuid.NewString(),
+		member:  memberFromContext(r.Context()),
+		send:    make(chan *frame, 256),
+		topics:  make(map[string]struct{}),
+		limiter: newLimiter(cli.Limits),
+	}
+	conn.touch()
+	conn.setRole(cmp.Or(conn.member.Role, RoleEditor))
+
+	if cli.locked.Load() && conn.role() != RoleOwner {
+		http.Error(w, "room is locked", http.StatusLocked)
+		return
+	}
+
+	// the connections of some users are limited across the rooms, e.g. the guests'
+	if err := cli.joinUser(r.Context(), conn); err != nil {
+		if errors.Is(err, backplane.ErrRoomFull) {
+			http.Error(w, "too many connections", http.StatusTooManyRequests)
+			return
+		}
+
+		slog.Error("backplane join", "err", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
 		return
 	}
 
+	// capacity is shared by the hubs of the room on every instance,
+	// spectators have their own
+	room, capacity := cli.seat(conn.role())
+	if err := cli.bp.Join(r.Context(), room, conn.id, capacity); err != nil {
+		switch {
+		case errors.Is(err, backplane.ErrRoomFull) && conn.role() == RoleSpectator:
+			cli.leaveUser(conn)
+			http.Error(w, "too many spectators", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, backplane.ErrRoomFull):
+			// wait in the lobby until a slot frees up, see lobby.go
+			conn.setRole(RoleWaiting)
+		default:
+			cli.leaveUser(conn)
+			slog.Error("backplane join", "err", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	rwc, _, _, err := cli.upgrader.Upgrade(r, w)
 	if err != nil {
 		// TODO log that there was an error
+		cli.leaveSeat(conn)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	conn.rwc = rwc
 
-	conn := &TransportHandler{
-		rwc:  rwc,
-		send: make(chan *wsutil.Message, 256),
+	fd, err := -1, ErrNetpollUnsupported
+	if cli.netpoll != nil {
+		fd, err = connFd(rwc)
+	}
+	conn.polled = err == nil
+	conn.lastRead.Store(time.Now().UnixNano())
+
+	// added before the connection is registered, Drain waits for its close frame
+	if !cli.addWriter() {
+		_ = conn.write(&wsutil.Message{OpCode: ws.OpClose, Payload: ws.NewCloseFrameBody(statusServiceRestart, "")})
+		_ = rwc.Close()
+		cli.leaveSeat(conn)
+		return
+	}
+
+	select {
+	case cli.register <- conn:
+	case <-cli.done:
+		cli.writers.Done()
+		_ = conn.write(&wsutil.Message{OpCode: ws.OpClose, Payload: ws.NewCloseFrameBody(statusServiceRestart, "")})
+		_ = rwc.Close()
+		cli.leaveSeat(conn)
+		return
 	}
 
-	cli.register <- conn
+	if conn.polled {
+		if err := cli.poll(conn, fd); err != nil {
+			slog.Error("netpoll start", "err", err)
+			cli.disconnect(conn)
+		}
+		return
+	}
 
 	go read(conn, cli)
-	go write(conn)
+	go write(conn, cli)
 }
@@ -0,0 +1,344 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// readTimeout bounds every read of the test clients.
+const readTimeout = 2 * time.Second
+
+// newServer serves hub to the members of the query: n is their name, u their
+// user id, role their Role and max their MaxConns.
+func newServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		maxConns, _ := strconv.ParseUint(q.Get("max"), 10, 32)
+		hub.ServeHTTP(w, r.WithContext(WithMember(r.Context(), &Member{
+			Name:     q.Get("n"),
+			UserID:   q.Get("u"),
+			Role:     Role(q.Get("role")),
+			MaxConns: uint(maxConns),
+		})))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// client is a websocket client of a test server.
+type client struct {
+	t *testing.T
+	net.Conn
+}
+
+// bufConn reads what the handshake buffered first.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func dial(t *testing.T, srv *httptest.Server, query string) *client {
+	t.Helper()
+
+	conn, br, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"?"+query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if br != nil {
+		return &client{t, &bufConn{conn, br}}
+	}
+
+	return &client{t, conn}
+}
+
+func (c *client) send(typ msg.MsgType, v any) {
+	c.t.Helper()
+
+	env, err := msg.NewJSON(typ, v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	bs, err := env.MarshalBinary()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if err := wsutil.WriteClientBinary(c, bs); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next envelope, the error is a wsutil.ClosedError once the
+// server closed the connection. wsutil rejects 1012 (service restart), the
+// frames are read as they are.
+func (c *client) next() (msg.Envelope, error) {
+	var env msg.Envelope
+
+	_ = c.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		f, err := ws.ReadFrame(c)
+		if err != nil {
+			return env, err
+		}
+
+		switch f.Header.OpCode {
+		case ws.OpClose:
+			code, reason := ws.ParseCloseFrameData(f.Payload)
+			return env, wsutil.ClosedError{Code: code, Reason: reason}
+		case ws.OpBinary:
+			return env, env.UnmarshalBinary(f.Payload)
+		}
+	}
+}
+
+// expect skips the envelopes until one of typ.
+func (c *client) expect(typ msg.MsgType) msg.Envelope {
+	c.t.Helper()
+
+	for {
+		env, err := c.next()
+		if err != nil {
+			c.t.Fatalf("waiting for %v: %v", typ, err)
+		}
+		if env.Typ == typ {
+			return env
+		}
+	}
+}
+
+// expectJSON decodes the payload of the next envelope of typ into v.
+func (c *client) expectJSON(typ msg.MsgType, v any) {
+	c.t.Helper()
+
+	if err := json.Unmarshal(c.expect(typ).Payload, v); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expectClose skips the envelopes until the close frame and returns its status.
+func (c *client) expectClose() ws.StatusCode {
+	c.t.Helper()
+
+	for {
+		_, err := c.next()
+
+		var closed wsutil.ClosedError
+		if errors.As(err, &closed) {
+			return closed.Code
+		}
+		if err != nil {
+			c.t.Fatalf("waiting for the close frame: %v", err)
+		}
+	}
+}
+
+// presenceID returns the connection id of the member named name in a presence.
+func (c *client) presenceID(p *msg.PresencePayload, name string) string {
+	c.t.Helper()
+
+	for _, m := range p.Members {
+		if m.Name == name {
+			return m.ID
+		}
+	}
+
+	c.t.Fatalf("%s isn't in the presence %+v", name, p.Members)
+	return ""
+}
+
+// memberID waits for a presence with the member named name and returns its connection id.
+func (c *client) memberID(name string) string {
+	c.t.Helper()
+
+	for {
+		var p msg.PresencePayload
+		c.expectJSON(msg.Presence, &p)
+
+		for _, m := range p.Members {
+			if m.Name == name {
+				return m.ID
+			}
+		}
+	}
+}
+
+// join dials the server and returns the client and the presence snapshot it got.
+func join(t *testing.T, srv *httptest.Server, query string) (*client, *msg.PresencePayload) {
+	t.Helper()
+
+	c := dial(t, srv, query)
+
+	p := &msg.PresencePayload{}
+	c.expectJSON(msg.Presence, p)
+	if p.Op != msg.PresenceOpSnapshot {
+		t.Fatalf("first presence is a %s, want a %s", p.Op, msg.PresenceOpSnapshot)
+	}
+
+	return c, p
+}
+
+func TestHubStoreEmpty(t *testing.T) {
+	defer func(d time.Duration) { emptyGrace = d }(emptyGrace)
+	emptyGrace = time.Millisecond * 200
+
+	hs := NewHubStore(backplane.NewMemory(), &HubOptions{})
+
+	hub, err := hs.GetOrCreate("room", &HubOptions{Capacity: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t, hub)
+
+	c, _ := join(t, srv, "n=alice")
+	c.Close()
+
+	// alice reconnects within the grace period
+	time.Sleep(emptyGrace / 2)
+	c, _ = join(t, srv, "n=alice")
+
+	time.Sleep(emptyGrace * 2)
+	if hub.stopped() {
+		t.Fatal("the hub stopped with a member")
+	}
+
+	c.Close()
+	time.Sleep(emptyGrace * 2)
+	if !hub.stopped() {
+		t.Fatal("the empty hub didn't stop")
+	}
+
+	other, err := hs.GetOrCreate("room", &HubOptions{Capacity: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hub {
+		t.Error("the stopped hub is still in the store")
+	}
+}
+
+func TestHubStoreDrain(t *testing.T) {
+	hs := NewHubStore(backplane.NewMemory(), &HubOptions{})
+
+	hub, err := hs.GetOrCreate("room", &HubOptions{Capacity: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t, hub)
+	c, _ := join(t, srv, "n=alice")
+
+	drained := make(chan error, 1)
+	go func() { drained <- hs.Drain(context.Background(), time.Second) }()
+
+	if code := c.expectClose(); code != statusServiceRestart {
+		t.Errorf("alice was closed with %d, want %d", code, statusServiceRestart)
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+
+	// the rooms opened during the drain would never be drained
+	if _, err := hs.GetOrCreate("other", &HubOptions{Capacity: 3}); !errors.Is(err, ErrDraining) {
+		t.Errorf("creating a hub while draining got %v, want %v", err, ErrDraining)
+	}
+	if _, err := hs.GetOrCreate("room", &HubOptions{Capacity: 3}); !errors.Is(err, ErrDraining) {
+		t.Errorf("getting the drained hub got %v, want %v", err, ErrDraining)
+	}
+
+	// and the connections registered during the drain are closed
+	if _, _, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"?n=bob"); err == nil {
+		t.Error("bob connected to the drained hub")
+	}
+}
+
+func TestMalformedEnvelope(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	alice, _ := join(t, srv, "n=alice")
+	bob, _ := join(t, srv, "n=bob")
+	alice.expect(msg.Presence)
+
+	if err := wsutil.WriteClientBinary(alice, []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	var p msg.ErrorPayload
+	alice.expectJSON(msg.Error, &p)
+	if p.Code != msg.ErrorInvalid {
+		t.Errorf("error code = %q, want %q", p.Code, msg.ErrorInvalid)
+	}
+
+	// bob only gets what alice sends next
+	alice.send(msg.Presence, &msg.PresenceUpdate{})
+	if env, err := bob.next(); err != nil || env.Typ != msg.Presence {
+		t.Errorf("bob got %v (%v), want the presence of alice", env.Typ, err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	bp := backplane.NewMemory()
+
+	var srvs []*httptest.Server
+	for _, room := range []string{"a", "b"} {
+		hub, err := NewHub(room, bp, &HubOptions{Capacity: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer hub.Close()
+
+		srvs = append(srvs, newServer(t, hub))
+	}
+
+	a, _ := join(t, srvs[0], "n=guest&u=guest-id&max=2")
+	join(t, srvs[1], "n=guest&u=guest-id&max=2")
+
+	url := "ws" + strings.TrimPrefix(srvs[0].URL, "http") + "?n=guest&u=guest-id&max=2"
+	var status ws.StatusError
+	if _, _, _, err := ws.Dial(context.Background(), url); !errors.As(err, &status) || int(status) != http.StatusTooManyRequests {
+		t.Fatalf("the third connection got %v, want %d", err, http.StatusTooManyRequests)
+	}
+
+	// other users aren't limited by the connections of the guest
+	join(t, srvs[0], "n=alice&u=alice-id&max=2")
+
+	// the connection is given back once a is gone
+	a.Close()
+	deadline := time.Now().Add(readTimeout)
+	for {
+		conn, _, _, err := ws.Dial(context.Background(), url)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the guest can't connect once a is closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,336 @@
+package websocket
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// strikes older than strikeWindow are forgotten
+const strikeWindow = time.Minute
+
+// errFragments is returned once a message has more than MaxFragments, the rest
+// of it can't be discarded.
+var errFragments = &protocolError{code: msg.ErrorTooLarge, msg: "too many fragments", fatal: true}
+
+// frames declared over maxDiscardFactor times MaxFrameSize aren't discarded,
+// the peer could hold the reader for as long as it trickles their bytes.
+const maxDiscardFactor = 2
+
+// errFrameTooLarge is returned for the frames too large to be discarded.
+var errFrameTooLarge = &protocolError{code: msg.ErrorTooLarge, msg: "frame too large", fatal: true}
+
+// Rate of a token bucket, a message takes a token and PerSecond tokens are added
+// up to Burst. A zero PerSecond is no limit.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Limits bound what a single connection can send. Messages over the limits are
+// dropped and the client gets an Error message, it's disconnected with status
+// 1008 (policy violation) after MaxStrikes of them within a minute.
+type Limits struct {
+	// MaxFrameSize and MaxMessageSize are in bytes, they're checked before
+	// anything is buffered. MaxFragments bounds the frames of a message.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+	MaxFragments   int
+
+	// Rate of every message of a connection and TypeRates of each type.
+	Rate      Rate
+	TypeRates map[msg.MsgType]Rate
+	// UserRates of each type are shared by the connections of a member to
+	// the same hub, opening more of them doesn't let more messages through.
+	UserRates map[msg.MsgType]Rate
+
+	MaxStrikes int
+}
+
+func DefaultLimits() *Limits {
+	return &Limits{
+		MaxFrameSize:   64 << 10,
+		MaxMessageSize: 256 << 10,
+		MaxFragments:   16,
+		Rate:           Rate{PerSecond: 100, Burst: 200},
+		TypeRates: map[msg.MsgType]Rate{
+			msg.Presence:  {PerSecond: 5, Burst: 10},
+			msg.Awareness: {PerSecond: 30, Burst: 30},
+			msg.Signal:    {PerSecond: 20, Burst: 50},
+			msg.Subscribe: {PerSecond: 5, Burst: 10},
+		},
+		UserRates: map[msg.MsgType]Rate{
+			// chat has its own bucket so talking doesn't take from the music
+			msg.Chat: {PerSecond: 1, Burst: 5},
+		},
+		MaxStrikes: 3,
+	}
+}
+
+// Validate reports the limits no message could meet and the invalid rates.
+func (l *Limits) Validate() error {
+	switch {
+	case l.MaxFrameSize <= 0, l.MaxMessageSize <= 0:
+		return fmt.Errorf("limits: invalid sizes, frame %d and message %d", l.MaxFrameSize, l.MaxMessageSize)
+	case l.MaxFragments <= 0:
+		return fmt.Errorf("limits: invalid max fragments %d", l.MaxFragments)
+	case l.MaxStrikes < 0:
+		return fmt.Errorf("limits: invalid max strikes %d", l.MaxStrikes)
+	}
+
+	if err := l.Rate.validate(); err != nil {
+		return err
+	}
+	for _, rates := range []map[msg.MsgType]Rate{l.TypeRates, l.UserRates} {
+		for typ, r := range rates {
+			if err := r.validate(); err != nil {
+				info, _ := msg.Lookup(typ)
+				return fmt.Errorf("%w for the %q messages", err, info.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate reports the rates that are negative or let no message through.
+func (r Rate) validate() error {
+	if math.IsNaN(r.PerSecond) || math.IsInf(r.PerSecond, 0) || r.PerSecond < 0 || (r.PerSecond > 0 && r.Burst < 1) {
+		return fmt.Errorf("limits: invalid rate %v per second with a burst of %d", r.PerSecond, r.Burst)
+	}
+
+	return nil
+}
+
+// protocolError is a message that broke the limits, it was dropped without
+// losing track of the stream so the connection can be kept unless it's fatal.
+type protocolError struct {
+	code, msg  string
+	typ        msg.MsgType
+	retryAfter time.Duration
+	// fatal errors lost track of the stream, the connection is closed once
+	// the client is told about it
+	fatal bool
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("protocol error: %s", e.msg)
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(r Rate) *bucket {
+	return &bucket{rate: r, tokens: float64(r.Burst)}
+}
+
+// take reports whether a token was available, if not it returns how long until there is one.
+func (b *bucket) take(now time.Time) (time.Duration, bool) {
+	if !b.last.IsZero() {
+		b.tokens = min(float64(b.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	return time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second)), false
+}
+
+// limiter keeps the buckets and the strikes of a connection, it's owned by its reader.
+type limiter struct {
+	limits *Limits
+	conn   *bucket
+	types  map[msg.MsgType]*bucket
+
+	strikes  int
+	struckAt time.Time
+	// violations before quietUntil are dropped without a strike, the client
+	// was already told when it can send again
+	quietUntil time.Time
+	out        bool
+}
+
+func newLimiter(limits *Limits) *limiter {
+	l := &limiter{limits: limits, types: make(map[msg.MsgType]*bucket)}
+	if limits.Rate.PerSecond > 0 {
+		l.conn = newBucket(limits.Rate)
+	}
+
+	return l
+}
+
+// allow takes a token for a message of the connection.
+func (l *limiter) allow(now time.Time) *protocolError {
+	if l.conn == nil {
+		return nil
+	}
+
+	if d, ok := l.conn.take(now); !ok {
+		return &protocolError{code: msg.ErrorRateLimited, msg: "rate limit exceeded", retryAfter: d}
+	}
+
+	return nil
+}
+
+// allowType takes a token for a message of type typ.
+func (l *limiter) allowType(typ msg.MsgType, now time.Time) *protocolError {
+	b, ok := l.types[typ]
+	if !ok {
+		r, ok := l.limits.TypeRates[typ]
+		if !ok || r.PerSecond <= 0 {
+			return nil
+		}
+
+		b = newBucket(r)
+		l.types[typ] = b
+	}
+
+	if d, ok := b.take(now); !ok {
+		return &protocolError{code: msg.ErrorRateLimited, msg: "rate limit exceeded", typ: typ, retryAfter: d}
+	}
+
+	return nil
+}
+
+// userLimiter keeps the buckets of the UserRates by member, signed in members
+// are known by their user and the others by their connection. It's shared by
+// the readers of the hub.
+type userLimiter struct {
+	rates map[msg.MsgType]Rate
+
+	mu      sync.Mutex
+	buckets map[userBucket]*bucket
+}
+
+type userBucket struct {
+	member string
+	typ    msg.MsgType
+}
+
+func newUserLimiter(rates map[msg.MsgType]Rate) *userLimiter {
+	return &userLimiter{rates: rates, buckets: make(map[userBucket]*bucket)}
+}
+
+// allow takes a token for a message of type typ sent by conn.
+func (u *userLimiter) allow(conn *TransportHandler, typ msg.MsgType, now time.Time) *protocolError {
+	r, ok := u.rates[typ]
+	if !ok || r.PerSecond <= 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := userBucket{member: cmp.Or(conn.member.UserID, conn.id), typ: typ}
+	b, ok := u.buckets[key]
+	if !ok {
+		u.prune(now)
+		b = newBucket(r)
+		u.buckets[key] = b
+	}
+
+	if d, ok := b.take(now); !ok {
+		return &protocolError{code: msg.ErrorRateLimited, msg: "rate limit exceeded", typ: typ, retryAfter: d}
+	}
+
+	return nil
+}
+
+// prune forgets the buckets that refilled since they were last used, they're
+// the same as new ones.
+func (u *userLimiter) prune(now time.Time) {
+	for key, b := range u.buckets {
+		if now.Sub(b.last).Seconds()*b.rate.PerSecond+b.tokens >= float64(b.rate.Burst) {
+			delete(u.buckets, key)
+		}
+	}
+}
+
+// strike records a violation, it reports whether the client should be told
+// about it and marks the limiter out once there are too many.
+func (l *limiter) strike(now time.Time) bool {
+	if now.Before(l.quietUntil) {
+		return false
+	}
+
+	if now.Sub(l.struckAt) > strikeWindow {
+		l.strikes = 0
+	}
+	l.strikes++
+	l.struckAt = now
+	l.out = l.strikes > l.limits.MaxStrikes
+
+	return true
+}
+
+// violation handles a message of conn that broke the limits. Called by the reader of conn.
+func (cli *Hub) violation(conn *TransportHandler, perr *protocolError) {
+	now := time.Now()
+	if perr.fatal {
+		conn.limiter.out = true
+	} else if !conn.limiter.strike(now) {
+		return
+	}
+	conn.limiter.quietUntil = now.Add(max(perr.retryAfter, time.Second))
+
+	slog.Debug("protocol error", "conn", conn.id, "code", perr.code, "type", perr.typ, "strikes", conn.limiter.strikes)
+
+	m := newErrorMessage(&msg.ErrorPayload{
+		Code:       perr.code,
+		Msg:        perr.msg,
+		Type:       perr.typ,
+		RetryAfter: int(perr.retryAfter.Milliseconds()),
+	})
+
+	out, reason := conn.limiter.out, "too many protocol errors"
+	if perr.fatal {
+		reason = perr.msg
+	}
+
+	cli.do(func() {
+		if m != nil {
+			cli.sendTo(conn, m)
+		}
+
+		// the writer sends the close frame after the error and closes the connection
+		if out && !conn.closed {
+			conn.closeCode, conn.closeReason = ws.StatusPolicyViolation, reason
+			cli.closeSend(conn)
+		}
+	})
+}
+
+// sendError tells conn one of its messages was dropped without a strike.
+func (cli *Hub) sendError(conn *TransportHandler, p *msg.ErrorPayload) {
+	m := newErrorMessage(p)
+	if m == nil {
+		return
+	}
+
+	cli.do(func() {
+		cli.sendTo(conn, m)
+	})
+}
+
+func newErrorMessage(p *msg.ErrorPayload) *wsutil.Message {
+	env, err := msg.NewJSON(msg.Error, p)
+	if err != nil {
+		slog.Error("error marshal", "err", err)
+		return nil
+	}
+
+	return newMessage(env)
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"math"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+func TestLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(*Limits)
+	}{
+		{"no frame size", func(l *Limits) { l.MaxFrameSize = 0 }},
+		{"negative message size", func(l *Limits) { l.MaxMessageSize = -1 }},
+		{"no fragments", func(l *Limits) { l.MaxFragments = 0 }},
+		{"negative strikes", func(l *Limits) { l.MaxStrikes = -1 }},
+		{"negative rate", func(l *Limits) { l.Rate = Rate{PerSecond: -1, Burst: 1} }},
+		{"infinite rate", func(l *Limits) { l.Rate = Rate{PerSecond: math.Inf(1), Burst: 1} }},
+		{"no burst", func(l *Limits) { l.Rate = Rate{PerSecond: 0.5} }},
+		{"no burst of a type", func(l *Limits) { l.TypeRates[msg.MIDI] = Rate{PerSecond: 10} }},
+		{"NaN rate of a user", func(l *Limits) { l.UserRates[msg.Chat] = Rate{PerSecond: math.NaN(), Burst: 1} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := DefaultLimits()
+			tt.apply(l)
+
+			if err := l.Validate(); err == nil {
+				t.Error("Validate succeeded")
+			}
+		})
+	}
+
+	if err := DefaultLimits().Validate(); err != nil {
+		t.Errorf("the default limits are invalid: %v", err)
+	}
+}
+
+// TestTooManyFragments checks the client is told why before its connection
+// is closed, the rest of the message can't be discarded.
+func TestTooManyFragments(t *testing.T) {
+	np, err := NewNetpoll(2)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer np.Close()
+
+	for name, np := range map[string]*Netpoll{"goroutines": nil, "netpoll": np} {
+		t.Run(name, func(t *testing.T) {
+			limits := DefaultLimits()
+			limits.MaxFragments = 2
+
+			hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 3, Limits: limits, Netpoll: np})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hub.Close()
+
+			c, _ := join(t, newServer(t, hub), "n=alice")
+
+			frames := []ws.Frame{
+				ws.NewFrame(ws.OpBinary, false, []byte{1}),
+				ws.NewFrame(ws.OpContinuation, false, []byte{2}),
+				ws.NewFrame(ws.OpContinuation, false, []byte{3}),
+			}
+			for _, f := range frames {
+				if err := ws.WriteFrame(c, ws.MaskFrameInPlace(f)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var p msg.ErrorPayload
+			c.expectJSON(msg.Error, &p)
+			if p.Code != msg.ErrorTooLarge {
+				t.Errorf("error code = %q, want %q", p.Code, msg.ErrorTooLarge)
+			}
+
+			if code := c.expectClose(); code != ws.StatusPolicyViolation {
+				t.Errorf("closed with %d, want %d", code, ws.StatusPolicyViolation)
+			}
+		})
+	}
+}
+
+// TestFrameTooLarge checks a frame declared far over the limit isn't discarded,
+// the connection is closed without waiting for its bytes.
+func TestFrameTooLarge(t *testing.T) {
+	limits := DefaultLimits()
+
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 3, Limits: limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	c, _ := join(t, newServer(t, hub), "n=alice")
+
+	// only the header and a few bytes of the frame are sent
+	h := ws.Header{Fin: true, OpCode: ws.OpBinary, Masked: true, Length: 1 << 40, Mask: ws.NewMask()}
+	if err := ws.WriteHeader(c, h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var p msg.ErrorPayload
+	c.expectJSON(msg.Error, &p)
+	if p.Code != msg.ErrorTooLarge {
+		t.Errorf("error code = %q, want %q", p.Code, msg.ErrorTooLarge)
+	}
+
+	if code := c.expectClose(); code != ws.StatusPolicyViolation {
+		t.Errorf("closed with %d, want %d", code, ws.StatusPolicyViolation)
+	}
+}
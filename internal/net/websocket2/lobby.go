@@ -0,0 +1,254 @@
+package websocket
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+const (
+	// connections waiting for a slot on a single instance
+	maxWaitlist = 100
+	// slots freed on other instances aren't always seen, e.g. when one of them
+	// crashed, the admitter tries again every admitRetry
+	admitRetry = 5 * time.Second
+
+	// gobwas/ws doesn't define it
+	statusTryAgainLater ws.StatusCode = 1013
+)
+
+/*
+The members joining a full room wait in its lobby, they're admitted first come
+first served as slots free up. If the room requires Approval only the members
+approved by the owner are admitted, in the same order.
+
+The waitlist is kept by each instance for its connections, the owner sees the
+members waiting on every instance through their presence.
+*/
+
+// enqueue adds the waiting conn to the waitlist. Called from the listen goroutine.
+func (cli *Hub) enqueue(conn *TransportHandler) {
+	if len(cli.waitlist) >= maxWaitlist {
+		conn.closeCode, conn.closeReason = statusTryAgainLater, "waitlist is full"
+		cli.closeSend(conn)
+		return
+	}
+
+	conn.waiting = true
+	cli.waitlist = append(cli.waitlist, conn)
+	cli.joinPresence(conn)
+	cli.notifyWaitlist()
+
+	// a slot may have been freed since the connection was turned away
+	cli.signalAdmit()
+}
+
+// dequeue removes conn from the waitlist and reports whether it was in it.
+func (cli *Hub) dequeue(conn *TransportHandler) bool {
+	i := slices.Index(cli.waitlist, conn)
+	if i < 0 {
+		return false
+	}
+
+	conn.waiting = false
+	cli.waitlist = slices.Delete(cli.waitlist, i, i+1)
+	cli.notifyWaitlist()
+	return true
+}
+
+// notifyWaitlist sends their position to the waiting connections it changed for.
+func (cli *Hub) notifyWaitlist() {
+	for i, conn := range cli.waitlist {
+		if conn.position == i+1 {
+			continue
+		}
+		conn.position = i + 1
+
+		if m := newLobbyMessage(&msg.LobbyPayload{Op: msg.LobbyWaiting, Position: conn.position, Approval: cli.Approval}); m != nil {
+			cli.sendTo(conn, m)
+		}
+	}
+}
+
+// nextWaiting returns the first connection of the waitlist that can be admitted.
+func (cli *Hub) nextWaiting() *TransportHandler {
+	for _, conn := range cli.waitlist {
+		if !conn.closed && (!cli.Approval || conn.approved) {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// signalAdmit wakes the admitter up, it's safe to call from any goroutine.
+func (cli *Hub) signalAdmit() {
+	select {
+	case cli.admitc <- struct{}{}:
+	default:
+	}
+}
+
+// admitter joins the waiting connections to the room as slots free up. It's
+// separate from listen so the listen goroutine never waits on the backplane.
+func (cli *Hub) admitter() {
+	ticker := time.NewTicker(admitRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cli.done:
+			return
+		case <-cli.admitc:
+		case <-ticker.C:
+		}
+
+		for cli.admitNext() {
+		}
+	}
+}
+
+// admitNext admits the next connection of the waitlist, it reports false
+// once there's nobody left to admit or no free slot.
+func (cli *Hub) admitNext() bool {
+	var conn *TransportHandler
+	found := make(chan struct{})
+	cli.do(func() {
+		defer close(found)
+		conn = cli.nextWaiting()
+	})
+
+	select {
+	case <-found:
+	case <-cli.done:
+		return false
+	}
+	if conn == nil {
+		return false
+	}
+
+	ctx := context.Background()
+	if err := cli.bp.Join(ctx, cli.room, conn.id, cli.Capacity); err != nil {
+		if !errors.Is(err, backplane.ErrRoomFull) {
+			slog.Error("backplane join", "err", err)
+		}
+		return false
+	}
+
+	conn.setRole(cmp.Or(conn.member.Role, RoleEditor))
+
+	// disconnect may have seen the connection as waiting, see promote
+	if conn.disconnected.Load() {
+		cli.leaveSeat(conn)
+		return true
+	}
+
+	cli.do(func() {
+		cli.admit(conn)
+	})
+	return true
+}
+
+// admit lets conn into the room once it has a slot. Called from the listen goroutine.
+func (cli *Hub) admit(conn *TransportHandler) {
+	if !cli.dequeue(conn) {
+		return
+	}
+
+	if m := newLobbyMessage(&msg.LobbyPayload{Op: msg.LobbyAdmitted}); m != nil {
+		cli.sendTo(conn, m)
+	}
+
+	// the presence of the room changed while waiting
+	if p, ok := cli.presence[conn.id]; ok {
+		p.Role = string(conn.role())
+		p.WaitingSince = nil
+		cli.emitPresence(msg.PresenceOpUpdate, *p)
+	}
+	if m := newPresenceMessage(msg.PresenceOpSnapshot, cli.presenceSnapshot()...); m != nil {
+		cli.sendTo(conn, m)
+	}
+	cli.sendChatHistory(conn)
+}
+
+// deny turns the waiting conn away. Called from the listen goroutine.
+func (cli *Hub) deny(conn *TransportHandler) {
+	if !cli.dequeue(conn) {
+		return
+	}
+
+	if m := newLobbyMessage(&msg.LobbyPayload{Op: msg.LobbyDenied}); m != nil {
+		cli.sendTo(conn, m)
+	}
+
+	if !conn.closed {
+		conn.closeCode, conn.closeReason = ws.StatusPolicyViolation, "denied by the owner"
+		cli.closeSend(conn)
+	}
+}
+
+// handleAdmit applies an Admit message sent by conn, only owners can send them.
+// The waiting member may be connected to another instance.
+func (cli *Hub) handleAdmit(conn *TransportHandler, m *wsutil.Message, payload []byte) {
+	if conn.role() != RoleOwner {
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorForbidden, Msg: "only the owner can admit members", Type: msg.Admit})
+		return
+	}
+
+	var ap msg.AdmitPayload
+	if err := json.Unmarshal(payload, &ap); err != nil {
+		slog.Debug("admit unmarshal", "err", err)
+		return
+	}
+
+	cli.do(func() {
+		cli.applyAdmit(&ap)
+	})
+	cli.publish(m)
+}
+
+// applyAdmit approves or denies a local waiting connection. Called from the listen goroutine.
+func (cli *Hub) applyAdmit(ap *msg.AdmitPayload) {
+	conn, ok := cli.byID[ap.ID]
+	if !ok || !conn.waiting {
+		return
+	}
+
+	if ap.Deny {
+		cli.deny(conn)
+		return
+	}
+
+	conn.approved = true
+	cli.signalAdmit()
+}
+
+// handleRemoteAdmit applies an Admit message sent by an owner connected to another instance.
+func (cli *Hub) handleRemoteAdmit(payload []byte) {
+	var ap msg.AdmitPayload
+	if err := json.Unmarshal(payload, &ap); err != nil {
+		slog.Debug("remote admit unmarshal", "err", err)
+		return
+	}
+
+	cli.applyAdmit(&ap)
+}
+
+func newLobbyMessage(p *msg.LobbyPayload) *wsutil.Message {
+	env, err := msg.NewJSON(msg.Lobby, p)
+	if err != nil {
+		slog.Error("lobby marshal", "err", err)
+		return nil
+	}
+
+	return newMessage(env)
+}
@@ -0,0 +1,146 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+func TestOwnerPastCapacity(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	join(t, srv, "n=bob")
+
+	_, snapshot := join(t, srv, "n=alice&u=alice-id&role=owner")
+	for _, m := range snapshot.Members {
+		if m.Name == "alice" && (m.Role != string(RoleOwner) || m.WaitingSince != nil) {
+			t.Fatalf("the owner joined the full room as %+v, want them admitted", m)
+		}
+	}
+
+	// the owner still takes a slot of the room
+	if n, _ := hub.bp.Len(t.Context(), hub.room); n != 2 {
+		t.Errorf("%d members in the room, want 2", n)
+	}
+}
+
+func TestLobbyAdmit(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 2, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	alice, _ := join(t, srv, "n=alice&u=alice-id&role=owner")
+	carol, _ := join(t, srv, "n=carol")
+	alice.memberID("carol")
+
+	bob, _ := join(t, srv, "n=bob")
+	var lp msg.LobbyPayload
+	bob.expectJSON(msg.Lobby, &lp)
+	if lp.Op != msg.LobbyWaiting || lp.Position != 1 || !lp.Approval {
+		t.Fatalf("bob got the lobby %+v, want to wait for the approval at 1", lp)
+	}
+	bobID := alice.memberID("bob")
+
+	// only the owner lets members in
+	carol.send(msg.Admit, &msg.AdmitPayload{ID: bobID})
+	var ep msg.ErrorPayload
+	carol.expectJSON(msg.Error, &ep)
+	if ep.Code != msg.ErrorForbidden {
+		t.Errorf("carol admitting bob got %q, want %q", ep.Code, msg.ErrorForbidden)
+	}
+
+	// a free slot isn't enough in rooms requiring approval
+	carol.Close()
+	alice.send(msg.Admit, &msg.AdmitPayload{ID: bobID})
+
+	bob.expectJSON(msg.Lobby, &lp)
+	if lp.Op != msg.LobbyAdmitted {
+		t.Fatalf("bob got the lobby %+v, want to be admitted", lp)
+	}
+
+	// the room is told first, bob then gets the presence of the room
+	var p msg.PresencePayload
+	bob.expectJSON(msg.Presence, &p)
+	if p.Op != msg.PresenceOpUpdate || len(p.Members) != 1 || p.Members[0].ID != bobID || p.Members[0].Role != string(RoleEditor) {
+		t.Errorf("bob got the presence %+v once admitted, want them an editor", p)
+	}
+	bob.expectJSON(msg.Presence, &p)
+	if p.Op != msg.PresenceOpSnapshot {
+		t.Errorf("bob got a %s once admitted, want a %s", p.Op, msg.PresenceOpSnapshot)
+	}
+
+	// the room is full again
+	dave, _ := join(t, srv, "n=dave")
+	dave.expectJSON(msg.Lobby, &lp)
+	alice.send(msg.Admit, &msg.AdmitPayload{ID: alice.memberID("dave"), Deny: true})
+
+	dave.expectJSON(msg.Lobby, &lp)
+	if lp.Op != msg.LobbyDenied {
+		t.Errorf("dave got the lobby %+v, want to be denied", lp)
+	}
+	if code := dave.expectClose(); code != 1008 {
+		t.Errorf("dave was closed with %d, want 1008", code)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 1, MaxSpectators: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	bob, _ := join(t, srv, "n=bob")
+	sam, snapshot := join(t, srv, "n=sam&role=spectator")
+	samID := sam.presenceID(snapshot, "sam")
+
+	sam.send(msg.Promote, nil)
+	var ep msg.ErrorPayload
+	sam.expectJSON(msg.Error, &ep)
+	if ep.Code != msg.ErrorRoomFull {
+		t.Fatalf("sam promoted in the full room got %q, want %q", ep.Code, msg.ErrorRoomFull)
+	}
+
+	// the slot of bob is given up once they're gone
+	bob.Close()
+	deadline := time.Now().Add(readTimeout)
+	sam.send(msg.Promote, nil)
+	for {
+		env, err := sam.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch env.Typ {
+		case msg.Error:
+			if time.Now().After(deadline) {
+				t.Fatal("sam was never promoted")
+			}
+			time.Sleep(10 * time.Millisecond)
+			sam.send(msg.Promote, nil)
+		case msg.Presence:
+			var p msg.PresencePayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Op == msg.PresenceOpUpdate && len(p.Members) == 1 && p.Members[0].ID == samID {
+				if p.Members[0].Role != string(RoleEditor) {
+					t.Errorf("sam was promoted to %s, want %s", p.Members[0].Role, RoleEditor)
+				}
+				return
+			}
+		}
+	}
+}
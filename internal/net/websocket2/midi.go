@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// stampMIDI validates the MIDI payload sent by conn and rewrites it in place,
+// so the message read from the connection can be relayed as is:
+// the source is set to conn and the event times are converted to the server clock.
+func (cli *Hub) stampMIDI(conn *TransportHandler, payload []byte, receivedAt time.Time) error {
+	p := msg.MIDIPayload(payload)
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(conn.id)
+	if err != nil {
+		return err
+	}
+	p.SetSource(id)
+
+	// the events happened about the latency of the sender before they were received
+	base := receivedAt.Add(-conn.member.Latency).UnixNano()
+	quantize := p.Flags()&msg.MIDIQuantize != 0 && cli.BPM > 0
+
+	for i := range p.Len() {
+		e := p.Event(i)
+
+		t := base + max(e.Time(), 0)
+		if quantize {
+			t = cli.quantize(t)
+		}
+
+		e.SetTime(t)
+	}
+
+	return nil
+}
+
+// quantize snaps t to the closest sixteenth note of the BPM grid.
+// The grid starts at the unix epoch so every instance agrees on it.
+func (cli *Hub) quantize(t int64) int64 {
+	step := int64(time.Minute) / int64(cli.BPM) / 4
+	return (t + step/2) / step * step
+}
@@ -0,0 +1,217 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+const (
+	maxModerationReason = 200
+	// close reasons are limited to 123 bytes by the protocol
+	maxCloseReason = 123
+)
+
+var (
+	ErrNotModerator      = errors.New("not allowed to moderate this room or member")
+	ErrMemberNotFound    = errors.New("member not found")
+	ErrInvalidModeration = errors.New("invalid moderation")
+	ErrBanAnonymous      = errors.New("only signed in members can be banned")
+)
+
+// Moderator is called with every moderation before it's applied, an error cancels it.
+// It's where the moderations are persisted, e.g. the bans and the audit trail of the room.
+type Moderator func(ctx context.Context, p *msg.ModeratePayload) error
+
+/*
+Moderate applies a moderation made by a member with role to the room on every
+instance. Owners can moderate everyone but the owners, moderators everyone but
+the owners and the other moderators.
+
+Kicked and banned members are disconnected with status 1008 (policy violation),
+the messages of muted members are dropped until they're unmuted, even once they
+reconnect, and locked rooms don't accept new connections but the owners'. The moderation is sent to the room once applied.
+*/
+func (cli *Hub) Moderate(ctx context.Context, role Role, p *msg.ModeratePayload) error {
+	if !role.Moderates() {
+		return ErrNotModerator
+	}
+
+	if len(p.Reason) > maxModerationReason {
+		return ErrInvalidModeration
+	}
+
+	switch p.Action {
+	case msg.ModerateLock, msg.ModerateUnlock:
+		p.Target, p.TargetUserID = "", ""
+	case msg.ModerateKick, msg.ModerateBan, msg.ModerateMute, msg.ModerateUnmute:
+		target, ok := cli.member(p.Target)
+		if !ok {
+			return ErrMemberNotFound
+		}
+		if Role(target.Role) == RoleOwner || (role != RoleOwner && Role(target.Role) == RoleModerator) {
+			return ErrNotModerator
+		}
+
+		p.TargetUserID = target.UserID
+		if p.Action == msg.ModerateBan && p.TargetUserID == "" {
+			return ErrBanAnonymous
+		}
+	default:
+		return ErrInvalidModeration
+	}
+
+	if cli.Moderator != nil {
+		if err := cli.Moderator(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	env, err := msg.NewJSON(msg.Moderate, p)
+	if err != nil {
+		return err
+	}
+	m := newMessage(env)
+
+	cli.do(func() {
+		if m != nil {
+			cli.emit(m)
+		}
+		cli.applyModeration(p)
+	})
+	return nil
+}
+
+// member returns the presence of the member with the connection id on any instance.
+func (cli *Hub) member(id string) (msg.MemberPresence, bool) {
+	var (
+		p  msg.MemberPresence
+		ok bool
+	)
+	found := make(chan struct{})
+	cli.do(func() {
+		defer close(found)
+
+		var mp *msg.MemberPresence
+		if mp, ok = cli.presence[id]; ok {
+			p = *mp
+		}
+	})
+
+	select {
+	case <-found:
+		return p, ok
+	case <-cli.done:
+		return p, false
+	}
+}
+
+// applyModeration applies p to the local connections and the state of the room.
+// Called from the listen goroutine of every instance.
+func (cli *Hub) applyModeration(p *msg.ModeratePayload) {
+	switch p.Action {
+	case msg.ModerateKick, msg.ModerateBan:
+		conn, ok := cli.byID[p.Target]
+		if !ok || conn.closed {
+			return
+		}
+
+		reason := "kicked"
+		if p.Action == msg.ModerateBan {
+			reason = "banned"
+		}
+		if p.Reason != "" {
+			reason += ": " + p.Reason
+		}
+
+		cli.dequeue(conn)
+		conn.closeCode, conn.closeReason = ws.StatusPolicyViolation, truncate(reason, maxCloseReason)
+		cli.closeSend(conn)
+	case msg.ModerateMute, msg.ModerateUnmute:
+		silenced := p.Action == msg.ModerateMute
+		key := muteKey(p.TargetUserID, p.Target)
+		if silenced {
+			cli.muted[key] = true
+		} else {
+			delete(cli.muted, key)
+		}
+
+		// every connection of the user is muted
+		for id, conn := range cli.byID {
+			if muteKey(conn.member.UserID, id) == key {
+				conn.silenced.Store(silenced)
+			}
+		}
+		for id, mp := range cli.presence {
+			if muteKey(mp.UserID, id) == key {
+				mp.Silenced = silenced
+			}
+		}
+	case msg.ModerateLock, msg.ModerateUnlock:
+		cli.locked.Store(p.Action == msg.ModerateLock)
+	}
+}
+
+// muteKey is the key of a member in Hub.muted, the signed in members are muted
+// by user and the anonymous ones by connection.
+func muteKey(userID, connID string) string {
+	if userID != "" {
+		return "user:" + userID
+	}
+
+	return "conn:" + connID
+}
+
+// handleModerate applies a Moderate message sent by conn. Called by the reader of conn.
+func (cli *Hub) handleModerate(conn *TransportHandler, payload []byte) {
+	var p msg.ModeratePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		slog.Debug("moderate unmarshal", "err", err)
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorInvalid, Msg: ErrInvalidModeration.Error(), Type: msg.Moderate})
+		return
+	}
+
+	p.TargetUserID = ""
+	p.ActorID, p.ActorUserID, p.ActorName = conn.id, conn.member.UserID, conn.member.Name
+
+	err := cli.Moderate(context.Background(), conn.role(), &p)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotModerator):
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorForbidden, Msg: err.Error(), Type: msg.Moderate})
+	case errors.Is(err, ErrMemberNotFound), errors.Is(err, ErrInvalidModeration), errors.Is(err, ErrBanAnonymous):
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorInvalid, Msg: err.Error(), Type: msg.Moderate})
+	default:
+		slog.Error("moderate", "err", err)
+		cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorInvalid, Msg: "unexpected error", Type: msg.Moderate})
+	}
+}
+
+// handleRemoteModerate applies a moderation made on another instance, it's
+// delivered before the target is disconnected so they know why.
+func (cli *Hub) handleRemoteModerate(m *wsutil.Message, payload []byte) {
+	var p msg.ModeratePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		slog.Debug("remote moderate unmarshal", "err", err)
+		return
+	}
+
+	cli.deliver(m)
+	cli.applyModeration(&p)
+}
+
+// truncate cuts s to at most n bytes without splitting a rune.
+func truncate(s string, n int) string {
+	for len(s) > n {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+
+	return s
+}
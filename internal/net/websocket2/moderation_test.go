@@ -0,0 +1,230 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// moderations records what the Moderator of a hub was called with.
+type moderations struct {
+	mu   sync.Mutex
+	seen []msg.ModeratePayload
+}
+
+func (m *moderations) moderate(_ context.Context, p *msg.ModeratePayload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seen = append(m.seen, *p)
+	return nil
+}
+
+func (m *moderations) last() msg.ModeratePayload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.seen[len(m.seen)-1]
+}
+
+func TestKickBan(t *testing.T) {
+	mods := &moderations{}
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 5, Moderator: mods.moderate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	alice, _ := join(t, srv, "n=alice&u=alice-id&role=owner")
+	bob, _ := join(t, srv, "n=bob&u=bob-id")
+	bobID := alice.memberID("bob")
+	eve, _ := join(t, srv, "n=eve")
+	eveID := alice.memberID("eve")
+
+	t.Run("kick", func(t *testing.T) {
+		alice.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateKick, Target: eveID, Reason: "spam"})
+
+		// eve is told why before being disconnected
+		var p msg.ModeratePayload
+		eve.expectJSON(msg.Moderate, &p)
+		if p.Action != msg.ModerateKick || p.Target != eveID || p.Reason != "spam" || p.ActorName != "alice" {
+			t.Errorf("eve got %+v, want to be kicked by alice", p)
+		}
+		if code := eve.expectClose(); code != 1008 {
+			t.Errorf("eve was closed with %d, want 1008", code)
+		}
+	})
+
+	t.Run("ban anonymous", func(t *testing.T) {
+		join(t, srv, "n=carol")
+		alice.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateBan, Target: alice.memberID("carol")})
+
+		var ep msg.ErrorPayload
+		alice.expectJSON(msg.Error, &ep)
+		if ep.Code != msg.ErrorInvalid {
+			t.Errorf("banning carol got %q, want %q", ep.Code, msg.ErrorInvalid)
+		}
+	})
+
+	t.Run("ban", func(t *testing.T) {
+		alice.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateBan, Target: bobID, TargetUserID: "someone-else"})
+
+		bob.expect(msg.Moderate)
+		if code := bob.expectClose(); code != 1008 {
+			t.Errorf("bob was closed with %d, want 1008", code)
+		}
+
+		// the ban is persisted for the user of the connection, whatever was sent
+		if p := mods.last(); p.Action != msg.ModerateBan || p.TargetUserID != "bob-id" || p.ActorUserID != "alice-id" {
+			t.Errorf("the Moderator got %+v, want the ban of bob by alice", p)
+		}
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		dave, snapshot := join(t, srv, "n=dave&u=dave-id&role=owner")
+		dave.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateKick, Target: dave.presenceID(snapshot, "alice")})
+
+		var ep msg.ErrorPayload
+		dave.expectJSON(msg.Error, &ep)
+		if ep.Code != msg.ErrorForbidden {
+			t.Errorf("kicking the owner got %q, want %q", ep.Code, msg.ErrorForbidden)
+		}
+	})
+}
+
+func TestModerateRoles(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	join(t, srv, "n=alice&u=alice-id&role=owner")
+	mod, _ := join(t, srv, "n=mod&u=mod-id&role=moderator")
+	join(t, srv, "n=other&u=other-id&role=moderator")
+	editor, _ := join(t, srv, "n=editor&u=editor-id")
+	// anonymous connections can't claim the role
+	anonymous, _ := join(t, srv, "n=anonymous&role=moderator")
+	bob, snapshot := join(t, srv, "n=bob&u=bob-id")
+
+	ids := make(map[string]string)
+	for _, m := range snapshot.Members {
+		ids[m.Name] = m.ID
+		if m.Name == "anonymous" && Role(m.Role) != RoleEditor {
+			t.Errorf("the anonymous moderator joined as %s, want %s", m.Role, RoleEditor)
+		}
+	}
+
+	forbidden := []struct {
+		name   string
+		c      *client
+		target string
+	}{
+		{"editor", editor, "bob"},
+		{"anonymous moderator", anonymous, "bob"},
+		{"moderator kicking the owner", mod, "alice"},
+		{"moderator kicking a moderator", mod, "other"},
+	}
+	for _, tc := range forbidden {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.c.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateKick, Target: ids[tc.target]})
+
+			var ep msg.ErrorPayload
+			tc.c.expectJSON(msg.Error, &ep)
+			if ep.Code != msg.ErrorForbidden {
+				t.Errorf("got %q, want %q", ep.Code, msg.ErrorForbidden)
+			}
+		})
+	}
+
+	t.Run("moderator", func(t *testing.T) {
+		mod.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateKick, Target: ids["bob"]})
+		if code := bob.expectClose(); code != 1008 {
+			t.Errorf("bob was closed with %d, want 1008", code)
+		}
+	})
+}
+
+func TestMuteReconnect(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	srv := newServer(t, hub)
+
+	alice, _ := join(t, srv, "n=alice&u=alice-id&role=owner")
+	bob, _ := join(t, srv, "n=bob&u=bob-id")
+	alice.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateMute, Target: alice.memberID("bob")})
+	bob.expect(msg.Moderate)
+
+	// muted reports whether the presence update of c is refused, it's sent to
+	// the room otherwise
+	muted := func(c *client, id string) bool {
+		t.Helper()
+
+		c.send(msg.Presence, &msg.PresenceUpdate{})
+		for {
+			env, err := c.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch env.Typ {
+			case msg.Error:
+				return true
+			case msg.Presence:
+				var p msg.PresencePayload
+				if err := json.Unmarshal(env.Payload, &p); err != nil {
+					t.Fatal(err)
+				}
+				if p.Op == msg.PresenceOpUpdate && len(p.Members) == 1 && p.Members[0].ID == id {
+					return false
+				}
+			}
+		}
+	}
+
+	// bob is still muted once reconnected
+	bob.Close()
+	for {
+		var p msg.PresencePayload
+		if alice.expectJSON(msg.Presence, &p); p.Op == msg.PresenceOpLeave {
+			break
+		}
+	}
+	bob, snapshot := join(t, srv, "n=bob&u=bob-id")
+	bobID := bob.presenceID(snapshot, "bob")
+	for _, m := range snapshot.Members {
+		if m.ID == bobID && !m.Silenced {
+			t.Errorf("bob reconnected as %+v, want them silenced", m)
+		}
+	}
+	if !muted(bob, bobID) {
+		t.Fatal("bob isn't muted once reconnected")
+	}
+
+	alice.send(msg.Moderate, &msg.ModeratePayload{Action: msg.ModerateUnmute, Target: bobID})
+	bob.expect(msg.Moderate)
+	if muted(bob, bobID) {
+		t.Error("bob is still muted once unmuted")
+	}
+
+	// the members muted before they connected
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeHTTP(w, r.WithContext(WithMember(r.Context(), &Member{Name: "carol", UserID: "carol-id", Role: RoleEditor, Muted: true})))
+	}))
+	defer srv.Close()
+	carol, snapshot := join(t, srv, "")
+	if !muted(carol, carol.presenceID(snapshot, "carol")) {
+		t.Error("carol muted before connecting isn't muted")
+	}
+}
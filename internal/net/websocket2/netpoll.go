@@ -0,0 +1,253 @@
+package websocket
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+const (
+	// time allowed to read the rest of a frame once its socket is readable,
+	// a slow peer can't hold a worker for longer
+	frameReadWait = 5 * time.Second
+	// tasks queued per worker before schedule starts spawning goroutines
+	netpollQueuePerWorker = 64
+)
+
+var ErrNetpollUnsupported = errors.New("netpoll is not supported on this platform")
+
+type pollDesc struct {
+	fd int
+	fn func(*pollDesc)
+}
+
+/*
+Netpoll serves the connections of every hub with a small pool of workers instead
+of a read and a write goroutine per connection. Sockets are read only once epoll
+reports them readable and the queued frames are written by a worker, so an idle
+connection costs its buffers and not two goroutine stacks.
+
+It's shared by the hubs of a HubStore and must be closed after they're drained.
+*/
+type Netpoll struct {
+	poller *poller
+	tasks  chan func()
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNetpoll starts the poller and the workers, if workers is 0 it's a few per CPU.
+// It returns ErrNetpollUnsupported on platforms without epoll.
+func NewNetpoll(workers int) (*Netpoll, error) {
+	if workers <= 0 {
+		workers = 4 * runtime.GOMAXPROCS(0)
+	}
+
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+
+	np := &Netpoll{
+		poller: p,
+		tasks:  make(chan func(), workers*netpollQueuePerWorker),
+		done:   make(chan struct{}),
+	}
+
+	for range workers {
+		go np.worker()
+	}
+
+	return np, nil
+}
+
+func (np *Netpoll) worker() {
+	for {
+		select {
+		case <-np.done:
+			return
+		case fn := <-np.tasks:
+			fn()
+		}
+	}
+}
+
+// schedule runs fn on a worker. It never blocks since it's called from the
+// listen goroutines, a goroutine is spawned when the queue is full.
+func (np *Netpoll) schedule(fn func()) {
+	select {
+	case np.tasks <- fn:
+	default:
+		go fn()
+	}
+}
+
+func (np *Netpoll) Close() error {
+	if np == nil {
+		return nil
+	}
+
+	var err error
+	np.closeOnce.Do(func() {
+		close(np.done)
+		err = np.poller.close()
+	})
+
+	return err
+}
+
+// connFd returns the file descriptor of conn, TLS and other wrapped connections
+// don't expose one and are served by goroutines.
+func connFd(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, ErrNetpollUnsupported
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return 0, err
+	}
+
+	return fd, nil
+}
+
+// poll hands the reads of conn to the netpoll workers, conn is already registered.
+func (cli *Hub) poll(conn *TransportHandler, fd int) error {
+	d, err := cli.netpoll.poller.start(fd, func(d *pollDesc) {
+		cli.netpoll.schedule(func() { cli.readReady(conn, d) })
+	})
+	if err != nil {
+		return err
+	}
+	conn.desc.Store(d)
+
+	return nil
+}
+
+// readReady reads a single frame of conn once its socket is readable.
+func (cli *Hub) readReady(conn *TransportHandler, d *pollDesc) {
+	_ = conn.setReadDeadLine(frameReadWait)
+
+	wsMsg, err := conn.next(wsutil.NewReader(conn.rwc, ws.StateServerSide))
+
+	var perr *protocolError
+	if errors.As(err, &perr) {
+		cli.violation(conn, perr)
+		if perr.fatal {
+			// flush disconnects conn once the error is sent
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		slog.Debug("netpoll read", "err", err)
+		cli.disconnect(conn)
+		return
+	}
+	conn.lastRead.Store(time.Now().UnixNano())
+
+	if wsMsg != nil && !cli.handle(conn, wsMsg) {
+		cli.disconnect(conn)
+		return
+	}
+
+	if err := cli.netpoll.poller.resume(d); err != nil {
+		slog.Debug("netpoll resume", "err", err)
+		cli.disconnect(conn)
+	}
+}
+
+// wake makes sure the frames queued on a polled conn get written. Called after
+// every send on and close of conn.send.
+func (cli *Hub) wake(conn *TransportHandler) {
+	if !conn.polled {
+		return
+	}
+
+	if conn.pending.Add(1) == 1 {
+		cli.netpoll.schedule(func() { cli.flush(conn) })
+	}
+}
+
+// flush writes the frames queued on conn until none are left, only one flush
+// of a connection runs at a time. It's the netpoll counterpart of write.
+func (cli *Hub) flush(conn *TransportHandler) {
+	for {
+		n := conn.pending.Load()
+
+	drain:
+		for {
+			select {
+			case f, ok := <-conn.send:
+				if !ok {
+					if !conn.writeFailed {
+						_ = conn.setWriteDeadLine(writeWait)
+						_ = conn.write(&wsutil.Message{OpCode: ws.OpClose, Payload: conn.closeBody()})
+						cli.writers.Done()
+					}
+
+					cli.disconnect(conn)
+					return
+				}
+
+				if !conn.writeFailed {
+					_ = conn.setWriteDeadLine(writeWait)
+					if _, err := conn.rwc.Write(f.bytes()); err != nil {
+						slog.Error("msg", "err", err)
+						// like write, the writer is done on the first error,
+						// the frames queued after it are only released
+						conn.writeFailed = true
+						cli.writers.Done()
+						cli.disconnect(conn)
+					}
+				}
+				f.release()
+			default:
+				break drain
+			}
+		}
+
+		if conn.pending.Add(-n) == 0 {
+			return
+		}
+	}
+}
+
+// pingPolled pings the polled connections and closes the ones that haven't sent
+// anything, pongs included, for pongWait. Called from the listen goroutine.
+func (cli *Hub) pingPolled() {
+	f, err := newFrame(&wsutil.Message{OpCode: ws.OpPing})
+	if err != nil {
+		slog.Error("frame encode", "err", err)
+		return
+	}
+	defer f.release()
+
+	deadline := time.Now().Add(-pongWait).UnixNano()
+	for conn := range cli.connections {
+		if !conn.polled || conn.closed {
+			continue
+		}
+
+		if conn.lastRead.Load() < deadline {
+			cli.closeSend(conn)
+			continue
+		}
+
+		cli.sendFrame(conn, f)
+	}
+}
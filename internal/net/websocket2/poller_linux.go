@@ -0,0 +1,147 @@
+//go:build linux
+
+package websocket
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// the registrations are one-shot, a connection is read by a single worker at a
+// time and has to be resumed once it's done
+const pollEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+
+// poller is an epoll instance, wait calls the function of a descriptor when
+// its socket is readable, hung up or in error.
+type poller struct {
+	epfd int
+	// wakes wait up when the poller is closed
+	efd int
+
+	mu    sync.Mutex
+	descs map[int]*pollDesc
+
+	done chan struct{}
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, efd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(efd)}); err != nil {
+		_ = unix.Close(efd)
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+
+	p := &poller{
+		epfd:  epfd,
+		efd:   efd,
+		descs: make(map[int]*pollDesc),
+		done:  make(chan struct{}),
+	}
+	go p.wait()
+
+	return p, nil
+}
+
+func (p *poller) start(fd int, fn func(*pollDesc)) (*pollDesc, error) {
+	d := &pollDesc{fd: fd, fn: fn}
+
+	// a closed descriptor leaves the epoll set on its own, fd may be a reused
+	// number whose old descriptor was never stopped
+	p.mu.Lock()
+	p.descs[fd] = d
+	p.mu.Unlock()
+
+	if err := unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: pollEvents, Fd: int32(fd)}); err != nil {
+		p.mu.Lock()
+		if p.descs[fd] == d {
+			delete(p.descs, fd)
+		}
+		p.mu.Unlock()
+
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// resume re-arms d after its event was handled. The lock orders what the
+// worker did before the next event of d is handled, possibly by another worker.
+func (p *poller) resume(d *pollDesc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, d.fd, &unix.EpollEvent{Events: pollEvents, Fd: int32(d.fd)})
+}
+
+// stop removes d, it must be called before the connection is closed.
+func (p *poller) stop(d *pollDesc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.descs[d.fd] != d {
+		return nil
+	}
+	delete(p.descs, d.fd)
+
+	err := unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, d.fd, nil)
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EBADF) {
+		return nil
+	}
+
+	return err
+}
+
+func (p *poller) close() error {
+	if _, err := unix.Write(p.efd, []byte{0, 0, 0, 0, 0, 0, 0, 1}); err != nil {
+		return err
+	}
+	<-p.done
+
+	return errors.Join(unix.Close(p.efd), unix.Close(p.epfd))
+}
+
+func (p *poller) wait() {
+	defer close(p.done)
+
+	events := make([]unix.EpollEvent, 128)
+	for {
+		n, err := unix.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+
+			slog.Error("epoll wait", "err", err)
+			return
+		}
+
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == p.efd {
+				return
+			}
+
+			p.mu.Lock()
+			d := p.descs[fd]
+			p.mu.Unlock()
+
+			if d != nil {
+				d.fn(d)
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package websocket
+
+// poller is only implemented with epoll, NewNetpoll fails on other platforms
+// and the hubs keep a read and a write goroutine per connection.
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (p *poller) start(fd int, fn func(*pollDesc)) (*pollDesc, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (p *poller) resume(d *pollDesc) error { return ErrNetpollUnsupported }
+
+func (p *poller) stop(d *pollDesc) error { return ErrNetpollUnsupported }
+
+func (p *poller) close() error { return nil }
@@ -0,0 +1,267 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+const (
+	// members without activity for idleAfter are marked idle
+	idleAfter       = time.Minute
+	idleCheckPeriod = 10 * time.Second
+	// awareness updates of a connection are coalesced and sent at most once per awarenessPeriod
+	awarenessPeriod = 50 * time.Millisecond
+)
+
+// Member is who a connection belongs to, it's set on the request context with WithMember
+// before the connection is handed to the hub.
+type Member struct {
+	UserID string
+	Name   string
+	Role   Role
+	// Latency of the member's audio setup, it's subtracted from the time of their MIDI events.
+	Latency time.Duration
+	// MaxConns limits the connections of the user to the rooms of every
+	// instance, 0 is unlimited. It's ignored for anonymous members.
+	MaxConns uint
+	// Muted members were muted in the room before they connected, see Moderate.
+	Muted bool
+}
+
+type memberCtxKey struct{}
+
+func WithMember(ctx context.Context, m *Member) context.Context {
+	return context.WithValue(ctx, memberCtxKey{}, m)
+}
+
+func memberFromContext(ctx context.Context) *Member {
+	m, ok := ctx.Value(memberCtxKey{}).(*Member)
+	if !ok || m == nil {
+		return &Member{Name: "anonymous", Role: RoleEditor}
+	}
+
+	// anonymous members never moderate the room
+	if m.UserID == "" && m.Role.Moderates() {
+		anonymous := *m
+		anonymous.Role = RoleEditor
+		return &anonymous
+	}
+
+	return m
+}
+
+// touch records activity of conn, it's safe to call from any goroutine.
+func (c *TransportHandler) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *TransportHandler) lastActiveAt() time.Time {
+	return time.Unix(0, c.lastActive.Load()).UTC()
+}
+
+// joinPresence adds conn to the presence of the room, sends it the snapshot and
+// tells everyone else. Called from the listen goroutine.
+func (cli *Hub) joinPresence(conn *TransportHandler) {
+	p := &msg.MemberPresence{
+		ID:         conn.id,
+		UserID:     conn.member.UserID,
+		Name:       conn.member.Name,
+		Role:       string(conn.role()),
+		LastActive: conn.lastActiveAt(),
+		Silenced:   conn.silenced.Load(),
+	}
+	if conn.waiting {
+		since := time.Now().UTC()
+		p.WaitingSince = &since
+	}
+	cli.presence[conn.id] = p
+
+	if m := newPresenceMessage(msg.PresenceOpSnapshot, cli.presenceSnapshot()...); m != nil {
+		cli.sendTo(conn, m)
+	}
+
+	cli.emitPresence(msg.PresenceOpJoin, *p)
+}
+
+// presenceSnapshot returns the presence of every member of the room.
+func (cli *Hub) presenceSnapshot() []msg.MemberPresence {
+	snapshot := make([]msg.MemberPresence, 0, len(cli.presence))
+	for _, p := range cli.presence {
+		snapshot = append(snapshot, *p)
+	}
+
+	return snapshot
+}
+
+func (cli *Hub) leavePresence(conn *TransportHandler) {
+	p, ok := cli.presence[conn.id]
+	if !ok {
+		return
+	}
+	delete(cli.presence, conn.id)
+
+	cli.emitPresence(msg.PresenceOpLeave, *p)
+}
+
+// updatePresence applies an update sent by conn.
+func (cli *Hub) updatePresence(conn *TransportHandler, payload []byte) {
+	var u msg.PresenceUpdate
+	if err := json.Unmarshal(payload, &u); err != nil {
+		slog.Debug("presence update unmarshal", "err", err)
+		return
+	}
+
+	cli.do(func() {
+		p, ok := cli.presence[conn.id]
+		if !ok {
+			return
+		}
+
+		if u.Instrument != nil {
+			p.Instrument = *u.Instrument
+		}
+		if u.Muted != nil {
+			p.Muted = *u.Muted
+		}
+		if u.Soloed != nil {
+			p.Soloed = *u.Soloed
+		}
+		p.Idle = false
+		p.LastActive = conn.lastActiveAt()
+
+		cli.emitPresence(msg.PresenceOpUpdate, *p)
+	})
+}
+
+// checkIdle marks the local members without recent activity as idle and the
+// ones that came back as active.
+func (cli *Hub) checkIdle() {
+	now := time.Now()
+	for conn := range cli.connections {
+		p, ok := cli.presence[conn.id]
+		if !ok {
+			continue
+		}
+
+		lastActive := conn.lastActiveAt()
+		idle := now.Sub(lastActive) > idleAfter
+		if idle == p.Idle {
+			continue
+		}
+
+		p.Idle = idle
+		p.LastActive = lastActive
+		cli.emitPresence(msg.PresenceOpUpdate, *p)
+	}
+}
+
+// applyRemotePresence keeps track of the members connected to other instances.
+// It reports whether the message should be delivered to the local connections.
+func (cli *Hub) applyRemotePresence(payload []byte) bool {
+	var pp msg.PresencePayload
+	if err := json.Unmarshal(payload, &pp); err != nil {
+		slog.Debug("remote presence unmarshal", "err", err)
+		return false
+	}
+
+	switch pp.Op {
+	case msg.PresenceOpSync:
+		// a hub for the room was opened on another instance, tell it who's here
+		local := make([]msg.MemberPresence, 0, len(cli.connections))
+		for conn := range cli.connections {
+			if p, ok := cli.presence[conn.id]; ok {
+				local = append(local, *p)
+			}
+		}
+
+		if len(local) > 0 {
+			if m := newPresenceMessage(msg.PresenceOpJoin, local...); m != nil {
+				cli.publish(m)
+			}
+		}
+		return false
+	case msg.PresenceOpLeave:
+		for _, p := range pp.Members {
+			delete(cli.presence, p.ID)
+			cli.forgetPeer(p.ID)
+		}
+
+		// the slot of the member may be free
+		if len(cli.waitlist) > 0 {
+			cli.signalAdmit()
+		}
+	default:
+		for _, p := range pp.Members {
+			cli.presence[p.ID] = &p
+		}
+	}
+
+	return true
+}
+
+// updateAwareness stores the latest awareness state of conn, it's sent on the next flush.
+// Awareness is never persisted.
+func (cli *Hub) updateAwareness(conn *TransportHandler, payload []byte) {
+	if !json.Valid(payload) {
+		return
+	}
+
+	cli.do(func() {
+		conn.awareness = payload
+	})
+}
+
+func (cli *Hub) flushAwareness() {
+	for conn := range cli.connections {
+		if conn.awareness == nil {
+			continue
+		}
+
+		env, err := msg.NewJSON(msg.Awareness, &msg.AwarenessPayload{
+			ID:    conn.id,
+			State: conn.awareness,
+		})
+		conn.awareness = nil
+		if err != nil {
+			slog.Error("awareness marshal", "err", err)
+			continue
+		}
+
+		if m := newMessage(env); m != nil {
+			cli.emit(m)
+		}
+	}
+}
+
+// emitPresence sends a presence delta to the local connections and the other instances.
+func (cli *Hub) emitPresence(op string, members ...msg.MemberPresence) {
+	if m := newPresenceMessage(op, members...); m != nil {
+		cli.emit(m)
+	}
+}
+
+func newPresenceMessage(op string, members ...msg.MemberPresence) *wsutil.Message {
+	env, err := msg.NewJSON(msg.Presence, &msg.PresencePayload{Op: op, Members: members})
+	if err != nil {
+		slog.Error("presence marshal", "err", err)
+		return nil
+	}
+
+	return newMessage(env)
+}
+
+func newMessage(env *msg.Envelope) *wsutil.Message {
+	bs, err := env.MarshalBinary()
+	if err != nil {
+		slog.Error("envelope marshal", "err", err)
+		return nil
+	}
+
+	return &wsutil.Message{OpCode: ws.OpBinary, Payload: bs}
+}
@@ -0,0 +1,351 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+/*
+Recordings are append-only files of records, all integers are big endian:
+
+	[0:8]    sequence number in the room
+	[8:16]   server time in unix nanoseconds
+	[16]     OpCode of the frame
+	[17:21]  length of the envelope
+	[21:]    envelope
+*/
+const (
+	recordingExt      = ".rmxrec"
+	recordHeaderSize  = 21
+	recorderQueueSize = 1024
+	recorderFlush     = time.Second
+)
+
+var (
+	ErrRecording         = errors.New("room is already being recorded")
+	ErrNotRecording      = errors.New("room is not being recorded")
+	ErrRecordingNotFound = errors.New("recording not found")
+)
+
+type Recording struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	StartedAt time.Time `json:"startedAt"`
+	Active    bool      `json:"active"`
+}
+
+type record struct {
+	seq uint64
+	at  time.Time
+	m   *wsutil.Message
+}
+
+type recorder struct {
+	name    string
+	f       *os.File
+	records chan record
+	done    chan struct{}
+}
+
+// StartRecording starts writing every sequenced envelope of the room to a new
+// file in dir, ephemeral types like presence are left out.
+func (cli *Hub) StartRecording(dir string) (*Recording, error) {
+	dir = filepath.Join(dir, cli.room)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	startedAt := time.Now().UTC()
+	name := strconv.FormatInt(startedAt.UnixNano(), 10) + recordingExt
+
+	var (
+		rec *Recording
+		err error
+	)
+	done := make(chan struct{})
+	cli.do(func() {
+		defer close(done)
+
+		if cli.recorder != nil {
+			err = ErrRecording
+			return
+		}
+
+		f, ferr := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+		if ferr != nil {
+			err = ferr
+			return
+		}
+
+		cli.recorder = &recorder{
+			name:    name,
+			f:       f,
+			records: make(chan record, recorderQueueSize),
+			done:    make(chan struct{}),
+		}
+		go cli.recorder.run()
+
+		rec = &Recording{Name: name, StartedAt: startedAt, Active: true}
+	})
+
+	select {
+	case <-done:
+	case <-cli.done:
+		return nil, ErrNotRecording
+	}
+
+	return rec, err
+}
+
+func (cli *Hub) StopRecording() error {
+	var rec *recorder
+	done := make(chan struct{})
+	cli.do(func() {
+		defer close(done)
+
+		rec = cli.recorder
+		cli.recorder = nil
+	})
+
+	select {
+	case <-done:
+	case <-cli.done:
+	}
+
+	if rec == nil {
+		return ErrNotRecording
+	}
+
+	return rec.stop()
+}
+
+// record queues m, called from the listen goroutine.
+func (cli *Hub) record(seq uint64, m *wsutil.Message) {
+	if cli.recorder == nil {
+		return
+	}
+
+	var envelope msg.Envelope
+	if err := envelope.UnmarshalBinary(m.Payload); err == nil {
+		if info, _ := msg.Lookup(envelope.Typ); info.Ephemeral {
+			return
+		}
+	}
+
+	select {
+	case cli.recorder.records <- record{seq: seq, at: time.Now(), m: m}:
+	default:
+		slog.Error("recorder queue full, dropping record", "room", cli.room, "seq", seq)
+	}
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+
+	w := bufio.NewWriter(r.f)
+	ticker := time.NewTicker(recorderFlush)
+	defer ticker.Stop()
+
+	header := make([]byte, recordHeaderSize)
+	for {
+		select {
+		case rec, ok := <-r.records:
+			if !ok {
+				if err := w.Flush(); err != nil {
+					slog.Error("recorder flush", "err", err)
+				}
+				return
+			}
+
+			binary.BigEndian.PutUint64(header[0:8], rec.seq)
+			binary.BigEndian.PutUint64(header[8:16], uint64(rec.at.UnixNano()))
+			header[16] = byte(rec.m.OpCode)
+			binary.BigEndian.PutUint32(header[17:21], uint32(len(rec.m.Payload)))
+
+			if _, err := w.Write(header); err != nil {
+				slog.Error("recorder write", "err", err)
+				continue
+			}
+			if _, err := w.Write(rec.m.Payload); err != nil {
+				slog.Error("recorder write", "err", err)
+			}
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				slog.Error("recorder flush", "err", err)
+			}
+		}
+	}
+}
+
+func (r *recorder) stop() error {
+	close(r.records)
+	<-r.done
+
+	return r.f.Close()
+}
+
+// ListRecordings returns the recordings of room in dir, oldest first.
+func ListRecordings(dir, room string) ([]Recording, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, room))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Recording{}, nil
+		}
+
+		return nil, err
+	}
+
+	recordings := []Recording{}
+	for _, e := range entries {
+		startedAt, ok := parseRecordingName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		recordings = append(recordings, Recording{
+			Name:      e.Name(),
+			Size:      info.Size(),
+			StartedAt: startedAt,
+		})
+	}
+
+	slices.SortFunc(recordings, func(a, b Recording) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+
+	return recordings, nil
+}
+
+// RecordingPath returns the path of a recording, name is checked so it can't escape dir.
+func RecordingPath(dir, room, name string) (string, error) {
+	if _, ok := parseRecordingName(name); !ok || filepath.Base(name) != name {
+		return "", ErrRecordingNotFound
+	}
+
+	path := filepath.Join(dir, room, name)
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrRecordingNotFound
+		}
+
+		return "", err
+	}
+
+	return path, nil
+}
+
+func parseRecordingName(name string) (time.Time, bool) {
+	ts, ok := strings.CutSuffix(name, recordingExt)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	nsec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, nsec).UTC(), true
+}
+
+// Replay describes a recording streamed into a read-only room.
+type Replay struct {
+	Path string
+	// Speed scales the time between records, 1 is the original speed.
+	Speed float64
+}
+
+// replay streams the recording into the room, it's started by the first member
+// and the room is closed once the recording ends.
+func (cli *Hub) replay(ctx context.Context) {
+	defer func() {
+		cli.closeAll(ws.StatusNormalClosure, "replay finished", nil)
+		cli.stop()
+	}()
+
+	f, err := os.Open(cli.Replay.Path)
+	if err != nil {
+		slog.Error("replay open", "err", err)
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, recordHeaderSize)
+
+	var recStart int64
+	start := time.Now()
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Error("replay read", "err", err)
+			}
+			return
+		}
+
+		at := int64(binary.BigEndian.Uint64(header[8:16]))
+		if recStart == 0 {
+			recStart = at
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[17:21]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			slog.Error("replay read", "err", err)
+			return
+		}
+
+		offset := time.Duration(float64(at-recStart) / cli.Replay.Speed)
+		select {
+		case <-time.After(time.Until(start.Add(offset))):
+		case <-ctx.Done():
+			return
+		case <-cli.done:
+			return
+		}
+
+		shiftMIDI(payload, recStart, start.UnixNano(), cli.Replay.Speed)
+
+		select {
+		case cli.broadcast <- &wsutil.Message{OpCode: ws.OpCode(header[16]), Payload: payload}:
+		case <-cli.done:
+			return
+		}
+	}
+}
+
+// shiftMIDI moves the event times of a recorded MIDI envelope to the replay clock.
+func shiftMIDI(bs []byte, recStart, start int64, speed float64) {
+	var envelope msg.Envelope
+	if err := envelope.UnmarshalBinary(bs); err != nil || envelope.Typ != msg.MIDI {
+		return
+	}
+
+	p := msg.MIDIPayload(envelope.Payload)
+	if p.Validate() != nil {
+		return
+	}
+
+	for i := range p.Len() {
+		e := p.Event(i)
+		e.SetTime(start + int64(float64(e.Time()-recStart)/speed))
+	}
+}
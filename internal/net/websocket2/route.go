@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// Role of a member in a room.
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	// RoleModerator members are editors the owner trusted with the moderation
+	// of the room, only signed in members can have it.
+	RoleModerator Role = "moderator"
+	// RoleSpectator members receive the messages of the room but can only send
+	// the passive ones, they don't count against the capacity of the room.
+	RoleSpectator Role = "spectator"
+	// RoleWaiting members wait in the lobby for a slot, they only receive
+	// their position and the presence of the room when they join.
+	RoleWaiting Role = "waiting"
+)
+
+const (
+	maxTopicsPerConn = 64
+)
+
+// Moderates reports whether the members with r can moderate the room, see Moderate.
+func (r Role) Moderates() bool {
+	return r == RoleOwner || r == RoleModerator
+}
+
+var errRouteType = errors.New("route: envelope type can't be routed")
+
+// route delivers the envelope wrapped in a Route message sent by conn to its audience
+// instead of the whole room. Routed messages aren't sequenced or recorded.
+func (cli *Hub) route(conn *TransportHandler, m *wsutil.Message, payload []byte, receivedAt time.Time) {
+	kind, target, inner, err := msg.RoutePayload(payload).Parse()
+	if err != nil {
+		slog.Debug("route", "err", err)
+		return
+	}
+
+	var envelope msg.Envelope
+	if err := envelope.UnmarshalBinary(inner); err != nil {
+		slog.Debug("route", "err", err)
+		return
+	}
+
+	if info, _ := msg.Lookup(envelope.Typ); !info.Routable {
+		slog.Debug("route", "err", errRouteType, "type", envelope.Typ)
+		return
+	}
+
+	if envelope.Typ == msg.MIDI {
+		if err := cli.stampMIDI(conn, envelope.Payload, receivedAt); err != nil {
+			slog.Debug("route midi", "err", err)
+			return
+		}
+	}
+
+	cli.do(func() {
+		cli.deliverRoute(kind, target, &wsutil.Message{OpCode: m.OpCode, Payload: inner})
+	})
+
+	// the audience may be connected to other instances
+	cli.publish(m)
+}
+
+// handleRemoteRoute delivers a routed message from another instance to the local part of its audience.
+func (cli *Hub) handleRemoteRoute(m *wsutil.Message, payload []byte) {
+	kind, target, inner, err := msg.RoutePayload(payload).Parse()
+	if err != nil {
+		slog.Debug("remote route", "err", err)
+		return
+	}
+
+	cli.deliverRoute(kind, target, &wsutil.Message{OpCode: m.OpCode, Payload: inner})
+}
+
+// deliverRoute sends m to the local connections matching the target. Called from the listen goroutine.
+func (cli *Hub) deliverRoute(kind byte, target string, m *wsutil.Message) {
+	if kind == msg.RouteMember {
+		if conn, ok := cli.byID[target]; ok && !conn.waiting {
+			cli.sendTo(conn, m)
+		}
+		return
+	}
+
+	f, err := newFrame(m)
+	if err != nil {
+		slog.Error("frame encode", "err", err)
+		return
+	}
+	defer f.release()
+
+	for conn := range cli.connections {
+		if conn.waiting {
+			continue
+		}
+
+		switch kind {
+		case msg.RouteRole:
+			if string(conn.role()) != target {
+				continue
+			}
+		case msg.RouteTopic:
+			if _, ok := conn.topics[target]; !ok {
+				continue
+			}
+		default:
+			return
+		}
+
+		cli.sendFrame(conn, f)
+	}
+}
+
+// updateSubscriptions changes the topics conn receives routed messages for.
+func (cli *Hub) updateSubscriptions(conn *TransportHandler, payload []byte) {
+	var sp msg.SubscribePayload
+	if err := json.Unmarshal(payload, &sp); err != nil {
+		slog.Debug("subscribe unmarshal", "err", err)
+		return
+	}
+
+	cli.do(func() {
+		for _, topic := range sp.Unsubscribe {
+			delete(conn.topics, topic)
+		}
+
+		for _, topic := range sp.Subscribe {
+			if len(conn.topics) >= maxTopicsPerConn {
+				slog.Debug("subscribe", "err", "too many topics", "conn", conn.id)
+				break
+			}
+
+			if topic == "" || len(topic) > msg.MaxTargetLength {
+				continue
+			}
+
+			conn.topics[topic] = struct{}{}
+		}
+	})
+}
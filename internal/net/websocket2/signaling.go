@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// peerLink is an edge of the WebRTC mesh of a room, A < B.
+type peerLink struct {
+	A, B string
+}
+
+func newPeerLink(a, b string) peerLink {
+	if b < a {
+		a, b = b, a
+	}
+
+	return peerLink{A: a, B: b}
+}
+
+// MeshLink is the state of the peer connection between two members.
+type MeshLink struct {
+	A     string `json:"a"`
+	B     string `json:"b"`
+	State string `json:"state"`
+}
+
+const (
+	linkOffered   = "offered"
+	linkConnected = "connected"
+)
+
+var (
+	errSignalKind   = errors.New("signal: unsupported kind")
+	errSignalTarget = errors.New("signal: recipient is not a member of the room")
+)
+
+// relaySignal routes a signaling message sent by conn to its recipient.
+// Only members of the same room can signal each other.
+func (cli *Hub) relaySignal(conn *TransportHandler, payload []byte) {
+	var sp msg.SignalPayload
+	if err := json.Unmarshal(payload, &sp); err != nil {
+		slog.Debug("signal unmarshal", "err", err)
+		return
+	}
+
+	switch sp.Kind {
+	case msg.SignalOffer, msg.SignalAnswer, msg.SignalCandidate, msg.SignalBye:
+	default:
+		slog.Debug("signal", "err", errSignalKind)
+		return
+	}
+
+	// members can't pretend to be someone else
+	sp.From = conn.id
+
+	env, err := msg.NewJSON(msg.Signal, &sp)
+	if err != nil {
+		slog.Error("signal marshal", "err", err)
+		return
+	}
+
+	m := newMessage(env)
+	if m == nil {
+		return
+	}
+
+	cli.do(func() {
+		if sp.To == sp.From {
+			return
+		}
+
+		if _, ok := cli.presence[sp.To]; !ok {
+			slog.Debug("signal", "err", errSignalTarget, "to", sp.To)
+			return
+		}
+
+		cli.trackSignal(&sp)
+
+		// the mesh is tracked by every instance, not only the one of the recipient
+		cli.publish(m)
+
+		if to, ok := cli.byID[sp.To]; ok {
+			cli.sendTo(to, m)
+		}
+	})
+}
+
+// handleRemoteSignal delivers a signaling message from another instance
+// if the recipient is connected to this one.
+func (cli *Hub) handleRemoteSignal(m *wsutil.Message, payload []byte) {
+	var sp msg.SignalPayload
+	if err := json.Unmarshal(payload, &sp); err != nil {
+		slog.Debug("remote signal unmarshal", "err", err)
+		return
+	}
+
+	cli.trackSignal(&sp)
+
+	if to, ok := cli.byID[sp.To]; ok {
+		cli.sendTo(to, m)
+	}
+}
+
+// trackSignal updates the mesh topology. Called from the listen goroutine.
+func (cli *Hub) trackSignal(sp *msg.SignalPayload) {
+	link := newPeerLink(sp.From, sp.To)
+
+	switch sp.Kind {
+	case msg.SignalOffer:
+		cli.mesh[link] = linkOffered
+	case msg.SignalAnswer:
+		cli.mesh[link] = linkConnected
+	case msg.SignalBye:
+		delete(cli.mesh, link)
+	}
+}
+
+// forgetPeer removes the links of a member that left. Called from the listen goroutine.
+func (cli *Hub) forgetPeer(id string) {
+	for link := range cli.mesh {
+		if link.A == id || link.B == id {
+			delete(cli.mesh, link)
+		}
+	}
+}
+
+// Mesh returns the WebRTC mesh topology of the room.
+func (cli *Hub) Mesh() []MeshLink {
+	links := []MeshLink{}
+	done := make(chan struct{})
+	cli.do(func() {
+		defer close(done)
+
+		for link, state := range cli.mesh {
+			links = append(links, MeshLink{A: link.A, B: link.B, State: state})
+		}
+	})
+
+	select {
+	case <-done:
+	case <-cli.done:
+	}
+
+	slices.SortFunc(links, func(a, b MeshLink) int {
+		return cmp.Or(strings.Compare(a.A, b.A), strings.Compare(a.B, b.B))
+	})
+
+	return links
+}
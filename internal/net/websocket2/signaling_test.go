@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+// TestSignalRelay relays an offer, its answer and a candidate between two
+// members connected to different instances, a third member gets none of them.
+func TestSignalRelay(t *testing.T) {
+	bp := backplane.NewMemory()
+
+	a, err := NewHub("room", bp, &HubOptions{Capacity: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := NewHub("room", bp, &HubOptions{Capacity: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	srvA, srvB := newServer(t, a), newServer(t, b)
+
+	alice, snapshot := join(t, srvA, "n=alice")
+	aliceID := alice.presenceID(snapshot, "alice")
+
+	bob, _ := join(t, srvB, "n=bob")
+
+	bobID := alice.memberID("bob")
+
+	carol, _ := join(t, srvA, "n=carol")
+	alice.memberID("carol")
+	bob.memberID("carol")
+
+	// the sender is always the connection, whatever it claims
+	alice.send(msg.Signal, &msg.SignalPayload{Kind: msg.SignalOffer, From: "mallory", To: bobID, SDP: "offer"})
+
+	var offer msg.SignalPayload
+	bob.expectJSON(msg.Signal, &offer)
+	if offer.Kind != msg.SignalOffer || offer.From != aliceID || offer.SDP != "offer" {
+		t.Errorf("bob got %+v, want the offer of alice", offer)
+	}
+
+	bob.send(msg.Signal, &msg.SignalPayload{Kind: msg.SignalAnswer, To: offer.From, SDP: "answer"})
+
+	var answer msg.SignalPayload
+	alice.expectJSON(msg.Signal, &answer)
+	if answer.Kind != msg.SignalAnswer || answer.From != bobID || answer.SDP != "answer" {
+		t.Errorf("alice got %+v, want the answer of bob", answer)
+	}
+
+	alice.send(msg.Signal, &msg.SignalPayload{Kind: msg.SignalCandidate, To: bobID, Candidate: json.RawMessage(`{"candidate":"candidate:1"}`)})
+
+	var candidate msg.SignalPayload
+	bob.expectJSON(msg.Signal, &candidate)
+	if candidate.Kind != msg.SignalCandidate || candidate.From != aliceID || string(candidate.Candidate) != `{"candidate":"candidate:1"}` {
+		t.Errorf("bob got %+v, want the candidate of alice", candidate)
+	}
+
+	// both instances track the mesh
+	for name, hub := range map[string]*Hub{"a": a, "b": b} {
+		mesh := hub.Mesh()
+		want := newPeerLink(aliceID, bobID)
+		if len(mesh) != 1 || mesh[0].A != want.A || mesh[0].B != want.B || mesh[0].State != linkConnected {
+			t.Errorf("mesh of %s = %+v, want alice and bob connected", name, mesh)
+		}
+	}
+
+	// carol gets the next presence of alice but none of the signals before it
+	alice.send(msg.Presence, &msg.PresenceUpdate{})
+	for {
+		env, err := carol.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Typ == msg.Signal {
+			t.Fatalf("carol got the signal %s", env.Payload)
+		}
+		if env.Typ == msg.Presence {
+			break
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+const (
+	// spectators are counted in their own room of the backplane
+	spectatorsSuffix = ":spectators"
+	// and the connections of the users with MaxConns in one of their own
+	userPrefix = "user:"
+)
+
+func (c *TransportHandler) role() Role {
+	return *c.currentRole.Load()
+}
+
+func (c *TransportHandler) setRole(r Role) {
+	c.currentRole.Store(&r)
+}
+
+// seat returns the room of the backplane a member with role is counted in and its capacity.
+// Owners are counted with the players but never wait for a slot of their own room.
+func (cli *Hub) seat(role Role) (string, uint) {
+	switch role {
+	case RoleSpectator:
+		return cli.room + spectatorsSuffix, cli.MaxSpectators
+	case RoleOwner:
+		return cli.room, 0
+	}
+
+	return cli.room, cli.Capacity
+}
+
+// joinUser counts conn against the MaxConns of its member, see ServeHTTP.
+func (cli *Hub) joinUser(ctx context.Context, conn *TransportHandler) error {
+	if conn.member.MaxConns == 0 || conn.member.UserID == "" {
+		return nil
+	}
+
+	return cli.bp.Join(ctx, userPrefix+conn.member.UserID, conn.id, conn.member.MaxConns)
+}
+
+// leaveUser gives up the connection of conn counted by joinUser.
+func (cli *Hub) leaveUser(conn *TransportHandler) {
+	if conn.member.MaxConns == 0 || conn.member.UserID == "" {
+		return
+	}
+
+	if err := cli.bp.Leave(context.Background(), userPrefix+conn.member.UserID, conn.id); err != nil {
+		slog.Error("backplane leave", "err", err)
+	}
+}
+
+// leaveSeat gives up the slot of conn, waiting connections have none, and its
+// connection counted by joinUser.
+func (cli *Hub) leaveSeat(conn *TransportHandler) {
+	cli.leaveUser(conn)
+
+	role := conn.role()
+	if role == RoleWaiting {
+		return
+	}
+
+	room, _ := cli.seat(role)
+	if err := cli.bp.Leave(context.Background(), room, conn.id); err != nil {
+		slog.Error("backplane leave", "err", err)
+	}
+}
+
+// promote makes the spectator conn a player if the room has a free slot,
+// the room is told with a presence update. Called by the reader of conn.
+func (cli *Hub) promote(conn *TransportHandler) {
+	if conn.role() != RoleSpectator {
+		return
+	}
+
+	ctx := context.Background()
+	if err := cli.bp.Join(ctx, cli.room, conn.id, cli.Capacity); err != nil {
+		if errors.Is(err, backplane.ErrRoomFull) {
+			cli.sendError(conn, &msg.ErrorPayload{Code: msg.ErrorRoomFull, Msg: "the room is full", Type: msg.Promote})
+			return
+		}
+
+		slog.Error("backplane join", "err", err)
+		return
+	}
+
+	conn.setRole(RoleEditor)
+	if err := cli.bp.Leave(ctx, cli.room+spectatorsSuffix, conn.id); err != nil {
+		slog.Error("backplane leave", "err", err)
+	}
+
+	// disconnect may have left the room of the spectators before the role changed
+	if conn.disconnected.Load() {
+		if err := cli.bp.Leave(ctx, cli.room, conn.id); err != nil {
+			slog.Error("backplane leave", "err", err)
+		}
+		return
+	}
+
+	cli.do(func() {
+		p, ok := cli.presence[conn.id]
+		if !ok {
+			return
+		}
+
+		p.Role = string(RoleEditor)
+		cli.emitPresence(msg.PresenceOpUpdate, *p)
+	})
+}
@@ -0,0 +1,288 @@
+package websocket
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+const (
+	// sequenced messages kept for the listeners resuming with Last-Event-ID
+	historySize = 512
+	// listeners are counted in their own room of the backplane
+	listenersSuffix = ":listeners"
+	sseKeepAlive    = 15 * time.Second
+)
+
+// event is a message delivered to the room, seq is 0 for the ones that aren't sequenced.
+type event struct {
+	seq uint64
+	m   *wsutil.Message
+}
+
+// history is a ring of the last sequenced events, owned by the listen goroutine.
+type history struct {
+	events []event
+	next   int
+}
+
+func (h *history) add(e event) {
+	if len(h.events) < historySize {
+		h.events = append(h.events, e)
+		return
+	}
+
+	h.events[h.next] = e
+	h.next = (h.next + 1) % historySize
+}
+
+// since returns the events after seq, oldest first. It reports false if some
+// of them are no longer in the history.
+func (h *history) since(seq uint64) ([]event, bool) {
+	events := make([]event, 0, len(h.events))
+	for i := range h.events {
+		if e := h.events[(h.next+i)%len(h.events)]; e.seq > seq {
+			events = append(events, e)
+		}
+	}
+
+	// the sequence numbers are contiguous, the ring dropped the oldest ones
+	if len(h.events) == historySize && len(events) == len(h.events) && events[0].seq > seq+1 {
+		return nil, false
+	}
+
+	return events, true
+}
+
+// listener is an SSE client of the room.
+type listener struct {
+	events chan event
+	// owned by the listen goroutine
+	closed bool
+}
+
+// deliverListeners sends e to every listener. Called from the listen goroutine.
+func (cli *Hub) deliverListeners(e event) {
+	for l := range cli.listeners {
+		select {
+		case l.events <- e:
+		default:
+			slog.Debug("listener channel buffer possible full")
+			cli.closeListener(l)
+		}
+	}
+}
+
+func (cli *Hub) closeListener(l *listener) {
+	if l.closed {
+		return
+	}
+
+	l.closed = true
+	close(l.events)
+	delete(cli.listeners, l)
+}
+
+/*
+ServeSSE streams the messages delivered to the room as Server-Sent Events encoded
+as JSON, see msg.Envelope.MarshalJSON. Listeners are read-only and count
+against MaxListeners instead of Capacity, locked rooms only accept the owners
+like ServeHTTP.
+
+The id of an event is the id of the hub and its sequence number in the room. A
+listener reconnecting with Last-Event-ID to the same hub gets the events it
+missed as long as they're still in its history. Otherwise, e.g. once the
+server restarted or on another instance, it gets the presence and the chat
+of the room like a new listener.
+*/
+func (cli *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if cli.draining.Load() {
+		http.Error(w, "server restarting", http.StatusServiceUnavailable)
+		return
+	}
+
+	if cli.locked.Load() && memberFromContext(r.Context()).Role != RoleOwner {
+		http.Error(w, "room is locked", http.StatusLocked)
+		return
+	}
+
+	lastID, resume := cli.parseEventID(cmp.Or(r.Header.Get("Last-Event-ID"), r.URL.Query().Get("lastEventId")))
+
+	// the stream outlives the WriteTimeout of the server
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.Error("sse write deadline", "err", err)
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	id := uuid.NewString()
+	if err := cli.bp.Join(r.Context(), cli.room+listenersSuffix, id, cli.MaxListeners); err != nil {
+		if errors.Is(err, backplane.ErrRoomFull) {
+			http.Error(w, "too many listeners", http.StatusServiceUnavailable)
+			return
+		}
+
+		slog.Error("backplane join", "err", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := cli.bp.Leave(context.Background(), cli.room+listenersSuffix, id); err != nil {
+			slog.Error("backplane leave", "err", err)
+		}
+	}()
+
+	l := &listener{events: make(chan event, 256)}
+
+	// registered on the listen goroutine so nothing is missed between the backlog and the live events
+	var backlog []event
+	registered := make(chan struct{})
+	cli.do(func() {
+		defer close(registered)
+
+		if resume && lastID <= cli.seq {
+			backlog, resume = cli.history.since(lastID)
+		} else {
+			resume = false
+		}
+
+		// the listeners that can't resume start over
+		if !resume {
+			for _, m := range cli.chatHistoryMessages() {
+				backlog = append(backlog, event{m: m})
+			}
+		}
+		if m := newPresenceMessage(msg.PresenceOpSnapshot, cli.presenceSnapshot()...); m != nil {
+			backlog = append([]event{{m: m}}, backlog...)
+		}
+		cli.listeners[l] = struct{}{}
+	})
+
+	select {
+	case <-registered:
+	case <-cli.done:
+		http.Error(w, "server restarting", http.StatusServiceUnavailable)
+		return
+	}
+	defer cli.do(func() { cli.closeListener(l) })
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+
+		return rc.Flush()
+	}
+
+	for _, e := range backlog {
+		if err := writeEvent(bw, cli.id, e); err != nil {
+			slog.Debug("sse write", "err", err)
+			return
+		}
+	}
+	if err := flush(); err != nil {
+		slog.Debug("sse flush", "err", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-l.events:
+			if !ok {
+				return
+			}
+
+			if err := writeEvent(bw, cli.id, e); err != nil {
+				slog.Debug("sse write", "err", err)
+				return
+			}
+
+			// write what's queued at once
+			for n := len(l.events); n > 0; n-- {
+				if e, ok := <-l.events; ok {
+					if err := writeEvent(bw, cli.id, e); err != nil {
+						slog.Debug("sse write", "err", err)
+						return
+					}
+				}
+			}
+		case <-keepAlive.C:
+			if _, err := bw.WriteString(": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := flush(); err != nil {
+			slog.Debug("sse flush", "err", err)
+			return
+		}
+	}
+}
+
+// parseEventID returns the sequence number of the event id, it reports false if
+// the event wasn't sent by this hub.
+func (cli *Hub) parseEventID(id string) (uint64, bool) {
+	hubID, seq, ok := strings.Cut(id, ":")
+	if !ok || hubID != cli.id {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// writeEvent writes e named after its type with its id in the hub, messages
+// that aren't envelopes are skipped.
+func writeEvent(w *bufio.Writer, hubID string, e event) error {
+	var envelope msg.Envelope
+	if err := envelope.UnmarshalBinary(e.m.Payload); err != nil {
+		return nil
+	}
+
+	data, err := json.Marshal(&envelope)
+	if err != nil {
+		return err
+	}
+
+	info, _ := msg.Lookup(envelope.Typ)
+
+	if e.seq > 0 {
+		fmt.Fprintf(w, "id: %s:%d\n", hubID, e.seq)
+	}
+
+	// tell EventSource when to reconnect when the server restarts
+	if envelope.Typ == msg.Notice {
+		var notice msg.NoticePayload
+		if err := json.Unmarshal(envelope.Payload, &notice); err == nil && notice.RetryAfter > 0 {
+			fmt.Fprintf(w, "retry: %d\n", notice.RetryAfter*1000)
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", info.Name, data)
+	return err
+}
@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+)
+
+type sseEvent struct {
+	id, name, data string
+}
+
+// sseStream is a listener of a test server.
+type sseStream struct {
+	t      *testing.T
+	res    *http.Response
+	r      *bufio.Reader
+	cancel context.CancelFunc
+}
+
+// listen opens the stream of srv, the members of its query are like the ones of newServer.
+func listen(t *testing.T, srv *httptest.Server, query, lastEventID string) *sseStream {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sseStream{t: t, res: res, r: bufio.NewReader(res.Body), cancel: cancel}
+	t.Cleanup(s.close)
+
+	return s
+}
+
+func (s *sseStream) close() {
+	s.cancel()
+	s.res.Body.Close()
+}
+
+func (s *sseStream) next() sseEvent {
+	s.t.Helper()
+
+	var e sseEvent
+	timer := time.AfterFunc(readTimeout, s.cancel)
+	defer timer.Stop()
+
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.t.Fatalf("reading the stream: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.name != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func newSSEServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		hub.ServeSSE(w, r.WithContext(WithMember(r.Context(), &Member{Name: q.Get("n"), UserID: q.Get("u"), Role: Role(q.Get("role"))})))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestSSEResume(t *testing.T) {
+	chat := &memoryChat{}
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 3, Chat: chat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	srv := newServer(t, hub)
+	sse := newSSEServer(t, hub)
+
+	alice, _ := join(t, srv, "n=alice")
+	alice.send(msg.Chat, &msg.ChatPayload{Op: msg.ChatSend, Text: "hello"})
+	alice.expect(msg.Chat)
+
+	first := listen(t, sse, "n=bob", "")
+	if e := first.next(); e.name != "presence" {
+		t.Fatalf("first event is %s, want the presence", e.name)
+	}
+	if e := first.next(); e.name != "chat" || !strings.Contains(e.data, "hello") {
+		t.Fatalf("second event is %s %s, want the chat history", e.name, e.data)
+	}
+
+	alice.send(msg.Presence, &msg.PresenceUpdate{})
+	seen := first.next()
+	if !strings.HasPrefix(seen.id, hub.id+":") {
+		t.Fatalf("event id %q isn't scoped to the hub %s", seen.id, hub.id)
+	}
+	first.close()
+
+	// missed while bob was away
+	alice.send(msg.Presence, &msg.PresenceUpdate{})
+	alice.expect(msg.Presence)
+	alice.expect(msg.Presence)
+
+	t.Run("same hub", func(t *testing.T) {
+		s := listen(t, sse, "n=bob", seen.id)
+		s.next() // presence
+
+		if e := s.next(); e.name != "presence" || e.id == seen.id || e.id == "" {
+			t.Errorf("resumed with %+v, want the missed presence", e)
+		}
+	})
+
+	t.Run("other hub", func(t *testing.T) {
+		s := listen(t, sse, "n=bob", "restarted:1")
+		s.next() // presence
+
+		if e := s.next(); e.name != "chat" {
+			t.Errorf("resumed with %+v, want the chat history of the snapshot", e)
+		}
+	})
+}
+
+func TestSSELocked(t *testing.T) {
+	hub, err := NewHub("room", backplane.NewMemory(), &HubOptions{Capacity: 3, Locked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	sse := newSSEServer(t, hub)
+
+	if s := listen(t, sse, "n=bob&role=spectator", ""); s.res.StatusCode != http.StatusLocked {
+		t.Errorf("listener of the locked room got %d, want %d", s.res.StatusCode, http.StatusLocked)
+	}
+	if s := listen(t, sse, "n=alice&u=alice-id&role=owner", ""); s.res.StatusCode != http.StatusOK {
+		t.Errorf("owner of the locked room got %d, want %d", s.res.StatusCode, http.StatusOK)
+	}
+}
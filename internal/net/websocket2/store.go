@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"golang.org/x/sync/errgroup"
+)
+
+// emptyGrace is how long a Hub is kept once its last member left, the members
+// reconnecting in the meantime find the room as they left it.
+var emptyGrace = 30 * time.Second
+
+// ErrDraining is returned by GetOrCreate once the store is draining.
+var ErrDraining = errors.New("hub store is draining")
+
+// HubStore keeps a Hub per room, hubs are removed once they're stopped or have
+// been empty for emptyGrace.
+type HubStore struct {
+	sync.RWMutex
+
+	bp       backplane.Backplane
+	defaults HubOptions
+	hubs     map[string]*Hub
+	draining bool
+}
+
+// NewHubStore returns an empty HubStore. The Netpoll, Limits and MaxSpectators
+// of defaults are used by the hubs created without their own.
+func NewHubStore(bp backplane.Backplane, defaults *HubOptions) *HubStore {
+	return &HubStore{
+		bp:       bp,
+		defaults: *defaults,
+		hubs:     make(map[string]*Hub),
+	}
+}
+
+// GetOrCreate returns the Hub of room, a new one is created with opts
+// if the room has no Hub on this instance yet. The stopped hubs that aren't
+// removed yet are replaced, no hub is created once the store is draining.
+func (hs *HubStore) GetOrCreate(room string, opts *HubOptions) (*Hub, error) {
+	hs.RLock()
+	hub, ok := hs.hubs[room]
+	hs.RUnlock()
+	if ok && !hub.stopped() {
+		return hub, nil
+	}
+
+	hs.Lock()
+	defer hs.Unlock()
+
+	if hub, ok := hs.hubs[room]; ok && !hub.stopped() {
+		return hub, nil
+	}
+	if hs.draining {
+		return nil, ErrDraining
+	}
+
+	o := *opts
+	o.Netpoll = cmp.Or(o.Netpoll, hs.defaults.Netpoll)
+	o.Limits = cmp.Or(o.Limits, hs.defaults.Limits)
+	o.MaxSpectators = cmp.Or(o.MaxSpectators, hs.defaults.MaxSpectators)
+
+	// set before the hub starts, it may stop on its own
+	o.onStop = func() {
+		hs.Lock()
+		defer hs.Unlock()
+
+		if hs.hubs[room] == hub {
+			delete(hs.hubs, room)
+		}
+	}
+
+	var err error
+	if hub, err = NewHub(room, hs.bp, &o); err != nil {
+		return nil, err
+	}
+	hs.hubs[room] = hub
+
+	return hub, nil
+}
+
+// Drain drains every Hub concurrently, see Hub.Drain.
+func (hs *HubStore) Drain(ctx context.Context, retry time.Duration) error {
+	// no hub is created from now on, the ones in the store are all there is to drain.
+	// hubs remove themselves from the store once they're stopped
+	hs.Lock()
+	hs.draining = true
+	hubs := make([]*Hub, 0, len(hs.hubs))
+	for _, hub := range hs.hubs {
+		hubs = append(hubs, hub)
+	}
+	hs.Unlock()
+
+	eg := errgroup.Group{}
+	for _, hub := range hubs {
+		eg.Go(func() error {
+			return hub.Drain(ctx, retry)
+		})
+	}
+
+	return eg.Wait()
+}
@@ -1,14 +1,17 @@
 package websocket
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/pmoieni/rmx/internal/net/msg"
 )
 
 const (
@@ -17,13 +20,59 @@ const (
 	// Time allowed to read the next pong message from the peer.
 	pongWait   = 60 * time.Second
 	pingPeriod = (pongWait * 9) / 10
+
+	// gobwas/ws doesn't define it
+	statusServiceRestart ws.StatusCode = 1012
 )
 
 // using websocket for now, will be switching to Quic and WebTransport later
 type TransportHandler struct {
-	rwc net.Conn
+	id     string
+	member *Member
+	rwc    net.Conn
+
+	// role starts as the one of member and changes when a spectator is promoted,
+	// the messages of silenced connections are dropped
+	currentRole atomic.Pointer[Role]
+	silenced    atomic.Bool
+
+	// unix nanoseconds of the last message read
+	lastActive atomic.Int64
+	// limits of the messages read, owned by the reader
+	limiter *limiter
+	// latest awareness state not sent yet and the topics of routed messages
+	// the connection receives, owned by the hub's listen goroutine
+	awareness []byte
+	topics    map[string]struct{}
+	// state of the connection in the waitlist, owned by the hub's listen goroutine
+	waiting  bool
+	approved bool
+	position int
+
+	// frames shared with the other connections, released by the write goroutine
+	send chan *frame
+
+	// owned by the hub's listen goroutine until send is closed
+	closed      bool
+	closeCode   ws.StatusCode
+	closeReason string
+
+	// polled connections are read and written by the netpoll workers, pending
+	// counts the wakes of the writer and writeFailed is owned by it
+	polled       bool
+	desc         atomic.Pointer[pollDesc]
+	pending      atomic.Int32
+	writeFailed  bool
+	lastRead     atomic.Int64
+	disconnected atomic.Bool
+}
+
+func (c *TransportHandler) closeBody() []byte {
+	if c.closeCode == 0 {
+		return []byte{}
+	}
 
-	send chan *wsutil.Message
+	return ws.NewCloseFrameBody(c.closeCode, c.closeReason)
 }
 
 func (c *TransportHandler) setWriteDeadLine(d time.Duration) error {
@@ -38,51 +87,93 @@ func (c *TransportHandler) read() (*wsutil.Message, error) {
 	r := wsutil.NewReader(c.rwc, ws.StateServerSide)
 
 	for {
-		h, err := r.NextFrame()
-		if err != nil {
-			return nil, fmt.Errorf("next frame: %w", err)
+		m, err := c.next(r)
+		if err != nil || m != nil {
+			return m, err
 		}
+	}
+}
 
-		if h.OpCode.IsControl() {
-			if err := c.controlHandler(h, r); err != nil {
-				return nil, fmt.Errorf("control handler: %w", err)
-			}
-			continue
+// next reads a single frame, the message is nil for control frames and the
+// frames that are discarded.
+func (c *TransportHandler) next(r *wsutil.Reader) (*wsutil.Message, error) {
+	h, err := r.NextFrame()
+	if err != nil {
+		return nil, fmt.Errorf("next frame: %w", err)
+	}
+
+	limits := c.limiter.limits
+	fragments := 1
+	r.OnContinuation = func(h ws.Header, _ io.Reader) error {
+		// the message can't be discarded either, the connection is closed
+		if fragments++; fragments > limits.MaxFragments {
+			return errFragments
+		}
+		if h.Length > limits.MaxFrameSize {
+			return wsutil.ErrFrameTooLarge
+		}
+		return nil
+	}
+
+	if h.OpCode.IsControl() {
+		if err := c.controlHandler(h, r); err != nil {
+			return nil, fmt.Errorf("control handler: %w", err)
 		}
+		return nil, nil
+	}
 
-		/*
-			// TODO check if this worth doing
-			if !h.OpCode.IsData() {
-				if h.OpCode.IsControl() {
-					if err := c.controlHandler(h, r); err != nil {
-						return nil, fmt.Errorf("control handler: %w", err)
-					}
-					continue
+	/*
+		// TODO check if this worth doing
+		if !h.OpCode.IsData() {
+			if h.OpCode.IsControl() {
+				if err := c.controlHandler(h, r); err != nil {
+					return nil, fmt.Errorf("control handler: %w", err)
 				}
-			 	if err := r.Discard(); err != nil {
-			 		return nil, fmt.Errorf("discard: %w", err)
-			 	}
-			 	continue
+				continue
 			}
-		*/
+		 	if err := r.Discard(); err != nil {
+		 		return nil, fmt.Errorf("discard: %w", err)
+		 	}
+		 	continue
+		}
+	*/
 
-		// where want = ws.OpText|ws.OpBinary
-		// NOTE -- eq: h.OpCode != 0 && h.OpCode != want
-		if want := (ws.OpText | ws.OpBinary); h.OpCode&want == 0 {
-			if err := r.Discard(); err != nil {
-				return nil, fmt.Errorf("discard: %w", err)
-			}
-			continue
+	// where want = ws.OpText|ws.OpBinary
+	// NOTE -- eq: h.OpCode != 0 && h.OpCode != want
+	if want := (ws.OpText | ws.OpBinary); h.OpCode&want == 0 {
+		if err := r.Discard(); err != nil {
+			return nil, fmt.Errorf("discard: %w", err)
 		}
+		return nil, nil
+	}
 
-		// TODO the custom handler to parse payload could be done here (?)
+	// TODO the custom handler to parse payload could be done here (?)
 
-		p, err := io.ReadAll(r)
-		if err != nil {
-			return nil, fmt.Errorf("read all: %w", err)
-		}
-		return &wsutil.Message{OpCode: h.OpCode, Payload: p}, nil
+	if h.Length/maxDiscardFactor > limits.MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	if h.Length > limits.MaxFrameSize {
+		return nil, c.tooLarge(r)
 	}
+
+	p, err := io.ReadAll(io.LimitReader(r, limits.MaxMessageSize+1))
+	if errors.Is(err, wsutil.ErrFrameTooLarge) || int64(len(p)) > limits.MaxMessageSize {
+		return nil, c.tooLarge(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read all: %w", err)
+	}
+	return &wsutil.Message{OpCode: h.OpCode, Payload: p}, nil
+}
+
+// tooLarge discards the rest of a message over the size limits, it's bounded by
+// the limits. The connection can be kept if it succeeds.
+func (c *TransportHandler) tooLarge(r *wsutil.Reader) error {
+	if err := r.Discard(); err != nil {
+		return fmt.Errorf("discard: %w", err)
+	}
+
+	return &protocolError{code: msg.ErrorTooLarge, msg: "message too large"}
 }
 
 func (c *TransportHandler) write(msg *wsutil.Message) error {
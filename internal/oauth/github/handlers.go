@@ -10,16 +10,13 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/pmoieni/rmx/internal/lib"
 	"github.com/pmoieni/rmx/internal/oauth"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 )
 
 var (
-	stateLength uint = 16
 	// read:user is enabled by default for all GH apps
 	defaultScopes = []string{"read:user", "user:email"}
 
@@ -45,52 +42,13 @@ func NewOAuth2(ctx context.Context, clientID, clientSecret, redirectURL string)
 
 func (p *Provider) Name() string { return "github" }
 
-func (p *Provider) HandleAuthorizationRequest(w http.ResponseWriter, r *http.Request) {
-	state, err := lib.RandomString(stateLength)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	setCallbackCookie(w, "state", state)
-
-	http.Redirect(w, r, p.AuthCodeURL(state), http.StatusTemporaryRedirect)
-}
-
-func setCallbackCookie(w http.ResponseWriter, name, value string) {
-	c := &http.Cookie{
-		Name:     name,
-		Value:    value,
-		MaxAge:   int(time.Hour.Seconds()),
-		Secure:   true,
-		HttpOnly: true,
-	}
-	http.SetCookie(w, c)
+func (p *Provider) AuthCodeURL(_ context.Context, a *oauth.AuthState) (string, error) {
+	return p.Config.AuthCodeURL(a.State, oauth2.S256ChallengeOption(a.Verifier)), nil
 }
 
 // TODO: implement a way to avoid fetching new token if previous token is still valid
-func (p *Provider) GetCallbackResult(r *http.Request) (*oauth.CallbackResult, error) {
-	oauthToken, err := p.getOAuthToken(r)
-	if err != nil {
-		return nil, err
-	}
-
-	return p.FetchUser(r, oauthToken)
-}
-
-func (p *Provider) getOAuthToken(r *http.Request) (*oauth2.Token, error) {
-	state, err := r.Cookie("state")
-	if err != nil {
-		return nil, errors.New("state not found")
-	}
-
-	originalState := r.URL.Query().Get("state")
-
-	if originalState != "" && (originalState != state.Value) {
-		return nil, errors.New("state didn't match")
-	}
-
-	token, err := p.Exchange(r.Context(), r.URL.Query().Get("code"))
+func (p *Provider) Exchange(ctx context.Context, code string, a *oauth.AuthState) (*oauth.CallbackResult, error) {
+	token, err := p.Config.Exchange(ctx, code, oauth2.VerifierOption(a.Verifier))
 	if err != nil {
 		return nil, errors.New("authorization failed")
 	}
@@ -99,11 +57,11 @@ func (p *Provider) getOAuthToken(r *http.Request) (*oauth2.Token, error) {
 		return nil, errors.New("invalid token")
 	}
 
-	return token, err
+	return p.FetchUser(ctx, token)
 }
 
-func (p *Provider) FetchUser(r *http.Request, token *oauth2.Token) (*oauth.CallbackResult, error) {
-	req, err := http.NewRequest("GET", ProfileURL, nil)
+func (p *Provider) FetchUser(ctx context.Context, token *oauth2.Token) (*oauth.CallbackResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ProfileURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -136,21 +94,42 @@ func (p *Provider) FetchUser(r *http.Request, token *oauth2.Token) (*oauth.Callb
 		return nil, err
 	}
 
-	if res.Email == "" {
-		for _, scope := range defaultScopes {
-			if strings.TrimSpace(scope) == "user" || strings.TrimSpace(scope) == "user:email" {
-				res.Email, err = getPrivateMail(token)
-				if err != nil {
-					return nil, err
-				}
-				break
+	for _, scope := range defaultScopes {
+		if strings.TrimSpace(scope) == "user" || strings.TrimSpace(scope) == "user:email" {
+			mails, err := getMails(ctx, token)
+			if err != nil {
+				return nil, err
 			}
+
+			verifyMail(res, mails)
+			break
 		}
 	}
 
 	return res, nil
 }
 
+type mail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// verifyMail sets the email of res to the primary verified email if the profile
+// has none, and whether it's verified.
+func verifyMail(res *oauth.CallbackResult, mails []mail) {
+	for _, m := range mails {
+		if res.Email == "" && m.Primary && m.Verified {
+			res.Email = m.Email
+		}
+
+		if strings.EqualFold(m.Email, res.Email) {
+			res.EmailVerified = m.Verified
+			return
+		}
+	}
+}
+
 func userFromReader(reader io.Reader, res *oauth.CallbackResult) error {
 	u := struct {
 		ID    int    `json:"id"`
@@ -168,10 +147,10 @@ func userFromReader(reader io.Reader, res *oauth.CallbackResult) error {
 	return err
 }
 
-func getPrivateMail(token *oauth2.Token) (string, error) {
-	req, err := http.NewRequest("GET", EmailURL, nil)
+func getMails(ctx context.Context, token *oauth2.Token) ([]mail, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", EmailURL, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	req.Header.Add("Authorization", "Bearer "+token.AccessToken)
@@ -182,29 +161,18 @@ func getPrivateMail(token *oauth2.Token) (string, error) {
 			// TODO: log these errors
 			response.Body.Close()
 		}
-		return "", err
+		return nil, err
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("GitHub API responded with a %d trying to fetch user email", response.StatusCode)
-	}
-
-	var mailList []struct {
-		Email    string `json:"email"`
-		Primary  bool   `json:"primary"`
-		Verified bool   `json:"verified"`
+		return nil, fmt.Errorf("GitHub API responded with a %d trying to fetch user email", response.StatusCode)
 	}
 
-	if err := json.NewDecoder(response.Body).Decode(&mailList); err != nil {
-		return "", err
-	}
-
-	for _, v := range mailList {
-		if v.Primary && v.Verified {
-			return v.Email, nil
-		}
+	var mails []mail
+	if err := json.NewDecoder(response.Body).Decode(&mails); err != nil {
+		return nil, err
 	}
 
-	return "", errors.New("no verified GitHub email found")
+	return mails, nil
 }
@@ -1,15 +1,30 @@
 package oauth
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 )
 
+var (
+	ErrUnknownProvider     = errors.New("invalid name for provider")
+	ErrProviderUnavailable = errors.New("oauth: provider unavailable")
+	// ErrAuthorizationDenied is returned when the provider responded with an
+	// error, e.g. the user denied the authorization.
+	ErrAuthorizationDenied = errors.New("oauth: authorization denied")
+)
+
+// Provider is an OAuth provider, the ClientStore handles the state of its
+// authorizations.
 type Provider interface {
 	Name() string
-	HandleAuthorizationRequest(http.ResponseWriter, *http.Request)
-	GetCallbackResult(*http.Request) (*CallbackResult, error)
+	// AuthCodeURL returns the URL of the authorization request with the state,
+	// the nonce and the PKCE challenge of a.
+	AuthCodeURL(ctx context.Context, a *AuthState) (string, error)
+	// Exchange returns the user of the authorization code of a callback.
+	Exchange(ctx context.Context, code string, a *AuthState) (*CallbackResult, error)
 	// VerifyAccessToken(context.Context, string) error
 }
 
@@ -18,17 +33,23 @@ type CallbackResult struct {
 	Issuer  string
 	UserID  string
 	Email   string
+	// EmailVerified is whether the provider verified Email, users are only
+	// linked by their email when it's verified.
+	EmailVerified bool
 }
 
 type ClientStore struct {
 	sync.RWMutex
 
 	clients map[string]Provider
+	// stateKey signs the cookies of the authorization states
+	stateKey []byte
 }
 
-func NewClientStore() *ClientStore {
+func NewClientStore(stateKey []byte) *ClientStore {
 	return &ClientStore{
-		clients: make(map[string]Provider),
+		clients:  make(map[string]Provider),
+		stateKey: stateKey,
 	}
 }
 
@@ -45,8 +66,56 @@ func (cs *ClientStore) GetProvider(name string) (Provider, error) {
 
 	provider, ok := cs.clients[name]
 	if !ok {
-		return nil, errors.New("invalid name for provider")
+		return nil, ErrUnknownProvider
 	}
 
 	return provider, nil
 }
+
+// HandleAuthorizationRequest redirects to the authorization of the provider
+// with a new state carrying opts, its callback is handled by GetCallbackResult.
+func (cs *ClientStore) HandleAuthorizationRequest(w http.ResponseWriter, r *http.Request, name string, opts AuthOptions) error {
+	provider, err := cs.GetProvider(name)
+	if err != nil {
+		return err
+	}
+
+	a, err := newAuthState(name, opts)
+	if err != nil {
+		return err
+	}
+
+	u, err := provider.AuthCodeURL(r.Context(), a)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.setState(w, a); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, u, http.StatusFound)
+	return nil
+}
+
+// GetCallbackResult verifies the state of the callback r from the provider and
+// returns its user with the options of the authorization, the state can't be
+// used again. The options are returned with the errors of a valid state too.
+func (cs *ClientStore) GetCallbackResult(w http.ResponseWriter, r *http.Request, name string) (*CallbackResult, AuthOptions, error) {
+	provider, err := cs.GetProvider(name)
+	if err != nil {
+		return nil, AuthOptions{}, err
+	}
+
+	a, err := cs.popState(w, r, name)
+	if err != nil {
+		return nil, AuthOptions{}, err
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		return nil, a.AuthOptions, fmt.Errorf("%w: %s", ErrAuthorizationDenied, e)
+	}
+
+	res, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), a)
+	return res, a.AuthOptions, err
+}
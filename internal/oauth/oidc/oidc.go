@@ -0,0 +1,215 @@
+package oidc
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/pmoieni/rmx/internal/oauth"
+	"golang.org/x/oauth2"
+)
+
+var (
+	defaultScopes = []string{"profile", "email"}
+
+	// a failed discovery is retried by the first request after retryInterval
+	retryInterval    = time.Second * 30
+	discoveryTimeout = time.Second * 10
+)
+
+// Claims are the names of the claims of the user in the ID tokens, the empty
+// ones are the standard claims (sub, email and email_verified).
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified string
+}
+
+type Config struct {
+	// Name of the provider in the auth endpoints.
+	Name string
+	// IssuerURL is where the provider is discovered, it must be the issuer of its ID tokens.
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes requested on top of openid, defaults to profile and email.
+	Scopes []string
+	Claims Claims
+}
+
+/*
+Provider signs in the users of an OpenID Connect issuer like Keycloak, Authentik
+or GitLab.
+
+The issuer is discovered by the first request, a failed discovery fails the
+requests until it's retried after retryInterval.
+*/
+type Provider struct {
+	cfg Config
+
+	mu       sync.Mutex
+	oidc     *gooidc.Provider
+	oauth2   *oauth2.Config
+	verifier *gooidc.IDTokenVerifier
+	err      error
+	failedAt time.Time
+}
+
+// New returns a Provider with the config, the issuer isn't discovered until it's used.
+func New(cfg Config) (*Provider, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("oidc: provider has no name")
+	}
+	if u, err := url.Parse(cfg.IssuerURL); err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("oidc: %s: invalid issuer URL %q", cfg.Name, cfg.IssuerURL)
+	}
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("oidc: %s: no client ID", cfg.Name)
+	}
+
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = defaultScopes
+	}
+	cfg.Claims.Subject = cmp.Or(cfg.Claims.Subject, "sub")
+	cfg.Claims.Email = cmp.Or(cfg.Claims.Email, "email")
+	cfg.Claims.EmailVerified = cmp.Or(cfg.Claims.EmailVerified, "email_verified")
+
+	return &Provider{cfg: cfg}, nil
+}
+
+func (p *Provider) Name() string { return p.cfg.Name }
+
+// discover fetches the configuration of the issuer once, the failures are kept
+// for retryInterval so an unreachable issuer isn't requested by every request.
+func (p *Provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oidc != nil {
+		return nil
+	}
+	if p.err != nil && time.Since(p.failedAt) < retryInterval {
+		return p.err
+	}
+
+	// the discovery isn't cancelled with the request, the others are waiting for it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryTimeout)
+	defer cancel()
+
+	provider, err := gooidc.NewProvider(ctx, p.cfg.IssuerURL)
+	if err != nil {
+		slog.Warn("oidc discovery failed", "provider", p.cfg.Name, "issuer", p.cfg.IssuerURL, "err", err)
+
+		p.err = fmt.Errorf("%w: %s discovery: %w", oauth.ErrProviderUnavailable, p.cfg.Name, err)
+		p.failedAt = time.Now()
+		return p.err
+	}
+
+	p.oidc = provider
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{gooidc.ScopeOpenID}, p.cfg.Scopes...),
+	}
+	p.verifier = provider.Verifier(&gooidc.Config{ClientID: p.cfg.ClientID})
+	p.err = nil
+
+	return nil
+}
+
+func (p *Provider) AuthCodeURL(ctx context.Context, a *oauth.AuthState) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+
+	return p.oauth2.AuthCodeURL(a.State, gooidc.Nonce(a.Nonce), oauth2.S256ChallengeOption(a.Verifier)), nil
+}
+
+func (p *Provider) Exchange(ctx context.Context, code string, a *oauth.AuthState) (*oauth.CallbackResult, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(a.Verifier))
+	if err != nil {
+		return nil, errors.New("authorization failed")
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token field in oauth2 token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID Token: %w", err)
+	}
+
+	if idToken.Nonce != a.Nonce {
+		return nil, errors.New("nonce didn't match")
+	}
+
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	// some issuers only put the email in the userinfo
+	if _, ok := claims[p.cfg.Claims.Email]; !ok && p.oidc.UserInfoEndpoint() != "" {
+		info, err := p.oidc.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err != nil {
+			return nil, err
+		}
+		if info.Subject != idToken.Subject {
+			return nil, errors.New("userinfo subject didn't match")
+		}
+
+		var infoClaims map[string]any
+		if err := info.Claims(&infoClaims); err != nil {
+			return nil, err
+		}
+		for k, v := range infoClaims {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+
+	subject, _ := claims[p.cfg.Claims.Subject].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("no %s claim in ID token", p.cfg.Claims.Subject)
+	}
+
+	email, _ := claims[p.cfg.Claims.Email].(string)
+
+	return &oauth.CallbackResult{
+		RawData:       claims,
+		Issuer:        idToken.Issuer,
+		UserID:        subject,
+		Email:         email,
+		EmailVerified: boolClaim(claims[p.cfg.Claims.EmailVerified]),
+	}, nil
+}
+
+// boolClaim returns the value of a boolean claim, some issuers send them as strings.
+func boolClaim(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+
+	return false
+}
@@ -0,0 +1,313 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/oauth"
+	"golang.org/x/oauth2"
+)
+
+const clientID = "rmx"
+
+// issuer is a stand-in OIDC issuer, its ID tokens have the nonce of the last
+// authorization and its claims. It only issues them to the verifier of the
+// PKCE challenge of the last authorization.
+type issuer struct {
+	*httptest.Server
+
+	key  *rsa.PrivateKey
+	down atomic.Bool
+
+	mu        sync.Mutex
+	nonce     string
+	challenge string
+	claims    map[string]any
+}
+
+func newIssuer(t *testing.T) *issuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss := &issuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if iss.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                iss.URL,
+			"authorization_endpoint":                iss.URL + "/auth",
+			"token_endpoint":                        iss.URL + "/token",
+			"jwks_uri":                              iss.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		iss.mu.Lock()
+		challenge := iss.challenge
+		iss.mu.Unlock()
+		if b64(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     iss.idToken(t),
+		})
+	})
+
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+
+	return iss
+}
+
+func b64(bs []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func (iss *issuer) idToken(t *testing.T) string {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	claims := map[string]any{
+		"iss":   iss.URL,
+		"aud":   clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": iss.nonce,
+	}
+	for k, v := range iss.claims {
+		claims[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func newProvider(t *testing.T, iss *issuer, claims Claims) (*Provider, *oauth.ClientStore) {
+	t.Helper()
+
+	p, err := New(Config{
+		Name:        "test",
+		IssuerURL:   iss.URL,
+		ClientID:    clientID,
+		RedirectURL: "http://localhost/users/auth/callback?provider=test",
+		Claims:      claims,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := oauth.NewClientStore([]byte("key"))
+	cs.AddProvider(p.Name(), p)
+
+	return p, cs
+}
+
+// authorize starts the authorization and returns the request of its callback.
+func authorize(t *testing.T, cs *oauth.ClientStore, iss *issuer) *http.Request {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := cs.HandleAuthorizationRequest(w, httptest.NewRequest("GET", "/users/auth/login?provider=test", nil), "test", oauth.AuthOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := loc.Query().Get("code_challenge_method"); m != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", m)
+	}
+
+	iss.mu.Lock()
+	iss.nonce = loc.Query().Get("nonce")
+	iss.challenge = loc.Query().Get("code_challenge")
+	iss.mu.Unlock()
+
+	r := httptest.NewRequest("GET", "/users/auth/callback?provider=test&code=code&state="+url.QueryEscape(loc.Query().Get("state")), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	return r
+}
+
+func TestDiscoveryRetry(t *testing.T) {
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = time.Millisecond * 100
+
+	iss := newIssuer(t)
+	iss.down.Store(true)
+
+	// the provider is created without the issuer
+	p, _ := newProvider(t, iss, Claims{})
+
+	authorize := func() error {
+		_, err := p.AuthCodeURL(context.Background(), &oauth.AuthState{State: "state"})
+		return err
+	}
+
+	if err := authorize(); !errors.Is(err, oauth.ErrProviderUnavailable) {
+		t.Fatalf("authorization with the issuer down = %v, want %v", err, oauth.ErrProviderUnavailable)
+	}
+
+	iss.down.Store(false)
+	if err := authorize(); !errors.Is(err, oauth.ErrProviderUnavailable) {
+		t.Fatalf("authorization before the retry = %v, want %v", err, oauth.ErrProviderUnavailable)
+	}
+
+	time.Sleep(retryInterval)
+	if err := authorize(); err != nil {
+		t.Fatalf("authorization after the retry: %v", err)
+	}
+}
+
+func TestCallbackResult(t *testing.T) {
+	tests := []struct {
+		name         string
+		claims       Claims
+		issued       map[string]any
+		wantEmail    string
+		wantVerified bool
+	}{
+		{
+			name:         "standard claims",
+			issued:       map[string]any{"sub": "alice", "email": "alice@example.com", "email_verified": true},
+			wantEmail:    "alice@example.com",
+			wantVerified: true,
+		},
+		{
+			name:         "verified as a string",
+			issued:       map[string]any{"sub": "alice", "email": "alice@example.com", "email_verified": "true"},
+			wantEmail:    "alice@example.com",
+			wantVerified: true,
+		},
+		{
+			name:      "unverified",
+			issued:    map[string]any{"sub": "alice", "email": "alice@example.com"},
+			wantEmail: "alice@example.com",
+		},
+		{
+			name:         "mapped claims",
+			claims:       Claims{Subject: "uid", Email: "mail", EmailVerified: "mail_verified"},
+			issued:       map[string]any{"sub": "other", "uid": "alice", "mail": "alice@example.com", "mail_verified": true},
+			wantEmail:    "alice@example.com",
+			wantVerified: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := newIssuer(t)
+			iss.claims = tt.issued
+			_, cs := newProvider(t, iss, tt.claims)
+
+			res, _, err := cs.GetCallbackResult(httptest.NewRecorder(), authorize(t, cs, iss), "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Issuer != iss.URL {
+				t.Errorf("Issuer = %q, want %q", res.Issuer, iss.URL)
+			}
+			if res.UserID != "alice" {
+				t.Errorf("UserID = %q, want %q", res.UserID, "alice")
+			}
+			if res.Email != tt.wantEmail {
+				t.Errorf("Email = %q, want %q", res.Email, tt.wantEmail)
+			}
+			if res.EmailVerified != tt.wantVerified {
+				t.Errorf("EmailVerified = %v, want %v", res.EmailVerified, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestExchangeVerifier(t *testing.T) {
+	iss := newIssuer(t)
+	iss.claims = map[string]any{"sub": "alice"}
+	p, cs := newProvider(t, iss, Claims{})
+
+	authorize(t, cs, iss)
+
+	iss.mu.Lock()
+	nonce := iss.nonce
+	iss.mu.Unlock()
+
+	if _, err := p.Exchange(context.Background(), "code", &oauth.AuthState{Nonce: nonce, Verifier: oauth2.GenerateVerifier()}); err == nil {
+		t.Error("exchange with another verifier succeeded")
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"no name", Config{IssuerURL: "https://issuer.example.com", ClientID: clientID}},
+		{"relative issuer", Config{Name: "test", IssuerURL: "issuer.example.com", ClientID: clientID}},
+		{"no client ID", Config{Name: "test", IssuerURL: "https://issuer.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); err == nil {
+				t.Error("New succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package oauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/lib"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// stateCookie holds the AuthState of an authorization until its callback,
+	// it has the default path which is the directory of the login endpoint.
+	stateCookie = "rmx_oauth"
+	stateExpiry = time.Minute * 10
+
+	stateLength uint = 16
+)
+
+var ErrInvalidState = errors.New("oauth: invalid state")
+
+// AuthOptions of an authorization are carried by its state to the callback.
+type AuthOptions struct {
+	// Link is the id of the user linking the provider to their account.
+	Link string `json:"l,omitempty"`
+	// ReturnTo is where the browser is sent back after the callback.
+	ReturnTo string `json:"r,omitempty"`
+}
+
+// AuthState is the one-time state of an authorization request, it's kept in
+// a cookie signed by the ClientStore until its callback.
+type AuthState struct {
+	AuthOptions
+
+	Provider string `json:"p"`
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	// Verifier is the PKCE code verifier, its S256 challenge is sent with the authorization request.
+	Verifier  string `json:"v"`
+	ExpiresAt int64  `json:"e"`
+}
+
+func newAuthState(provider string, opts AuthOptions) (*AuthState, error) {
+	state, err := lib.RandomString(stateLength)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := lib.RandomString(stateLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthState{
+		AuthOptions: opts,
+
+		Provider:  provider,
+		State:     state,
+		Nonce:     nonce,
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(stateExpiry).Unix(),
+	}, nil
+}
+
+func (cs *ClientStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, cs.stateKey)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (cs *ClientStore) setState(w http.ResponseWriter, a *AuthState) error {
+	bs, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(bs)
+	http.SetCookie(w, stateCookieOf(payload+"."+cs.sign(payload), int(stateExpiry.Seconds())))
+
+	return nil
+}
+
+/*
+popState returns the AuthState of the callback r to the provider, the cookie of
+the state is cleared even if it's invalid so it's only used once.
+
+It returns ErrInvalidState if the cookie is missing, tampered with or expired,
+or its state isn't the one in the query of r.
+*/
+func (cs *ClientStore) popState(w http.ResponseWriter, r *http.Request, provider string) (*AuthState, error) {
+	c, err := r.Cookie(stateCookie)
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+
+	http.SetCookie(w, stateCookieOf("", -1))
+
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(cs.sign(payload))) {
+		return nil, ErrInvalidState
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+
+	a := &AuthState{}
+	if err := json.Unmarshal(bs, a); err != nil {
+		return nil, ErrInvalidState
+	}
+
+	if a.Provider != provider || time.Now().Unix() > a.ExpiresAt {
+		return nil, ErrInvalidState
+	}
+
+	state := r.URL.Query().Get("state")
+	if state == "" || !hmac.Equal([]byte(state), []byte(a.State)) {
+		return nil, ErrInvalidState
+	}
+
+	return a, nil
+}
+
+func stateCookieOf(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     stateCookie,
+		Value:    value,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		// the callback is a redirect from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,174 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// provider is a stand-in Provider, its users are the authorization codes.
+type provider struct {
+	state *AuthState
+}
+
+func (p *provider) Name() string { return "test" }
+
+func (p *provider) AuthCodeURL(_ context.Context, a *AuthState) (string, error) {
+	return "https://provider.example.com/auth?" + url.Values{"state": {a.State}}.Encode(), nil
+}
+
+func (p *provider) Exchange(_ context.Context, code string, a *AuthState) (*CallbackResult, error) {
+	p.state = a
+	return &CallbackResult{Issuer: "test", UserID: code}, nil
+}
+
+func newClientStore() (*ClientStore, *provider) {
+	p := &provider{}
+	cs := NewClientStore([]byte("key"))
+	cs.AddProvider(p.Name(), p)
+
+	return cs, p
+}
+
+// authorize starts an authorization and returns its state and cookie.
+func authorize(t *testing.T, cs *ClientStore, opts AuthOptions) (string, *http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := cs.HandleAuthorizationRequest(w, httptest.NewRequest("GET", "/users/auth/login?provider=test", nil), "test", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookie {
+		t.Fatalf("authorization set the cookies %v, want %s", cookies, stateCookie)
+	}
+
+	return loc.Query().Get("state"), cookies[0]
+}
+
+func callback(state string, c *http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/users/auth/callback?provider=test&code=alice&state="+url.QueryEscape(state), nil)
+	if c != nil {
+		r.AddCookie(c)
+	}
+
+	return r
+}
+
+func TestCallbackState(t *testing.T) {
+	cs, p := newClientStore()
+	state, c := authorize(t, cs, AuthOptions{Link: "user"})
+
+	w := httptest.NewRecorder()
+	res, opts, err := cs.GetCallbackResult(w, callback(state, c), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UserID != "alice" {
+		t.Errorf("UserID = %q, want %q", res.UserID, "alice")
+	}
+	if opts.Link != "user" {
+		t.Errorf("Link = %q, want %q", opts.Link, "user")
+	}
+	if p.state.Verifier == "" || p.state.Nonce == "" {
+		t.Error("the state has no verifier or nonce")
+	}
+
+	cleared := w.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != stateCookie || cleared[0].MaxAge >= 0 {
+		t.Errorf("callback set the cookies %v, want %s cleared", cleared, stateCookie)
+	}
+}
+
+func TestCallbackInvalidState(t *testing.T) {
+	cs, _ := newClientStore()
+
+	expired := func() (string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		a := &AuthState{Provider: "test", State: "state", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+		if err := cs.setState(w, a); err != nil {
+			t.Fatal(err)
+		}
+
+		return a.State, w.Result().Cookies()[0]
+	}
+
+	otherKey := func() (string, *http.Cookie) {
+		other := NewClientStore([]byte("other"))
+		other.AddProvider("test", &provider{})
+		return authorize(t, other, AuthOptions{})
+	}
+
+	tests := []struct {
+		name    string
+		request func() (string, *http.Cookie)
+	}{
+		{"no cookie", func() (string, *http.Cookie) {
+			state, _ := authorize(t, cs, AuthOptions{})
+			return state, nil
+		}},
+		{"no state", func() (string, *http.Cookie) {
+			_, c := authorize(t, cs, AuthOptions{})
+			return "", c
+		}},
+		{"other state", func() (string, *http.Cookie) {
+			_, c := authorize(t, cs, AuthOptions{})
+			state, _ := authorize(t, cs, AuthOptions{})
+			return state, c
+		}},
+		{"tampered cookie", func() (string, *http.Cookie) {
+			state, c := authorize(t, cs, AuthOptions{})
+			c.Value = "x" + c.Value
+			return state, c
+		}},
+		{"signed by another key", otherKey},
+		{"expired", expired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, c := tt.request()
+
+			if _, _, err := cs.GetCallbackResult(httptest.NewRecorder(), callback(state, c), "test"); !errors.Is(err, ErrInvalidState) {
+				t.Errorf("GetCallbackResult = %v, want %v", err, ErrInvalidState)
+			}
+		})
+	}
+}
+
+func TestCallbackOtherProvider(t *testing.T) {
+	cs, p := newClientStore()
+	cs.AddProvider("other", p)
+
+	state, c := authorize(t, cs, AuthOptions{})
+
+	if _, _, err := cs.GetCallbackResult(httptest.NewRecorder(), callback(state, c), "other"); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("GetCallbackResult = %v, want %v", err, ErrInvalidState)
+	}
+}
+
+func TestCallbackDenied(t *testing.T) {
+	cs, _ := newClientStore()
+	state, c := authorize(t, cs, AuthOptions{ReturnTo: "https://rmx.example.com/jams"})
+
+	r := callback(state, c)
+	r.URL.RawQuery += "&error=access_denied"
+
+	_, opts, err := cs.GetCallbackResult(httptest.NewRecorder(), r, "test")
+	if !errors.Is(err, ErrAuthorizationDenied) {
+		t.Errorf("GetCallbackResult = %v, want %v", err, ErrAuthorizationDenied)
+	}
+	if opts.ReturnTo != "https://rmx.example.com/jams" {
+		t.Errorf("ReturnTo = %q, want the one of the authorization", opts.ReturnTo)
+	}
+}
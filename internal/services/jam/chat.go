@@ -0,0 +1,179 @@
+package jam
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/net/msg"
+	"github.com/pmoieni/rmx/internal/net/websocket2"
+	"github.com/pmoieni/rmx/internal/store/jam"
+)
+
+const (
+	defaultMessagesPage = 50
+	maxMessagesPage     = 200
+)
+
+var _ websocket.ChatStore = (*chatStore)(nil)
+
+// chatStore keeps the chat of a Jam in its repo.
+type chatStore struct {
+	repo  JamRepo
+	jamID uuid.UUID
+}
+
+func (cs *chatStore) LastMessages(ctx context.Context, n int) ([]msg.ChatMessage, error) {
+	messages, err := cs.repo.ListMessages(ctx, cs.jamID, uuid.NullUUID{}, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return chatMessages(messages), nil
+}
+
+func (cs *chatStore) SaveMessage(ctx context.Context, m *msg.ChatMessage) error {
+	id, err := uuid.Parse(m.ID)
+	if err != nil {
+		return err
+	}
+
+	return cs.repo.CreateMessage(ctx, &jam.MessageDTO{
+		ID:         id,
+		JamID:      cs.jamID,
+		AuthorID:   parseNullUUID(m.AuthorUserID),
+		AuthorConn: m.AuthorID,
+		AuthorName: m.AuthorName,
+		Text:       m.Text,
+		CreatedAt:  m.CreatedAt,
+	})
+}
+
+func (cs *chatStore) EditMessage(ctx context.Context, id string, author websocket.ChatAuthor, text string) (*msg.ChatMessage, error) {
+	messageID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, websocket.ErrChatMessageNotFound
+	}
+
+	m, err := cs.repo.EditMessage(ctx, cs.jamID, messageID, messageAuthor(author), text)
+	if err != nil {
+		if errors.Is(err, jam.ErrMessageNotFound) {
+			return nil, websocket.ErrChatMessageNotFound
+		}
+
+		return nil, err
+	}
+
+	cm := chatMessage(m)
+	return &cm, nil
+}
+
+func (cs *chatStore) DeleteMessage(ctx context.Context, id string, author websocket.ChatAuthor) error {
+	messageID, err := uuid.Parse(id)
+	if err != nil {
+		return websocket.ErrChatMessageNotFound
+	}
+
+	if err := cs.repo.DeleteMessage(ctx, cs.jamID, messageID, messageAuthor(author)); err != nil {
+		if errors.Is(err, jam.ErrMessageNotFound) {
+			return websocket.ErrChatMessageNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func messageAuthor(a websocket.ChatAuthor) jam.MessageAuthor {
+	return jam.MessageAuthor{ID: parseNullUUID(a.UserID), Conn: a.ConnID}
+}
+
+func chatMessage(m *jam.MessageDTO) msg.ChatMessage {
+	cm := msg.ChatMessage{
+		ID:         m.ID.String(),
+		AuthorID:   m.AuthorConn,
+		AuthorName: m.AuthorName,
+		Text:       m.Text,
+		CreatedAt:  m.CreatedAt.UTC(),
+	}
+	if m.AuthorID.Valid {
+		cm.AuthorUserID = m.AuthorID.UUID.String()
+	}
+	if m.EditedAt.Valid {
+		editedAt := m.EditedAt.Time.UTC()
+		cm.EditedAt = &editedAt
+	}
+
+	return cm
+}
+
+// chatMessages converts the messages returned newest first by the repo, oldest first.
+func chatMessages(messages []jam.MessageDTO) []msg.ChatMessage {
+	cms := make([]msg.ChatMessage, 0, len(messages))
+	for i := range messages {
+		cms = append(cms, chatMessage(&messages[i]))
+	}
+	slices.Reverse(cms)
+
+	return cms
+}
+
+// handleListMessages returns a page of the chat of the Jam, oldest first. The
+// next page has the messages sent before the first one, it's requested with
+// its id as the before query parameter. The banned users can't read the chat,
+// nor anyone but the owner while the Jam is locked.
+func handleListMessages(repo JamRepo) net.Handler {
+	type res struct {
+		Messages []msg.ChatMessage `json:"messages"`
+		// Next is the before parameter of the next page, empty on the last one.
+		Next string `json:"next,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		jamID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: "invalid jam id", Code: http.StatusBadRequest}
+		}
+
+		var before uuid.NullUUID
+		if s := r.URL.Query().Get("before"); s != "" {
+			if before.UUID, err = uuid.Parse(s); err != nil {
+				return net.HandlerError{Err: err, Msg: "invalid value for before", Code: http.StatusBadRequest}
+			}
+			before.Valid = true
+		}
+
+		limit := defaultMessagesPage
+		if s := r.URL.Query().Get("limit"); s != "" {
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit < 1 || limit > maxMessagesPage {
+				return net.HandlerError{Err: err, Msg: "invalid value for limit, limit should be in range 1-200", Code: http.StatusBadRequest}
+			}
+		}
+
+		j, err := repo.GetJam(r.Context(), jamID)
+		if err != nil {
+			return err
+		}
+		if err := checkAccess(r.Context(), repo, j); err != nil {
+			return err
+		}
+
+		messages, err := repo.ListMessages(r.Context(), j.ID, before, limit)
+		if err != nil {
+			return err
+		}
+
+		page := &res{Messages: chatMessages(messages)}
+		if len(page.Messages) == limit {
+			page.Next = page.Messages[0].ID
+		}
+
+		return net.WriteJSON(w, http.StatusOK, page)
+	}
+}
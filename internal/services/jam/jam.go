@@ -30,4 +30,20 @@ type JamRepo interface {
 	CreateJam(context.Context, *jam.JamParams) (*jam.JamDTO, error)
 	UpdateJam(context.Context, uuid.UUID, *jam.JamParams) (*jam.JamDTO, error)
 	DeleteJam(context.Context, uuid.UUID) error
+
+	BanUser(ctx context.Context, jamID, userID uuid.UUID, reason string, bannedBy uuid.NullUUID) error
+	IsBanned(ctx context.Context, jamID, userID uuid.UUID) (bool, error)
+	MuteUser(ctx context.Context, jamID, userID uuid.UUID, mutedBy uuid.NullUUID) error
+	UnmuteUser(ctx context.Context, jamID, userID uuid.UUID) error
+	IsMuted(ctx context.Context, jamID, userID uuid.UUID) (bool, error)
+	SetLocked(ctx context.Context, jamID uuid.UUID, locked bool) error
+	AddModerator(ctx context.Context, jamID, userID uuid.UUID) error
+	RemoveModerator(ctx context.Context, jamID, userID uuid.UUID) error
+	IsModerator(ctx context.Context, jamID, userID uuid.UUID) (bool, error)
+	LogModeration(context.Context, *jam.ModerationParams) error
+
+	CreateMessage(context.Context, *jam.MessageDTO) error
+	ListMessages(ctx context.Context, jamID uuid.UUID, before uuid.NullUUID, limit int) ([]jam.MessageDTO, error)
+	EditMessage(ctx context.Context, jamID, id uuid.UUID, author jam.MessageAuthor, text string) (*jam.MessageDTO, error)
+	DeleteMessage(ctx context.Context, jamID, id uuid.UUID, author jam.MessageAuthor) error
 }
@@ -0,0 +1,195 @@
+package jam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/net/msg"
+	"github.com/pmoieni/rmx/internal/net/websocket2"
+	"github.com/pmoieni/rmx/internal/store/jam"
+)
+
+// moderator persists the bans, the mutes and the lock of the Jam and writes every moderation to its audit trail.
+func moderator(repo JamRepo, jamID uuid.UUID) websocket.Moderator {
+	return func(ctx context.Context, p *msg.ModeratePayload) error {
+		actorID := parseNullUUID(p.ActorUserID)
+		targetID := parseNullUUID(p.TargetUserID)
+
+		switch p.Action {
+		case msg.ModerateBan:
+			if !targetID.Valid {
+				return websocket.ErrBanAnonymous
+			}
+
+			if err := repo.BanUser(ctx, jamID, targetID.UUID, p.Reason, actorID); err != nil {
+				return err
+			}
+		case msg.ModerateMute, msg.ModerateUnmute:
+			// anonymous members are only muted until they leave
+			if targetID.Valid {
+				var err error
+				if p.Action == msg.ModerateMute {
+					err = repo.MuteUser(ctx, jamID, targetID.UUID, actorID)
+				} else {
+					err = repo.UnmuteUser(ctx, jamID, targetID.UUID)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		case msg.ModerateLock, msg.ModerateUnlock:
+			if err := repo.SetLocked(ctx, jamID, p.Action == msg.ModerateLock); err != nil {
+				return err
+			}
+		}
+
+		return repo.LogModeration(ctx, &jam.ModerationParams{
+			JamID:        jamID,
+			Action:       p.Action,
+			ActorID:      actorID,
+			ActorName:    p.ActorName,
+			Target:       p.Target,
+			TargetUserID: targetID,
+			Reason:       p.Reason,
+		})
+	}
+}
+
+func parseNullUUID(s string) uuid.NullUUID {
+	id, err := uuid.Parse(s)
+	return uuid.NullUUID{UUID: id, Valid: err == nil}
+}
+
+// handleModerate applies action to the Jam in the path, the member is in the path
+// for the actions on a member. The body can have the reason of the moderation.
+// The owner and the moderators of the Jam can moderate it over HTTP as they do
+// over the socket.
+func handleModerate(repo JamRepo, hubs *websocket.HubStore, action string) net.Handler {
+	type req struct {
+		Reason string `json:"reason"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		parsed := &req{}
+		if err := json.NewDecoder(r.Body).Decode(parsed); err != nil && !errors.Is(err, io.EOF) {
+			return net.HandlerError{Err: err, Msg: "invalid request body", Code: http.StatusBadRequest}
+		}
+
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		jamID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: "invalid jam id", Code: http.StatusBadRequest}
+		}
+
+		j, err := repo.GetJam(r.Context(), jamID)
+		if err != nil {
+			return err
+		}
+
+		role, err := memberRole(r.Context(), repo, j, p.UserID)
+		if err != nil {
+			return err
+		}
+		if !role.Moderates() {
+			return net.HandlerError{Err: websocket.ErrNotModerator, Msg: websocket.ErrNotModerator.Error(), Code: http.StatusForbidden}
+		}
+
+		hub, err := getHub(hubs, j.ID.String(), hubOptions(repo, j))
+		if err != nil {
+			return err
+		}
+
+		err = hub.Moderate(r.Context(), role, &msg.ModeratePayload{
+			Action:      action,
+			Target:      r.PathValue("member"),
+			Reason:      parsed.Reason,
+			ActorUserID: p.UserID.String(),
+			ActorName:   p.Username,
+		})
+		switch {
+		case err == nil:
+		case errors.Is(err, websocket.ErrNotModerator):
+			return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusForbidden}
+		case errors.Is(err, websocket.ErrMemberNotFound):
+			return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusNotFound}
+		case errors.Is(err, websocket.ErrInvalidModeration), errors.Is(err, websocket.ErrBanAnonymous):
+			return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusBadRequest}
+		default:
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// memberRole returns the role of the signed in user in the Jam, the owner and
+// the moderators added by the owner moderate it, everyone else is an editor.
+func memberRole(ctx context.Context, repo JamRepo, j *jam.JamDTO, userID uuid.UUID) (websocket.Role, error) {
+	if userID == j.Owner.ID {
+		return websocket.RoleOwner, nil
+	}
+
+	moderator, err := repo.IsModerator(ctx, j.ID, userID)
+	if err != nil {
+		return "", err
+	}
+	if moderator {
+		return websocket.RoleModerator, nil
+	}
+
+	return websocket.RoleEditor, nil
+}
+
+// handleSetModerator adds the user in the path to the moderators of the Jam, or
+// removes them. Only the owner of the Jam can, it applies from the next
+// connection of the user.
+func handleSetModerator(repo JamRepo, moderator bool) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		jamID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: "invalid jam id", Code: http.StatusBadRequest}
+		}
+		userID, err := uuid.Parse(r.PathValue("user"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: "invalid user id", Code: http.StatusBadRequest}
+		}
+
+		j, err := repo.GetJam(r.Context(), jamID)
+		if err != nil {
+			return err
+		}
+		if p.UserID != j.Owner.ID {
+			return net.HandlerError{Err: websocket.ErrNotModerator, Msg: "only the owner can change the moderators", Code: http.StatusForbidden}
+		}
+		if userID == j.Owner.ID {
+			return net.HandlerError{Msg: "the owner already moderates the jam", Code: http.StatusBadRequest}
+		}
+
+		if moderator {
+			err = repo.AddModerator(r.Context(), j.ID, userID)
+		} else {
+			err = repo.RemoveModerator(r.Context(), j.ID, userID)
+		}
+		if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package jam
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/net/websocket2"
+	"github.com/pmoieni/rmx/internal/store/jam"
+)
+
+// ErrNotOwner is returned for the requests only the owner of the Jam can make.
+var ErrNotOwner = errors.New("only the owner of the jam can do this")
+
+const (
+	minReplaySpeed = 0.25
+	maxReplaySpeed = 8
+)
+
+func handleStartRecording(repo JamRepo, hubs *websocket.HubStore, dir string) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		j, err := ownedJam(r, repo)
+		if err != nil {
+			return err
+		}
+
+		hub, err := getHub(hubs, j.ID.String(), hubOptions(repo, j))
+		if err != nil {
+			return err
+		}
+
+		rec, err := hub.StartRecording(dir)
+		if err != nil {
+			if errors.Is(err, websocket.ErrRecording) {
+				return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusConflict}
+			}
+
+			return err
+		}
+
+		return net.WriteJSON(w, http.StatusCreated, rec)
+	}
+}
+
+func handleStopRecording(repo JamRepo, hubs *websocket.HubStore) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		j, err := ownedJam(r, repo)
+		if err != nil {
+			return err
+		}
+
+		hub, err := getHub(hubs, j.ID.String(), hubOptions(repo, j))
+		if err != nil {
+			return err
+		}
+
+		if err := hub.StopRecording(); err != nil {
+			if errors.Is(err, websocket.ErrNotRecording) {
+				return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusConflict}
+			}
+
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func handleListRecordings(repo JamRepo, dir string) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		j, err := ownedJam(r, repo)
+		if err != nil {
+			return err
+		}
+
+		recordings, err := websocket.ListRecordings(dir, j.ID.String())
+		if err != nil {
+			return err
+		}
+
+		return net.WriteJSON(w, http.StatusOK, recordings)
+	}
+}
+
+// handleReplay streams a recording into a read-only room, listeners of the same
+// recording at the same speed share the room.
+func handleReplay(repo JamRepo, hubs *websocket.HubStore, dir string) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		j, err := ownedJam(r, repo)
+		if err != nil {
+			return err
+		}
+
+		speed := 1.0
+		if s := r.URL.Query().Get("speed"); s != "" {
+			speed, err = strconv.ParseFloat(s, 64)
+			if err != nil || speed < minReplaySpeed || speed > maxReplaySpeed {
+				return net.HandlerError{Err: err, Msg: "invalid value for speed, speed should be in range 0.25-8", Code: http.StatusBadRequest}
+			}
+		}
+
+		name := r.PathValue("name")
+		path, err := websocket.RecordingPath(dir, j.ID.String(), name)
+		if err != nil {
+			if errors.Is(err, websocket.ErrRecordingNotFound) {
+				return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusNotFound}
+			}
+
+			return err
+		}
+
+		room := "replay:" + j.ID.String() + ":" + name + ":" + strconv.FormatFloat(speed, 'f', -1, 64)
+		hub, err := getHub(hubs, room, &websocket.HubOptions{
+			Local:  true,
+			Replay: &websocket.Replay{Path: path, Speed: speed},
+		})
+		if err != nil {
+			return err
+		}
+
+		hub.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+// ownedJam returns the Jam in the path, ErrNotOwner if the principal of r doesn't
+// own it. The recordings of a Jam and their replays are only for its owner.
+func ownedJam(r *http.Request, repo JamRepo) (*jam.JamDTO, error) {
+	p, ok := net.PrincipalFrom(r.Context())
+	if !ok {
+		return nil, net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+	}
+
+	jamID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return nil, net.HandlerError{Err: err, Msg: "invalid jam id", Code: http.StatusBadRequest}
+	}
+
+	j, err := repo.GetJam(r.Context(), jamID)
+	if err != nil {
+		return nil, err
+	}
+	if p.UserID != j.Owner.ID {
+		return nil, net.HandlerError{Err: ErrNotOwner, Msg: ErrNotOwner.Error(), Code: http.StatusForbidden}
+	}
+
+	return j, nil
+}
+
+func hubOptions(repo JamRepo, j *jam.JamDTO) *websocket.HubOptions {
+	return &websocket.HubOptions{
+		Capacity:     j.Capacity,
+		BPM:          j.BPM,
+		Locked:       j.Locked,
+		Moderator:    moderator(repo, j.ID),
+		Chat:         &chatStore{repo: repo, jamID: j.ID},
+		Approval:     j.Approval,
+		MaxListeners: maxListeners,
+	}
+}
@@ -1,32 +1,57 @@
 package jam
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pmoieni/rmx/internal/lib"
 	"github.com/pmoieni/rmx/internal/net"
-	"github.com/pmoieni/rmx/internal/net/websocket"
+	"github.com/pmoieni/rmx/internal/net/msg"
+	"github.com/pmoieni/rmx/internal/net/websocket2"
 	"github.com/pmoieni/rmx/internal/store/jam"
 )
 
-var _ net.Service = (*JamService)(nil)
+var (
+	_ net.Service = (*JamService)(nil)
+	_ net.Drainer = (*JamService)(nil)
+)
+
+const (
+	// listeners of a Jam over SSE, they don't count against its capacity
+	maxListeners = 500
+
+	jamCapacity = 10
+	// guests can own a single smaller Jam until they sign in
+	guestJamCapacity = 4
+	maxGuestJams     = 1
+	// connections of a guest to the Jams at once, on every instance
+	maxGuestConns = 2
+)
 
 type JamService struct {
 	*http.ServeMux
 
-	repo JamRepo
-	hub  *websocket.Hub
-	log  *lib.Logger
+	repo          JamRepo
+	hubs          *websocket.HubStore
+	recordingsDir string
+	auth          *net.Auth
+	log           *lib.Logger
 }
 
-func NewService(repo JamRepo) (*JamService, error) {
+func NewService(repo JamRepo, hubs *websocket.HubStore, recordingsDir string, auth *net.Auth) (*JamService, error) {
 	js := &JamService{
 		ServeMux: http.NewServeMux(),
 
-		repo: repo,
-		log:  lib.NewLogger("jam"),
+		repo:          repo,
+		hubs:          hubs,
+		recordingsDir: recordingsDir,
+		auth:          auth,
+		log:           lib.NewLogger("jam"),
 	}
 	js.setupControllers()
 
@@ -37,16 +62,36 @@ func (js *JamService) MountPath() string {
 	return "jam"
 }
 
+func (js *JamService) Drain(ctx context.Context, retry time.Duration) error {
+	return js.hubs.Drain(ctx, retry)
+}
+
 func (js *JamService) setupControllers() {
-	js.HandleFunc("POST /", handleCreateJam(js.repo).ServeHTTP)
+	js.HandleFunc("POST /", js.auth.RequireAuth(handleCreateJam(js.repo)).ServeHTTP)
 	js.HandleFunc("GET /", handleGetOrListJams().ServeHTTP)
-	js.HandleFunc("GET /ws", handleConn(js.hub).ServeHTTP)
+	js.HandleFunc("GET /ws", js.auth.OptionalAuth(handleConn(js.repo, js.hubs)).ServeHTTP)
+	js.HandleFunc("GET /{id}/mesh", js.auth.OptionalAuth(handleGetMesh(js.repo, js.hubs)).ServeHTTP)
+	js.HandleFunc("GET /{id}/events", js.auth.OptionalAuth(handleEvents(js.repo, js.hubs)).ServeHTTP)
+	js.HandleFunc("GET /{id}/messages", js.auth.OptionalAuth(handleListMessages(js.repo)).ServeHTTP)
+	js.HandleFunc("GET /{id}/recordings", js.auth.RequireAuth(handleListRecordings(js.repo, js.recordingsDir)).ServeHTTP)
+	js.HandleFunc("POST /{id}/recordings", js.auth.RequireAuth(handleStartRecording(js.repo, js.hubs, js.recordingsDir)).ServeHTTP)
+	js.HandleFunc("DELETE /{id}/recordings", js.auth.RequireAuth(handleStopRecording(js.repo, js.hubs)).ServeHTTP)
+	js.HandleFunc("GET /{id}/recordings/{name}/replay", js.auth.RequireAuth(handleReplay(js.repo, js.hubs, js.recordingsDir)).ServeHTTP)
+	js.HandleFunc("POST /{id}/members/{member}/kick", js.auth.RequireAuth(handleModerate(js.repo, js.hubs, msg.ModerateKick)).ServeHTTP)
+	js.HandleFunc("POST /{id}/members/{member}/ban", js.auth.RequireAuth(handleModerate(js.repo, js.hubs, msg.ModerateBan)).ServeHTTP)
+	js.HandleFunc("POST /{id}/members/{member}/mute", js.auth.RequireAuth(handleModerate(js.repo, js.hubs, msg.ModerateMute)).ServeHTTP)
+	js.HandleFunc("DELETE /{id}/members/{member}/mute", js.auth.RequireAuth(handleModerate(js.repo, js.hubs, msg.ModerateUnmute)).ServeHTTP)
+	js.HandleFunc("POST /{id}/lock", js.auth.RequireAuth(handleModerate(js.repo, js.hubs, msg.ModerateLock)).ServeHTTP)
+	js.HandleFunc("DELETE /{id}/lock", js.auth.RequireAuth(handleModerate(js.repo, js.hubs, msg.ModerateUnlock)).ServeHTTP)
+	js.HandleFunc("PUT /{id}/moderators/{user}", js.auth.RequireAuth(handleSetModerator(js.repo, true)).ServeHTTP)
+	js.HandleFunc("DELETE /{id}/moderators/{user}", js.auth.RequireAuth(handleSetModerator(js.repo, false)).ServeHTTP)
 }
 
 func handleCreateJam(repo JamRepo) net.Handler {
 	type req struct {
-		Name string `json:"name"`
-		BPM  uint   `json:"bpm"`
+		Name     string `json:"name"`
+		BPM      uint   `json:"bpm"`
+		Approval bool   `json:"approval"`
 	}
 
 	type res struct {
@@ -54,27 +99,40 @@ func handleCreateJam(repo JamRepo) net.Handler {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
 		dec := json.NewDecoder(r.Body)
 		dec.DisallowUnknownFields()
 		parsed := &req{}
 		if err := dec.Decode(&parsed); err != nil {
-			return err
+			return net.HandlerError{Err: err, Msg: "invalid request body", Code: http.StatusBadRequest}
 		}
 
-		createdJam, err := repo.CreateJam(r.Context(), &jam.JamParams{
+		params := &jam.JamParams{
 			Name:     parsed.Name,
-			Capacity: 10,
+			Capacity: jamCapacity,
 			BPM:      parsed.BPM,
-			// OwnerID: uuid.UUID, // NOTE: define middleware for guest users
-		})
+			Approval: parsed.Approval,
+			OwnerID:  p.UserID,
+		}
+		if p.Guest {
+			params.Capacity, params.MaxOwned = guestJamCapacity, maxGuestJams
+		}
+
+		createdJam, err := repo.CreateJam(r.Context(), params)
 		if err != nil {
+			if errors.Is(err, jam.ErrTooManyJams) {
+				return net.HandlerError{Err: err, Msg: "guests can only create one jam, sign in to create more", Code: http.StatusForbidden}
+			}
+
 			return err
 		}
 
-		bs, _ := json.MarshalIndent(createdJam, "", "	")
-
-		log.Printf("name: %s\n", string(bs))
-		return nil
+		w.Header().Set("Location", "/jam/"+createdJam.ID.String())
+		return net.WriteJSON(w, http.StatusCreated, &res{ID: createdJam.ID.String()})
 	}
 }
 
@@ -85,14 +143,174 @@ func handleGetOrListJams() net.Handler {
 }
 
 // handleConn gets the Jam info and establishes a websocket connection
-func handleConn(hub *websocket.Hub) net.Handler {
+func handleConn(repo JamRepo, hubs *websocket.HubStore) net.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		_, ok := r.URL.Query()["jamId"]
-		if !ok {
+		jamID, err := uuid.Parse(r.URL.Query().Get("jamId"))
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return nil
 		}
 
+		j, err := repo.GetJam(r.Context(), jamID)
+		if err != nil {
+			return err
+		}
+
+		// members of the same Jam share a room regardless of the instance they're connected to
+		hub, err := getHub(hubs, j.ID.String(), hubOptions(repo, j))
+		if err != nil {
+			return err
+		}
+
+		// latency of the member's audio setup in milliseconds
+		latency, _ := strconv.ParseUint(r.URL.Query().Get("latency"), 10, 16)
+
+		member := &websocket.Member{
+			Name:    r.URL.Query().Get("name"),
+			Role:    websocket.RoleEditor,
+			Latency: time.Duration(latency) * time.Millisecond,
+		}
+
+		// signed in members are known by their user, the others by the name they pick
+		if p, ok := net.PrincipalFrom(r.Context()); ok {
+			member.UserID = p.UserID.String()
+			member.Name = p.Username
+			if member.Role, err = memberRole(r.Context(), repo, j, p.UserID); err != nil {
+				return err
+			}
+			if member.Muted, err = repo.IsMuted(r.Context(), j.ID, p.UserID); err != nil {
+				return err
+			}
+			if p.Guest {
+				member.MaxConns = maxGuestConns
+			}
+		}
+		if member.Name == "" {
+			member.Name = "anonymous"
+		}
+
+		// spectators don't take a slot of the jam, they can ask to be promoted once one is free
+		if r.URL.Query().Get("spectate") == "true" {
+			member.Role = websocket.RoleSpectator
+		}
+
+		if err := checkBan(r.Context(), repo, j.ID, member.UserID); err != nil {
+			return err
+		}
+
+		hub.ServeHTTP(w, r.WithContext(websocket.WithMember(r.Context(), member)))
+		return nil
+	}
+}
+
+// getHub returns the Hub of room, see websocket.HubStore.GetOrCreate.
+func getHub(hubs *websocket.HubStore, room string, opts *websocket.HubOptions) (*websocket.Hub, error) {
+	hub, err := hubs.GetOrCreate(room, opts)
+	if errors.Is(err, websocket.ErrDraining) {
+		return nil, net.HandlerError{Err: err, Msg: "server restarting", Code: http.StatusServiceUnavailable}
+	}
+
+	return hub, err
+}
+
+// checkBan returns a HandlerError if the user is banned from the Jam. Bans are
+// kept by user, anonymous members can only be kicked.
+func checkBan(ctx context.Context, repo JamRepo, jamID uuid.UUID, userID string) error {
+	id, err := uuid.Parse(userID)
+	if err != nil {
+		return nil
+	}
+
+	banned, err := repo.IsBanned(ctx, jamID, id)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return net.HandlerError{Msg: "banned from this jam", Code: http.StatusForbidden}
+	}
+
+	return nil
+}
+
+// checkAccess returns a HandlerError if the user of ctx can't see the Jam,
+// the bans and the lock apply as they do to the members.
+func checkAccess(ctx context.Context, repo JamRepo, j *jam.JamDTO) error {
+	var userID string
+	p, ok := net.PrincipalFrom(ctx)
+	if ok {
+		userID = p.UserID.String()
+	}
+
+	if err := checkBan(ctx, repo, j.ID, userID); err != nil {
+		return err
+	}
+	if j.Locked && (!ok || p.UserID != j.Owner.ID) {
+		return net.HandlerError{Msg: "jam is locked", Code: http.StatusLocked}
+	}
+
+	return nil
+}
+
+// handleEvents streams the Jam's room as Server-Sent Events for the clients
+// that can't open a websocket, they can only listen. The bans and the lock
+// apply to them as they do to the members.
+func handleEvents(repo JamRepo, hubs *websocket.HubStore) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		jamID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: "invalid jam id", Code: http.StatusBadRequest}
+		}
+
+		j, err := repo.GetJam(r.Context(), jamID)
+		if err != nil {
+			return err
+		}
+
+		listener := &websocket.Member{Name: "anonymous", Role: websocket.RoleSpectator}
+		if p, ok := net.PrincipalFrom(r.Context()); ok {
+			listener.UserID, listener.Name = p.UserID.String(), p.Username
+			if p.UserID == j.Owner.ID {
+				listener.Role = websocket.RoleOwner
+			}
+		}
+
+		if err := checkBan(r.Context(), repo, j.ID, listener.UserID); err != nil {
+			return err
+		}
+
+		hub, err := getHub(hubs, j.ID.String(), hubOptions(repo, j))
+		if err != nil {
+			return err
+		}
+
+		hub.ServeSSE(w, r.WithContext(websocket.WithMember(r.Context(), listener)))
 		return nil
 	}
 }
+
+// handleGetMesh returns the WebRTC mesh topology of the Jam's room. It has the
+// connection ids of the members, the bans and the lock apply as they do to the
+// listeners of the room.
+func handleGetMesh(repo JamRepo, hubs *websocket.HubStore) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		jamID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: "invalid jam id", Code: http.StatusBadRequest}
+		}
+
+		j, err := repo.GetJam(r.Context(), jamID)
+		if err != nil {
+			return err
+		}
+		if err := checkAccess(r.Context(), repo, j); err != nil {
+			return err
+		}
+
+		hub, err := getHub(hubs, j.ID.String(), hubOptions(repo, j))
+		if err != nil {
+			return err
+		}
+
+		return net.WriteJSON(w, http.StatusOK, hub.Mesh())
+	}
+}
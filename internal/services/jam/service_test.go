@@ -1 +1,413 @@
 package jam_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	gonet "net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/net/backplane"
+	"github.com/pmoieni/rmx/internal/net/msg"
+	"github.com/pmoieni/rmx/internal/net/websocket2"
+	jamService "github.com/pmoieni/rmx/internal/services/jam"
+	"github.com/pmoieni/rmx/internal/store/jam"
+)
+
+// repo keeps the Jams in memory, the methods the tests don't need panic.
+type repo struct {
+	jamService.JamRepo
+
+	mu   sync.Mutex
+	jams map[uuid.UUID]*jam.JamDTO
+	// banned users and moderators by jam
+	bans, moderators map[uuid.UUID][]uuid.UUID
+}
+
+func newRepo() *repo {
+	return &repo{
+		jams:       make(map[uuid.UUID]*jam.JamDTO),
+		bans:       make(map[uuid.UUID][]uuid.UUID),
+		moderators: make(map[uuid.UUID][]uuid.UUID),
+	}
+}
+
+func (r *repo) addJam(owner uuid.UUID) *jam.JamDTO {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j := &jam.JamDTO{ID: uuid.New(), Name: "jam", Capacity: 5, BPM: 120}
+	j.Owner.ID = owner
+	r.jams[j.ID] = j
+
+	return j
+}
+
+func (r *repo) GetJam(_ context.Context, id uuid.UUID) (*jam.JamDTO, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.jams[id]
+	if !ok {
+		return nil, net.HandlerError{Msg: "jam not found", Code: http.StatusNotFound}
+	}
+
+	return j, nil
+}
+
+func (r *repo) ban(jamID, userID uuid.UUID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.bans[jamID] = append(r.bans[jamID], userID)
+}
+
+func (r *repo) IsBanned(_ context.Context, jamID, userID uuid.UUID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Contains(r.bans[jamID], userID), nil
+}
+
+func (r *repo) AddModerator(_ context.Context, jamID, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.moderators[jamID] = append(r.moderators[jamID], userID)
+	return nil
+}
+
+func (r *repo) IsModerator(_ context.Context, jamID, userID uuid.UUID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Contains(r.moderators[jamID], userID), nil
+}
+
+func (r *repo) IsMuted(context.Context, uuid.UUID, uuid.UUID) (bool, error) {
+	return false, nil
+}
+
+func (r *repo) LogModeration(context.Context, *jam.ModerationParams) error {
+	return nil
+}
+
+func (r *repo) ListMessages(context.Context, uuid.UUID, uuid.NullUUID, int) ([]jam.MessageDTO, error) {
+	return nil, nil
+}
+
+// newService returns the service with an Auth taking the id of the users as their token.
+func newService(t *testing.T, r jamService.JamRepo) http.Handler {
+	t.Helper()
+
+	auth := net.NewAuth(
+		func(token string) (uuid.UUID, error) { return uuid.Parse(token) },
+		func(_ context.Context, id uuid.UUID) (*net.Principal, error) {
+			return &net.Principal{UserID: id, Username: id.String()}, nil
+		},
+	)
+
+	hubs := websocket.NewHubStore(backplane.NewMemory(), &websocket.HubOptions{})
+	js, err := jamService.NewService(r, hubs, t.TempDir(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return js
+}
+
+func request(method, target string, user uuid.UUID) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if user != uuid.Nil {
+		r.Header.Set("Authorization", "Bearer "+user.String())
+	}
+
+	return r
+}
+
+func TestRecordingsOwner(t *testing.T) {
+	r := newRepo()
+	owner, other := uuid.New(), uuid.New()
+	j := r.addJam(owner)
+	js := newService(t, r)
+
+	routes := []struct{ method, path string }{
+		{"GET", "/" + j.ID.String() + "/recordings"},
+		{"POST", "/" + j.ID.String() + "/recordings"},
+		{"DELETE", "/" + j.ID.String() + "/recordings"},
+		{"GET", "/" + j.ID.String() + "/recordings/recording/replay"},
+	}
+	users := []struct {
+		name string
+		user uuid.UUID
+		want int
+	}{
+		{"anonymous", uuid.Nil, http.StatusUnauthorized},
+		{"other user", other, http.StatusForbidden},
+	}
+	for _, route := range routes {
+		for _, u := range users {
+			t.Run(route.method+" "+route.path+" "+u.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				js.ServeHTTP(w, request(route.method, route.path, u.user))
+
+				if w.Code != u.want {
+					t.Errorf("status = %d, want %d", w.Code, u.want)
+				}
+			})
+		}
+	}
+
+	w := httptest.NewRecorder()
+	js.ServeHTTP(w, request("GET", "/"+j.ID.String()+"/recordings", owner))
+	if w.Code != http.StatusOK {
+		t.Errorf("the owner listing the recordings got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestEventsBanned(t *testing.T) {
+	r := newRepo()
+	banned := uuid.New()
+	j := r.addJam(uuid.New())
+	r.ban(j.ID, banned)
+	js := newService(t, r)
+
+	w := httptest.NewRecorder()
+	js.ServeHTTP(w, request("GET", "/"+j.ID.String()+"/events", banned))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("banned listener got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestModerateAuth(t *testing.T) {
+	r := newRepo()
+	other := uuid.New()
+	j := r.addJam(uuid.New())
+	js := newService(t, r)
+
+	routes := []struct{ method, path string }{
+		{"POST", "/" + j.ID.String() + "/members/member/kick"},
+		{"POST", "/" + j.ID.String() + "/members/member/ban"},
+		{"POST", "/" + j.ID.String() + "/members/member/mute"},
+		{"DELETE", "/" + j.ID.String() + "/members/member/mute"},
+		{"POST", "/" + j.ID.String() + "/lock"},
+		{"DELETE", "/" + j.ID.String() + "/lock"},
+	}
+	users := []struct {
+		name string
+		user uuid.UUID
+		want int
+	}{
+		{"anonymous", uuid.Nil, http.StatusUnauthorized},
+		{"other user", other, http.StatusForbidden},
+	}
+	for _, route := range routes {
+		for _, u := range users {
+			t.Run(route.method+" "+route.path+" "+u.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				js.ServeHTTP(w, request(route.method, route.path, u.user))
+
+				if w.Code != u.want {
+					t.Errorf("status = %d, want %d", w.Code, u.want)
+				}
+			})
+		}
+	}
+}
+
+// dial connects user to the Jam over the socket, anonymously for uuid.Nil.
+func dial(t *testing.T, srv *httptest.Server, jamID, user uuid.UUID, name string) gonet.Conn {
+	t.Helper()
+
+	d := ws.Dialer{}
+	if user != uuid.Nil {
+		d.Header = ws.HandshakeHeaderHTTP(http.Header{"Authorization": {"Bearer " + user.String()}})
+	}
+
+	conn, br, _, err := d.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?jamId="+jamID.String()+"&name="+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if br != nil {
+		return &bufConn{conn, br}
+	}
+
+	return conn
+}
+
+// bufConn reads what the handshake buffered first.
+type bufConn struct {
+	gonet.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// snapshot returns the presence snapshot the connection gets once it joined.
+func snapshot(t *testing.T, conn gonet.Conn) *msg.PresencePayload {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		bs, err := wsutil.ReadServerBinary(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var env msg.Envelope
+		if err := env.UnmarshalBinary(bs); err != nil {
+			t.Fatal(err)
+		}
+		if env.Typ != msg.Presence {
+			continue
+		}
+
+		p := &msg.PresencePayload{}
+		if err := json.Unmarshal(env.Payload, p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Op == msg.PresenceOpSnapshot {
+			return p
+		}
+	}
+}
+
+func TestModerator(t *testing.T) {
+	r := newRepo()
+	owner, mod, other := uuid.New(), uuid.New(), uuid.New()
+	j := r.addJam(owner)
+	srv := httptest.NewServer(newService(t, r))
+	defer srv.Close()
+
+	do := func(method, path string, user uuid.UUID) int {
+		t.Helper()
+
+		req, err := http.NewRequest(method, srv.URL+"/"+j.ID.String()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+user.String())
+
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if code := do("PUT", "/moderators/"+mod.String(), other); code != http.StatusForbidden {
+		t.Errorf("other user adding a moderator got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("PUT", "/moderators/"+mod.String(), owner); code != http.StatusNoContent {
+		t.Fatalf("owner adding a moderator got %d, want %d", code, http.StatusNoContent)
+	}
+
+	bob := dial(t, srv, j.ID, uuid.Nil, "bob")
+	bobID := snapshot(t, bob).Members[0].ID
+
+	for _, m := range snapshot(t, dial(t, srv, j.ID, mod, "")).Members {
+		if m.UserID == mod.String() && websocket.Role(m.Role) != websocket.RoleModerator {
+			t.Errorf("the moderator joined as %s, want %s", m.Role, websocket.RoleModerator)
+		}
+	}
+
+	if code := do("POST", "/members/"+bobID+"/kick", other); code != http.StatusForbidden {
+		t.Errorf("other user kicking bob got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("POST", "/members/"+bobID+"/kick", mod); code != http.StatusNoContent {
+		t.Fatalf("moderator kicking bob got %d, want %d", code, http.StatusNoContent)
+	}
+
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, err := wsutil.ReadServerBinary(bob)
+
+		var closed wsutil.ClosedError
+		if errors.As(err, &closed) {
+			if closed.Code != ws.StatusPolicyViolation {
+				t.Errorf("bob was closed with %d, want %d", closed.Code, ws.StatusPolicyViolation)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("waiting for bob to be kicked: %v", err)
+		}
+	}
+}
+
+func TestMessagesAccess(t *testing.T) {
+	r := newRepo()
+	owner, banned := uuid.New(), uuid.New()
+	j, locked := r.addJam(owner), r.addJam(owner)
+	locked.Locked = true
+	r.ban(j.ID, banned)
+	js := newService(t, r)
+
+	tests := []struct {
+		name string
+		jam  uuid.UUID
+		user uuid.UUID
+		want int
+	}{
+		{"anonymous", j.ID, uuid.Nil, http.StatusOK},
+		{"unknown jam", uuid.New(), uuid.Nil, http.StatusNotFound},
+		{"banned", j.ID, banned, http.StatusForbidden},
+		{"locked", locked.ID, uuid.Nil, http.StatusLocked},
+		{"owner of the locked jam", locked.ID, owner, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			js.ServeHTTP(w, request("GET", "/"+tt.jam.String()+"/messages", tt.user))
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeshAccess(t *testing.T) {
+	r := newRepo()
+	owner, banned := uuid.New(), uuid.New()
+	j, locked := r.addJam(owner), r.addJam(owner)
+	locked.Locked = true
+	r.ban(j.ID, banned)
+	js := newService(t, r)
+
+	tests := []struct {
+		name string
+		jam  uuid.UUID
+		user uuid.UUID
+		want int
+	}{
+		{"anonymous", j.ID, uuid.Nil, http.StatusOK},
+		{"banned", j.ID, banned, http.StatusForbidden},
+		{"locked", locked.ID, uuid.Nil, http.StatusLocked},
+		{"owner of the locked jam", locked.ID, owner, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			js.ServeHTTP(w, request("GET", "/"+tt.jam.String()+"/mesh", tt.user))
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/services/user/internal/token"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+// NewAuth authenticates the requests with the access tokens issued by the service.
+func NewAuth(userRepo UserRepo, tokenRepo TokenRepo, keyring *Keyring) *net.Auth {
+	return net.NewAuth(func(s string) (uuid.UUID, error) {
+		return verifyAccessToken(keyring, tokenRepo, s)
+	}, func(ctx context.Context, userID uuid.UUID) (*net.Principal, error) {
+		u, err := userRepo.GetUserByID(ctx, userID)
+		if err != nil {
+			if errors.Is(err, userStore.ErrUserNotFound) {
+				return nil, net.ErrUnauthenticated
+			}
+
+			return nil, err
+		}
+
+		return &net.Principal{UserID: u.ID, Username: u.Username, Email: u.Email, Guest: u.Guest}, nil
+	})
+}
+
+func verifyAccessToken(keyring *Keyring, tokenRepo TokenRepo, s string) (uuid.UUID, error) {
+	claims, err := keyring.Parse(s, token.Access)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	revoked, err := tokenRepo.IsRevoked(claims.ID, claims.UserID, claims.IssuedAt)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if revoked {
+		return uuid.Nil, userStore.ErrTokenRevoked
+	}
+
+	return uuid.Parse(claims.UserID)
+}
+
+func handleUserInfo() net.Handler {
+	type res struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Email    string `json:"email,omitempty"`
+		Guest    bool   `json:"guest"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		return net.WriteJSON(w, http.StatusOK, &res{
+			ID:       p.UserID.String(),
+			Username: p.Username,
+			Email:    p.Email,
+			Guest:    p.Guest,
+		})
+	}
+}
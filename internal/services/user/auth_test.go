@@ -0,0 +1,206 @@
+package user_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/services/user"
+	"github.com/pmoieni/rmx/internal/services/user/internal/token"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+// users finds the users it was given, the methods the tests don't need panic.
+type users struct {
+	user.UserRepo
+
+	byID map[uuid.UUID]*userStore.UserDTO
+}
+
+func (u *users) GetUserByID(_ context.Context, id uuid.UUID) (*userStore.UserDTO, error) {
+	if dto, ok := u.byID[id]; ok {
+		return dto, nil
+	}
+
+	return nil, userStore.ErrUserNotFound
+}
+
+// tokens keeps the revoked token ids and how long they're revoked for.
+type tokens struct {
+	user.TokenRepo
+
+	mu      sync.Mutex
+	revoked map[string]time.Duration
+}
+
+func (t *tokens) Revoke(id string, exp time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.revoked[id] = exp
+	return nil
+}
+
+func (t *tokens) IsRevoked(id, _ string, _ time.Time) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.revoked[id]
+	return ok, nil
+}
+
+func newKeyring(t *testing.T) *user.Keyring {
+	t.Helper()
+
+	k, err := token.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kr, err := user.NewKeyring("", k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kr
+}
+
+func newToken(t *testing.T, kr *user.Keyring, c *token.Claims, exp time.Duration) string {
+	t.Helper()
+
+	s, err := kr.New(c, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestAuth(t *testing.T) {
+	kr, other := newKeyring(t), newKeyring(t)
+
+	alice := &userStore.UserDTO{ID: uuid.New(), Username: "alice", Email: "alice@rmx.example.com"}
+	gone := uuid.New()
+	tokenRepo := &tokens{revoked: map[string]time.Duration{"revoked": time.Minute}}
+	auth := user.NewAuth(&users{byID: map[uuid.UUID]*userStore.UserDTO{alice.ID: alice}}, tokenRepo, kr)
+
+	access := func(userID uuid.UUID) *token.Claims {
+		return &token.Claims{Type: token.Access, UserID: userID.String()}
+	}
+	valid := newToken(t, kr, access(alice.ID), time.Minute)
+
+	tests := []struct {
+		name string
+		// header is the Authorization header, cookie the AccessTokenCookie
+		header, cookie string
+		want           int
+	}{
+		{"missing", "", "", http.StatusUnauthorized},
+		{"malformed", "Bearer v4.public.garbage", "", http.StatusUnauthorized},
+		{"not a bearer", "Basic " + valid, "", http.StatusUnauthorized},
+		{"expired", "Bearer " + newToken(t, kr, access(alice.ID), -time.Minute), "", http.StatusUnauthorized},
+		{"revoked", "Bearer " + newToken(t, kr, &token.Claims{Type: token.Access, UserID: alice.ID.String(), ID: "revoked"}, time.Minute), "", http.StatusUnauthorized},
+		{"wrong kid", "Bearer " + newToken(t, other, access(alice.ID), time.Minute), "", http.StatusUnauthorized},
+		{"refresh token", "Bearer " + newToken(t, kr, &token.Claims{Type: token.Refresh, UserID: alice.ID.String(), Family: "family"}, time.Minute), "", http.StatusUnauthorized},
+		{"deleted user", "Bearer " + newToken(t, kr, access(gone), time.Minute), "", http.StatusUnauthorized},
+		{"valid", "Bearer " + valid, "", http.StatusOK},
+		{"valid cookie", "", valid, http.StatusOK},
+	}
+
+	// the principal found by the handler, nil if there's none
+	serve := func(mw func(http.Handler) net.Handler, header, cookie string) (*httptest.ResponseRecorder, *net.Principal) {
+		var got *net.Principal
+		h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = net.PrincipalFrom(r.Context())
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: net.AccessTokenCookie, Value: cookie})
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w, got
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, p := serve(auth.RequireAuth, tt.header, tt.cookie)
+			if w.Code != tt.want {
+				t.Errorf("RequireAuth status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("RequireAuth didn't ask for a Bearer token")
+			}
+			if tt.want == http.StatusOK && (p == nil || p.UserID != alice.ID || p.Username != alice.Username) {
+				t.Errorf("RequireAuth principal = %+v, want alice", p)
+			}
+
+			// the requests that aren't authenticated are served anonymously
+			w, p = serve(auth.OptionalAuth, tt.header, tt.cookie)
+			if w.Code != http.StatusOK {
+				t.Errorf("OptionalAuth status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if authenticated := tt.want == http.StatusOK; (p != nil) != authenticated {
+				t.Errorf("OptionalAuth principal = %+v, want one %v", p, authenticated)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	kr := newKeyring(t)
+	alice := &userStore.UserDTO{ID: uuid.New(), Username: "alice"}
+	userRepo := &users{byID: map[uuid.UUID]*userStore.UserDTO{alice.ID: alice}}
+	tokenRepo := &tokens{revoked: make(map[string]time.Duration)}
+	auth := user.NewAuth(userRepo, tokenRepo, kr)
+
+	frontend := newFrontend(t)
+	us, err := user.NewService(userRepo, nil, tokenRepo, nil, kr, auth, frontend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// longer than the access tokens issued by the service
+	lifetime := time.Hour
+
+	for name, authenticate := range map[string]func(r *http.Request, at string){
+		"cookie": func(r *http.Request, at string) { r.AddCookie(&http.Cookie{Name: net.AccessTokenCookie, Value: at}) },
+		"bearer": func(r *http.Request, at string) { r.Header.Set("Authorization", "Bearer "+at) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			claims := &token.Claims{Type: token.Access, UserID: alice.ID.String()}
+			at := newToken(t, kr, claims, lifetime)
+
+			r := httptest.NewRequest("POST", "/auth/logout", nil)
+			authenticate(r, at)
+			w := httptest.NewRecorder()
+			us.ServeHTTP(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("logout status = %d, want %d", w.Code, http.StatusNoContent)
+			}
+
+			// revoked for the rest of its lifetime, not a fixed expiry
+			if exp, ok := tokenRepo.revoked[claims.ID]; !ok || exp < lifetime-time.Minute || exp > lifetime {
+				t.Errorf("the access token was revoked for %v (%v), want about %v", exp, ok, lifetime)
+			}
+
+			r = httptest.NewRequest("GET", "/me", nil)
+			r.Header.Set("Authorization", "Bearer "+at)
+			w = httptest.NewRecorder()
+			us.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("the access token is still valid after logout, got %d", w.Code)
+			}
+		})
+	}
+}
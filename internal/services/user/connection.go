@@ -0,0 +1,258 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucasepe/codename"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/oauth"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+// ErrAccountConflict is returned when the account of a provider is linked to
+// another user and the users can't be merged.
+var ErrAccountConflict = errors.New("the account is linked to another user")
+
+// connectionID identifies the account of a provider user, subjects are only
+// unique to their issuer.
+func connectionID(res *oauth.CallbackResult) string {
+	return res.Issuer + ":" + res.UserID
+}
+
+/*
+findOrCreateUser returns the user of the connection in res, the connection is
+created if there's none.
+
+  - Guests signing in to an existing user are merged into it, guests without
+    one are upgraded to a user with the connection. Either way they keep
+    their jams and memberships.
+  - Otherwise a new user is created.
+
+A verified email of an existing user isn't enough to sign in to it, any issuer
+can claim one. ErrAccountConflict is returned instead, the user signs in to the
+existing account and links the connection from there, see linkConnection.
+*/
+func findOrCreateUser(
+	ctx context.Context,
+	userRepo UserRepo,
+	connectionRepo ConnectionRepo,
+	tokenRepo TokenRepo,
+	pName string,
+	res *oauth.CallbackResult,
+) (*userStore.UserDTO, error) {
+	conn, err := connectionRepo.GetConnectionByConnectionID(ctx, connectionID(res))
+	switch {
+	case err == nil:
+		user, err := userRepo.GetUserByID(ctx, conn.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		// guests signing in to an existing account bring their jams and memberships
+		if p, ok := net.PrincipalFrom(ctx); ok && p.Guest && p.UserID != user.ID {
+			if err := mergeUsers(ctx, userRepo, tokenRepo, user.ID, p.UserID); err != nil {
+				return nil, err
+			}
+		}
+
+		return user, nil
+	case !errors.Is(err, userStore.ErrConnectionNotFound):
+		return nil, err
+	}
+
+	if res.EmailVerified {
+		_, err := userRepo.GetVerifiedUserByEmail(ctx, res.Email)
+		switch {
+		case err == nil:
+			return nil, fmt.Errorf("%w: sign in to the user with the email to link the account", ErrAccountConflict)
+		case !errors.Is(err, userStore.ErrUserNotFound):
+			return nil, err
+		}
+	}
+
+	var user *userStore.UserDTO
+	if p, ok := net.PrincipalFrom(ctx); ok && p.Guest {
+		if user, err = userRepo.UpgradeGuest(ctx, p.UserID, res.Email, res.EmailVerified); err != nil {
+			return nil, err
+		}
+	} else {
+		if user, err = userRepo.CreateUser(ctx, &userStore.UserParams{
+			Username:      codename.Generate(codenameRNG, 4),
+			Email:         res.Email,
+			EmailVerified: res.EmailVerified,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := connectionRepo.CreateConnection(ctx, &userStore.ConnectionParams{
+		ID:       connectionID(res),
+		UserID:   user.ID,
+		Provider: pName,
+	}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+/*
+linkConnection links the connection in res to the user with the id.
+
+If it's linked to another user, that user is merged into this one when both
+share the same verified email, ErrAccountConflict is returned otherwise.
+*/
+func linkConnection(
+	ctx context.Context,
+	userRepo UserRepo,
+	connectionRepo ConnectionRepo,
+	tokenRepo TokenRepo,
+	id uuid.UUID,
+	pName string,
+	res *oauth.CallbackResult,
+) error {
+	conn, err := connectionRepo.GetConnectionByConnectionID(ctx, connectionID(res))
+	switch {
+	case err == nil:
+	case errors.Is(err, userStore.ErrConnectionNotFound):
+		_, err := connectionRepo.CreateConnection(ctx, &userStore.ConnectionParams{
+			ID:       connectionID(res),
+			UserID:   id,
+			Provider: pName,
+		})
+		return err
+	default:
+		return err
+	}
+
+	if conn.UserID == id {
+		return nil
+	}
+
+	user, err := userRepo.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	other, err := userRepo.GetUserByID(ctx, conn.UserID)
+	if err != nil {
+		return err
+	}
+
+	if !user.EmailVerified || !other.EmailVerified || !strings.EqualFold(user.Email, other.Email) {
+		return ErrAccountConflict
+	}
+
+	return mergeUsers(ctx, userRepo, tokenRepo, id, other.ID)
+}
+
+// mergeUsers merges the user from into the user into and signs from out.
+func mergeUsers(ctx context.Context, userRepo UserRepo, tokenRepo TokenRepo, into, from uuid.UUID) error {
+	if err := userRepo.MergeUsers(ctx, into, from); err != nil {
+		return err
+	}
+
+	return tokenRepo.RevokeAllForUser(from.String(), refreshTokenExpiry)
+}
+
+// handleLink starts the authorization of a provider to link to the user, its
+// callback links the account instead of signing in.
+func handleLink(ocs *oauth.ClientStore, frontend *Frontend) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+		if p.Guest {
+			return net.HandlerError{Err: errors.New("guests can't link accounts"), Msg: "guests sign in instead of linking accounts", Code: http.StatusForbidden}
+		}
+
+		returnTo, err := frontend.ReturnTo(r.URL.Query().Get("return_to"))
+		if err != nil {
+			return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusBadRequest}
+		}
+
+		return oauthError(ocs.HandleAuthorizationRequest(w, r, getProvider(r), oauth.AuthOptions{
+			Link:     p.UserID.String(),
+			ReturnTo: returnTo,
+		}))
+	}
+}
+
+// linkingUser returns the id of the user linking a provider with the callback
+// r, if any. The link fails if the user signed out since.
+func linkingUser(r *http.Request, opts oauth.AuthOptions) (uuid.UUID, bool, error) {
+	if opts.Link == "" {
+		return uuid.Nil, false, nil
+	}
+
+	// the link is only for the user who started it
+	p, ok := net.PrincipalFrom(r.Context())
+	if !ok || p.Guest || opts.Link != p.UserID.String() {
+		return uuid.Nil, false, net.ErrUnauthenticated
+	}
+
+	return p.UserID, true, nil
+}
+
+// handleListConnections returns the providers linked to the user.
+func handleListConnections(connectionRepo ConnectionRepo) net.Handler {
+	type connection struct {
+		ID        string    `json:"id"`
+		Provider  string    `json:"provider"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	type res struct {
+		Connections []connection `json:"connections"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		conns, err := connectionRepo.GetConnectionsByUserID(r.Context(), p.UserID)
+		if err != nil {
+			return err
+		}
+
+		body := &res{Connections: make([]connection, 0, len(conns))}
+		for _, c := range conns {
+			body.Connections = append(body.Connections, connection{ID: c.ID, Provider: c.Provider, CreatedAt: c.CreatedAt})
+		}
+
+		return net.WriteJSON(w, http.StatusOK, body)
+	}
+}
+
+// handleUnlink unlinks a provider from the user, users keep at least one.
+func handleUnlink(connectionRepo ConnectionRepo) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		if err := connectionRepo.UnlinkProvider(r.Context(), p.UserID, r.PathValue("provider")); err != nil {
+			switch {
+			case errors.Is(err, userStore.ErrConnectionNotFound):
+				return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusNotFound}
+			case errors.Is(err, userStore.ErrLastConnection):
+				return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusConflict}
+			}
+
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -0,0 +1,201 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/oauth"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+// accounts keeps the users and their connections in memory, the methods the
+// tests don't need panic.
+type accounts struct {
+	UserRepo
+	ConnectionRepo
+	TokenRepo
+
+	mu    sync.Mutex
+	users map[uuid.UUID]*userStore.UserDTO
+	// connections by connection id
+	conns map[string]uuid.UUID
+	// merges made, into then from
+	merges [][2]uuid.UUID
+}
+
+func newAccounts(users ...*userStore.UserDTO) *accounts {
+	a := &accounts{users: make(map[uuid.UUID]*userStore.UserDTO), conns: make(map[string]uuid.UUID)}
+	for _, u := range users {
+		a.users[u.ID] = u
+	}
+
+	return a
+}
+
+func (a *accounts) GetUserByID(_ context.Context, id uuid.UUID) (*userStore.UserDTO, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if u, ok := a.users[id]; ok {
+		return u, nil
+	}
+
+	return nil, userStore.ErrUserNotFound
+}
+
+func (a *accounts) GetVerifiedUserByEmail(_ context.Context, email string) (*userStore.UserDTO, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, u := range a.users {
+		if u.EmailVerified && strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+
+	return nil, userStore.ErrUserNotFound
+}
+
+func (a *accounts) CreateUser(_ context.Context, p *userStore.UserParams) (*userStore.UserDTO, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := &userStore.UserDTO{ID: uuid.New(), Username: p.Username, Email: p.Email, EmailVerified: p.EmailVerified}
+	a.users[u.ID] = u
+
+	return u, nil
+}
+
+func (a *accounts) UpgradeGuest(_ context.Context, id uuid.UUID, email string, emailVerified bool) (*userStore.UserDTO, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u, ok := a.users[id]
+	if !ok {
+		return nil, userStore.ErrUserNotFound
+	}
+	u.Email, u.EmailVerified = email, emailVerified
+
+	return u, nil
+}
+
+func (a *accounts) MergeUsers(_ context.Context, into, from uuid.UUID) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.merges = append(a.merges, [2]uuid.UUID{into, from})
+	delete(a.users, from)
+
+	return nil
+}
+
+func (a *accounts) GetConnectionByConnectionID(_ context.Context, id string) (*userStore.ConnectionDTO, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if userID, ok := a.conns[id]; ok {
+		return &userStore.ConnectionDTO{ID: id, UserID: userID}, nil
+	}
+
+	return nil, userStore.ErrConnectionNotFound
+}
+
+func (a *accounts) CreateConnection(_ context.Context, p *userStore.ConnectionParams) (*userStore.ConnectionDTO, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.conns[p.ID]; ok {
+		return nil, userStore.ErrConnectionExists
+	}
+	a.conns[p.ID] = p.UserID
+
+	return &userStore.ConnectionDTO{ID: p.ID, UserID: p.UserID, Provider: p.Provider}, nil
+}
+
+func (a *accounts) RevokeAllForUser(string, time.Duration) error {
+	return nil
+}
+
+func TestFindOrCreateUserVerifiedEmail(t *testing.T) {
+	alice := &userStore.UserDTO{ID: uuid.New(), Username: "alice", Email: "alice@rmx.example.com", EmailVerified: true}
+	guest := &userStore.UserDTO{ID: uuid.New(), Username: "guest"}
+	a := newAccounts(alice, guest)
+
+	// another issuer claiming the email of alice
+	res := &oauth.CallbackResult{Issuer: "https://issuer.example.com", UserID: "subject", Email: "Alice@rmx.example.com", EmailVerified: true}
+
+	ctxs := map[string]context.Context{
+		"anonymous": context.Background(),
+		"guest":     net.WithPrincipal(context.Background(), &net.Principal{UserID: guest.ID, Guest: true}),
+	}
+	for name, ctx := range ctxs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := findOrCreateUser(ctx, a, a, a, "oidc", res); !errors.Is(err, ErrAccountConflict) {
+				t.Errorf("signing in with the email of alice got %v, want %v", err, ErrAccountConflict)
+			}
+		})
+	}
+
+	if len(a.conns) != 0 || len(a.merges) != 0 {
+		t.Errorf("the sign in linked %v and merged %v, want neither", a.conns, a.merges)
+	}
+
+	// alice links the account once signed in
+	if err := linkConnection(context.Background(), a, a, a, alice.ID, "oidc", res); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := findOrCreateUser(context.Background(), a, a, a, "oidc", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != alice.ID {
+		t.Errorf("signed in as %s once linked, want alice", user.Username)
+	}
+}
+
+func TestFindOrCreateUserGuest(t *testing.T) {
+	alice := &userStore.UserDTO{ID: uuid.New(), Username: "alice"}
+	guest := &userStore.UserDTO{ID: uuid.New(), Username: "guest"}
+	newcomer := &userStore.UserDTO{ID: uuid.New(), Username: "newcomer"}
+	a := newAccounts(alice, guest, newcomer)
+
+	res := &oauth.CallbackResult{Issuer: "https://issuer.example.com", UserID: "alice", Email: "alice@rmx.example.com"}
+	a.conns[connectionID(res)] = alice.ID
+
+	t.Run("existing user", func(t *testing.T) {
+		ctx := net.WithPrincipal(context.Background(), &net.Principal{UserID: guest.ID, Guest: true})
+		user, err := findOrCreateUser(ctx, a, a, a, "oidc", res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.ID != alice.ID {
+			t.Errorf("the guest signed in as %s, want alice", user.Username)
+		}
+		if len(a.merges) != 1 || a.merges[0] != [2]uuid.UUID{alice.ID, guest.ID} {
+			t.Errorf("merges = %v, want the guest merged into alice", a.merges)
+		}
+	})
+
+	t.Run("new user", func(t *testing.T) {
+		ctx := net.WithPrincipal(context.Background(), &net.Principal{UserID: newcomer.ID, Guest: true})
+		res := &oauth.CallbackResult{Issuer: "https://issuer.example.com", UserID: "newcomer", Email: "newcomer@rmx.example.com"}
+
+		user, err := findOrCreateUser(ctx, a, a, a, "oidc", res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// upgraded in place
+		if user.ID != newcomer.ID || user.Email != res.Email {
+			t.Errorf("the guest signed in as %+v, want them upgraded", user)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var errInvalidReturnTo = errors.New("return_to isn't a frontend URL")
+
+// the reasons of the failed sign ins sent to the error page of the frontend
+const (
+	reasonInvalidState        = "invalid_state"
+	reasonAccessDenied        = "access_denied"
+	reasonProviderUnavailable = "provider_unavailable"
+	reasonInvalidProvider     = "invalid_provider"
+	reasonAccountConflict     = "account_conflict"
+	reasonUnauthenticated     = "unauthenticated"
+	reasonServerError         = "server_error"
+)
+
+/*
+Frontend is where the browsers are sent back after signing in, to the return_to
+of the sign in or to the error page with the reason of the failure.
+
+Only the URLs of its origins are valid return_to, the paths are relative to
+the first one.
+*/
+type Frontend struct {
+	origins   []*url.URL
+	errorPath string
+}
+
+func NewFrontend(origins []string, errorPath string) (*Frontend, error) {
+	if len(origins) == 0 {
+		return nil, errors.New("user: no frontend origins")
+	}
+	if !strings.HasPrefix(errorPath, "/") {
+		return nil, fmt.Errorf("user: invalid frontend error path %q", errorPath)
+	}
+
+	f := &Frontend{errorPath: errorPath}
+	for _, o := range origins {
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("user: invalid frontend origin %q", o)
+		}
+
+		f.origins = append(f.origins, &url.URL{Scheme: u.Scheme, Host: strings.ToLower(u.Host)})
+	}
+
+	return f, nil
+}
+
+// ReturnTo validates the return_to of a sign in, the empty one is the first origin.
+func (f *Frontend) ReturnTo(s string) (string, error) {
+	if s == "" {
+		return f.origins[0].String() + "/", nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", errInvalidReturnTo
+	}
+
+	// paths, the scheme relative URLs (//host/path) have a host
+	if !u.IsAbs() && u.Host == "" && strings.HasPrefix(u.Path, "/") {
+		return f.origins[0].ResolveReference(u).String(), nil
+	}
+
+	if u.User != nil || f.origin(u) == nil {
+		return "", errInvalidReturnTo
+	}
+
+	return u.String(), nil
+}
+
+// Error returns the URL of the error page with the reason, on the origin of
+// returnTo if it's valid.
+func (f *Frontend) Error(returnTo, reason string) string {
+	origin := f.origins[0]
+	if u, err := url.Parse(returnTo); err == nil {
+		if o := f.origin(u); o != nil {
+			origin = o
+		}
+	}
+
+	return origin.ResolveReference(&url.URL{
+		Path:     f.errorPath,
+		RawQuery: url.Values{"reason": {reason}}.Encode(),
+	}).String()
+}
+
+func (f *Frontend) origin(u *url.URL) *url.URL {
+	for _, o := range f.origins {
+		if u.Scheme == o.Scheme && strings.EqualFold(u.Host, o.Host) {
+			return o
+		}
+	}
+
+	return nil
+}
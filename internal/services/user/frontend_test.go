@@ -0,0 +1,84 @@
+package user_test
+
+import (
+	"testing"
+
+	"github.com/pmoieni/rmx/internal/services/user"
+)
+
+func newFrontend(t *testing.T) *user.Frontend {
+	t.Helper()
+
+	f, err := user.NewFrontend([]string{"https://rmx.example.com", "http://localhost:5173"}, "/auth/error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestFrontendReturnTo(t *testing.T) {
+	f := newFrontend(t)
+
+	tests := []struct {
+		returnTo string
+		want     string
+		wantErr  bool
+	}{
+		{"", "https://rmx.example.com/", false},
+		{"https://rmx.example.com/jams/1?tab=chat", "https://rmx.example.com/jams/1?tab=chat", false},
+		{"http://localhost:5173/jams", "http://localhost:5173/jams", false},
+		{"https://RMX.example.com/", "https://RMX.example.com/", false},
+		{"/jams/1", "https://rmx.example.com/jams/1", false},
+		{"/\\evil.example.com", "https://rmx.example.com/%5Cevil.example.com", false},
+		{"https://evil.example.com/", "", true},
+		{"http://rmx.example.com/", "", true},
+		{"https://rmx.example.com.evil.example.com/", "", true},
+		{"https://user@rmx.example.com/", "", true},
+		{"//evil.example.com/jams", "", true},
+		{"jams/1", "", true},
+		{"javascript:alert(1)", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.returnTo, func(t *testing.T) {
+			got, err := f.ReturnTo(tt.returnTo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReturnTo(%q) error = %v, want error %v", tt.returnTo, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReturnTo(%q) = %q, want %q", tt.returnTo, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrontendError(t *testing.T) {
+	f := newFrontend(t)
+
+	tests := []struct {
+		returnTo string
+		want     string
+	}{
+		{"http://localhost:5173/jams", "http://localhost:5173/auth/error?reason=access_denied"},
+		{"https://evil.example.com/", "https://rmx.example.com/auth/error?reason=access_denied"},
+		{"", "https://rmx.example.com/auth/error?reason=access_denied"},
+	}
+	for _, tt := range tests {
+		if got := f.Error(tt.returnTo, "access_denied"); got != tt.want {
+			t.Errorf("Error(%q) = %q, want %q", tt.returnTo, got, tt.want)
+		}
+	}
+}
+
+func TestNewFrontend(t *testing.T) {
+	for _, origins := range [][]string{
+		nil,
+		{"rmx.example.com"},
+		{"ftp://rmx.example.com"},
+		{"https://rmx.example.com/app"},
+	} {
+		if _, err := user.NewFrontend(origins, "/auth/error"); err == nil {
+			t.Errorf("NewFrontend(%q) succeeded", origins)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package user
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lucasepe/codename"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/services/user/internal/token"
+)
+
+// guests have no refresh token, they sign in to keep their user once it expires
+var guestTokenExpiry time.Duration = time.Hour * 24
+
+const (
+	// guests created by each IP at once, enough for a few people sharing one
+	guestBurst = 5
+	// and how long it takes to create another one
+	guestRefill = time.Minute * 5
+)
+
+// handleGuest creates a guest user with a codename and signs it in, the
+// requests that are already signed in get their user back. Each IP can only
+// create so many guests, see ipLimiter.
+func handleGuest(userRepo UserRepo, keyring *Keyring, limiter *ipLimiter) net.Handler {
+	type res struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Guest    bool   `json:"guest"`
+		// AccessToken is for the clients using the Authorization header, it's
+		// set as a cookie too.
+		AccessToken string    `json:"accessToken,omitempty"`
+		ExpiresAt   time.Time `json:"expiresAt,omitzero"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if p, ok := net.PrincipalFrom(r.Context()); ok {
+			return net.WriteJSON(w, http.StatusOK, &res{ID: p.UserID.String(), Username: p.Username, Guest: p.Guest})
+		}
+
+		if wait, ok := limiter.allow(clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return net.HandlerError{Msg: "too many guests created, try again later", Code: http.StatusTooManyRequests}
+		}
+
+		guest, err := userRepo.CreateGuest(r.Context(), codename.Generate(codenameRNG, 4))
+		if err != nil {
+			return err
+		}
+
+		at, err := keyring.New(&token.Claims{Type: token.Access, UserID: guest.ID.String()}, guestTokenExpiry)
+		if err != nil {
+			return err
+		}
+
+		http.SetCookie(w, tokenCookie(net.AccessTokenCookie, "/", at, int(guestTokenExpiry.Seconds())))
+
+		return net.WriteJSON(w, http.StatusCreated, &res{
+			ID:          guest.ID.String(),
+			Username:    guest.Username,
+			Guest:       true,
+			AccessToken: at,
+			ExpiresAt:   time.Now().UTC().Add(guestTokenExpiry),
+		})
+	}
+}
+
+// ipLimiter keeps a token bucket by IP, a token is given back every refill up
+// to burst.
+type ipLimiter struct {
+	burst  float64
+	refill time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*ipBucket
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPLimiter(burst int, refill time.Duration) *ipLimiter {
+	return &ipLimiter{burst: float64(burst), refill: refill, buckets: make(map[string]*ipBucket)}
+}
+
+// allow takes a token of ip, if there's none it returns how long until there is one.
+func (l *ipLimiter) allow(ip string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		l.prune(now)
+		b = &ipBucket{tokens: l.burst}
+		l.buckets[ip] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+float64(now.Sub(b.last))/float64(l.refill))
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(l.refill)), false
+	}
+	b.tokens--
+
+	return 0, true
+}
+
+// prune forgets the buckets that refilled since they were last used, they're
+// the same as new ones.
+func (l *ipLimiter) prune(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))/float64(l.refill) >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
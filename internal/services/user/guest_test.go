@@ -0,0 +1,57 @@
+package user_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/services/user"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+func (u *users) CreateGuest(_ context.Context, username string) (*userStore.UserDTO, error) {
+	dto := &userStore.UserDTO{ID: uuid.New(), Username: username}
+	u.byID[dto.ID] = dto
+
+	return dto, nil
+}
+
+func TestGuestPerIP(t *testing.T) {
+	kr := newKeyring(t)
+	userRepo := &users{byID: make(map[uuid.UUID]*userStore.UserDTO)}
+	tokenRepo := &tokens{}
+	us, err := user.NewService(userRepo, nil, tokenRepo, nil, kr, user.NewAuth(userRepo, tokenRepo, kr), newFrontend(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guest := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/guest", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		us.ServeHTTP(w, r)
+
+		return w
+	}
+
+	for i := range 5 {
+		if w := guest("192.0.2.1:1234"); w.Code != http.StatusCreated {
+			t.Fatalf("guest %d got %d, want %d", i, w.Code, http.StatusCreated)
+		}
+	}
+
+	// from another port of the same address
+	w := guest("192.0.2.1:4321")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("guest past the limit got %d, want %d with a Retry-After", w.Code, http.StatusTooManyRequests)
+	}
+
+	if w := guest("192.0.2.2:1234"); w.Code != http.StatusCreated {
+		t.Errorf("guest of another IP got %d, want %d", w.Code, http.StatusCreated)
+	}
+	if len(userRepo.byID) != 6 {
+		t.Errorf("%d guests were created, want 6", len(userRepo.byID))
+	}
+}
@@ -3,49 +3,270 @@ package token
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
 	"time"
 
 	"aidanwoods.dev/go-paseto"
+	"github.com/google/uuid"
+)
+
+const (
+	Access  = "access"
+	Refresh = "refresh"
 )
 
 var (
-	privKey paseto.V4AsymmetricSecretKey
-	pubKey  paseto.V4AsymmetricPublicKey
-	parser  = paseto.NewParser()
+	ErrNoKeys     = errors.New("token: the keyring has no keys")
+	ErrUnknownKey = errors.New("token: signed by an unknown key")
+	ErrWrongType  = errors.New("token: wrong type")
+
+	parser = paseto.NewParser()
 )
 
-func init() {
-	// TODO: static keys
-	// use new go private mem feature
-	pub, priv, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		panic(err)
+// Claims of the tokens issued with a Keyring.
+type Claims struct {
+	// Type is either Access or Refresh.
+	Type   string
+	UserID string
+	Email  string
+	// ID (jti) is unique to every token, Family is shared by the refresh
+	// tokens rotated from the same sign in.
+	ID       string
+	Family   string
+	IssuedAt time.Time
+	// Expiration is set by Parse, New sets it from its exp.
+	Expiration time.Time
+}
+
+// Key is a signing key of a Keyring, Seed is the hex encoded Ed25519 seed.
+type Key struct {
+	ID        string    `json:"kid"`
+	Seed      string    `json:"seed"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GenerateKey returns a new Key with a random ID.
+func GenerateKey() (Key, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
 	}
 
-	privKey, err = paseto.NewV4AsymmetricSecretKeyFromEd25519(priv)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		panic(err)
+		return Key{}, err
 	}
 
-	pubKey, err = paseto.NewV4AsymmetricPublicKeyFromEd25519(pub)
+	return Key{
+		ID:        hex.EncodeToString(id),
+		Seed:      hex.EncodeToString(priv.Seed()),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// PublicKey is a public key of a Keyring, Key is in its PASERK form (k4.public.*).
+type PublicKey struct {
+	ID        string    `json:"kid"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type keyPair struct {
+	Key
+	priv paseto.V4AsymmetricSecretKey
+	pub  paseto.V4AsymmetricPublicKey
+}
+
+// footer of the tokens, it tells which key verifies them
+type footer struct {
+	KeyID string `json:"kid"`
+}
+
+/*
+Keyring signs the tokens with its newest key and verifies them with the key
+in their footer. Keys are rotated by adding a new one, the tokens signed by the
+older ones are valid as long as their key is in the keyring.
+*/
+type Keyring struct {
+	// oldest first
+	keys []keyPair
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	kr := &Keyring{}
+	for _, k := range keys {
+		if k.ID == "" {
+			return nil, errors.New("token: a key has no kid")
+		}
+		if slices.ContainsFunc(kr.keys, func(kp keyPair) bool { return kp.ID == k.ID }) {
+			return nil, fmt.Errorf("token: duplicate kid %q", k.ID)
+		}
+
+		priv, err := paseto.NewV4AsymmetricSecretKeyFromSeed(k.Seed)
+		if err != nil {
+			return nil, fmt.Errorf("token: key %q: %w", k.ID, err)
+		}
+
+		kr.keys = append(kr.keys, keyPair{Key: k, priv: priv, pub: priv.Public()})
+	}
+
+	slices.SortStableFunc(kr.keys, func(a, b keyPair) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return kr, nil
+}
+
+// keyringFile is the format of the keyring files.
+type keyringFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// LoadKeyring reads the keyring in the file at path, a keyring with a new key
+// is written to it if it doesn't exist.
+func LoadKeyring(path string) (*Keyring, error) {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		k, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if bs, err = json.MarshalIndent(&keyringFile{Keys: []Key{k}}, "", "\t"); err != nil {
+			return nil, err
+		}
+
+		// O_EXCL so instances starting together don't overwrite each other's keys
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return LoadKeyring(path)
+			}
+
+			return nil, err
+		}
+		defer f.Close()
+
+		if _, err := f.Write(bs); err != nil {
+			return nil, err
+		}
+
+		return NewKeyring(k)
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+
+	var kf keyringFile
+	if err := json.Unmarshal(bs, &kf); err != nil {
+		return nil, fmt.Errorf("token: keyring %s: %w", path, err)
+	}
+
+	return NewKeyring(kf.Keys...)
 }
 
-func New(userID string, email string, exp time.Duration) (string, error) {
+// New returns a token with the claims c signed by the newest key, a new ID is set if c has none.
+func (kr *Keyring) New(c *Claims, exp time.Duration) (string, error) {
 	now := time.Now().UTC()
 
+	if c.ID == "" {
+		c.ID = uuid.NewString()
+	}
+	c.Expiration = now.Add(exp)
+
 	token := paseto.NewToken()
 	token.SetIssuedAt(now)
 	token.SetNotBefore(now)
-	token.SetExpiration(now.Add(exp))
-	token.SetSubject(userID)
-	token.SetString("email", email)
+	token.SetExpiration(c.Expiration)
+	token.SetJti(c.ID)
+	token.SetSubject(c.UserID)
+	token.SetString("typ", c.Type)
+	token.SetString("email", c.Email)
+	if c.Family != "" {
+		token.SetString("fam", c.Family)
+	}
 
-	return token.V4Sign(privKey, nil), nil
+	signer := kr.keys[len(kr.keys)-1]
+	f, err := json.Marshal(&footer{KeyID: signer.ID})
+	if err != nil {
+		return "", err
+	}
+	token.SetFooter(f)
+
+	return token.V4Sign(signer.priv, nil), nil
 }
 
-func Parse(token string) (*paseto.Token, error) {
-	return parser.ParseV4Public(pubKey, token, nil)
+// Parse verifies a token of type typ and returns its claims.
+func (kr *Keyring) Parse(token, typ string) (*Claims, error) {
+	bs, err := parser.UnsafeParseFooter(paseto.V4Public, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var f footer
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, ErrUnknownKey
+	}
+
+	i := slices.IndexFunc(kr.keys, func(kp keyPair) bool { return kp.ID == f.KeyID })
+	if i < 0 {
+		return nil, ErrUnknownKey
+	}
+
+	parsed, err := parser.ParseV4Public(kr.keys[i].pub, token, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Claims{}
+	if c.Type, err = parsed.GetString("typ"); err != nil || c.Type != typ {
+		return nil, ErrWrongType
+	}
+	if c.UserID, err = parsed.GetSubject(); err != nil {
+		return nil, err
+	}
+	if c.ID, err = parsed.GetJti(); err != nil {
+		return nil, err
+	}
+	if c.Email, err = parsed.GetString("email"); err != nil {
+		return nil, err
+	}
+	if c.IssuedAt, err = parsed.GetIssuedAt(); err != nil {
+		return nil, err
+	}
+	if c.Expiration, err = parsed.GetExpiration(); err != nil {
+		return nil, err
+	}
+	if typ == Refresh {
+		if c.Family, err = parsed.GetString("fam"); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// PublicKeys returns the public keys of the keyring, newest first.
+func (kr *Keyring) PublicKeys() []PublicKey {
+	keys := make([]PublicKey, 0, len(kr.keys))
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		kp := kr.keys[i]
+		keys = append(keys, PublicKey{
+			ID:        kp.ID,
+			Key:       "k4.public." + base64.RawURLEncoding.EncodeToString(kp.pub.ExportBytes()),
+			CreatedAt: kp.CreatedAt,
+		})
+	}
+
+	return keys
 }
@@ -0,0 +1,62 @@
+package user
+
+import (
+	"net/http"
+
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/services/user/internal/token"
+)
+
+type (
+	// Keyring signs the tokens issued by the service with its newest key and
+	// verifies them with any of its keys.
+	Keyring = token.Keyring
+	// SigningKey is a key of a Keyring, Seed is the hex encoded Ed25519 seed.
+	SigningKey = token.Key
+)
+
+// NewKeyring returns the keyring of keys, or of the keyring file at path if
+// there are none. The file is created with a new key if it doesn't exist.
+func NewKeyring(path string, keys ...SigningKey) (*Keyring, error) {
+	if len(keys) > 0 {
+		return token.NewKeyring(keys...)
+	}
+
+	return token.LoadKeyring(path)
+}
+
+var _ net.Service = (*KeysService)(nil)
+
+// KeysService publishes the public keys of the Keyring so the tokens can be
+// verified outside of the service.
+type KeysService struct {
+	*http.ServeMux
+
+	keyring *Keyring
+}
+
+func NewKeysService(keyring *Keyring) *KeysService {
+	s := &KeysService{
+		ServeMux: http.NewServeMux(),
+
+		keyring: keyring,
+	}
+	s.HandleFunc("GET /rmx-keys", handleKeys(s.keyring).ServeHTTP)
+
+	return s
+}
+
+func (s *KeysService) MountPath() string {
+	return ".well-known"
+}
+
+func handleKeys(keyring *Keyring) net.Handler {
+	type res struct {
+		Keys []token.PublicKey `json:"keys"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		return net.WriteJSON(w, http.StatusOK, &res{Keys: keyring.PublicKeys()})
+	}
+}
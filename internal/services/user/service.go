@@ -1,12 +1,13 @@
 package user
 
 import (
-	"hash/fnv"
+	"errors"
+	"log/slog"
 	"math/rand"
 	"net/http"
-	"strconv"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/lucasepe/codename"
 	"github.com/pmoieni/rmx/internal/lib"
 	"github.com/pmoieni/rmx/internal/net"
@@ -39,6 +40,9 @@ type UserService struct {
 	connectionRepo ConnectionRepo
 	tokenRepo      TokenRepo
 	ocs            *oauth.ClientStore
+	keyring        *Keyring
+	auth           *net.Auth
+	frontend       *Frontend
 	log            *lib.Logger
 }
 
@@ -47,6 +51,9 @@ func NewService(
 	connectionRepo ConnectionRepo,
 	tokenRepo TokenRepo,
 	ocs *oauth.ClientStore,
+	keyring *Keyring,
+	auth *net.Auth,
+	frontend *Frontend,
 ) (*UserService, error) {
 	s := &UserService{
 		ServeMux: http.NewServeMux(),
@@ -55,6 +62,9 @@ func NewService(
 		connectionRepo: connectionRepo,
 		tokenRepo:      tokenRepo,
 		ocs:            ocs,
+		keyring:        keyring,
+		auth:           auth,
+		frontend:       frontend,
 		log:            lib.NewLogger("user"),
 	}
 	s.setupControllers()
@@ -67,176 +77,164 @@ func (s *UserService) MountPath() string {
 }
 
 func (s *UserService) setupControllers() {
-	s.HandleFunc("GET /me", handleUserInfo().ServeHTTP)
-	s.HandleFunc("GET /auth/login", handleLogin(s.ocs).ServeHTTP)
-	s.HandleFunc("GET /auth/callback", handleCallback(s.userRepo, s.tokenRepo, s.connectionRepo, s.ocs).ServeHTTP)
-	s.HandleFunc("GET /auth/refresh", handleRefresh(s.tokenRepo).ServeHTTP)
+	s.HandleFunc("GET /me", s.auth.RequireAuth(handleUserInfo()).ServeHTTP)
+	s.HandleFunc("GET /auth/login", handleLogin(s.ocs, s.frontend).ServeHTTP)
+	s.HandleFunc("POST /guest", s.auth.OptionalAuth(handleGuest(s.userRepo, s.keyring, newIPLimiter(guestBurst, guestRefill))).ServeHTTP)
+	s.HandleFunc("GET /auth/callback", s.auth.OptionalAuth(handleCallback(s.userRepo, s.tokenRepo, s.connectionRepo, s.ocs, s.keyring, s.frontend)).ServeHTTP)
+	s.HandleFunc("GET /auth/refresh", handleRefresh(s.tokenRepo, s.keyring).ServeHTTP)
+	s.HandleFunc("POST /auth/logout", s.auth.OptionalAuth(handleLogout(s.tokenRepo, s.keyring)).ServeHTTP)
+	s.HandleFunc("GET /me/sessions", s.auth.RequireAuth(handleListSessions(s.tokenRepo)).ServeHTTP)
+	s.HandleFunc("DELETE /me/sessions/{id}", s.auth.RequireAuth(handleDeleteSession(s.tokenRepo)).ServeHTTP)
+	s.HandleFunc("GET /auth/link", s.auth.RequireAuth(handleLink(s.ocs, s.frontend)).ServeHTTP)
+	s.HandleFunc("GET /me/connections", s.auth.RequireAuth(handleListConnections(s.connectionRepo)).ServeHTTP)
+	s.HandleFunc("DELETE /me/connections/{provider}", s.auth.RequireAuth(handleUnlink(s.connectionRepo)).ServeHTTP)
 }
 
-func handleUserInfo() net.Handler {
+// handleLogin redirects to the authorization of the provider, the browser is
+// sent to return_to after the callback.
+func handleLogin(ocs *oauth.ClientStore, frontend *Frontend) net.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		return nil
-	}
-}
-
-func handleLogin(ocs *oauth.ClientStore) net.Handler {
-	return func(w http.ResponseWriter, r *http.Request) error {
-		pName := getProvider(r)
-		provider, err := ocs.GetProvider(pName)
+		returnTo, err := frontend.ReturnTo(r.URL.Query().Get("return_to"))
 		if err != nil {
-			return err
+			return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusBadRequest}
 		}
 
-		provider.HandleAuthorizationRequest(w, r)
-		return nil
+		return oauthError(ocs.HandleAuthorizationRequest(w, r, getProvider(r), oauth.AuthOptions{ReturnTo: returnTo}))
 	}
 }
 
+// handleCallback signs in the user of the provider, or links it, and redirects
+// to the return_to of the sign in. The failures are redirected to the error
+// page of the frontend with their reason.
 func handleCallback(
 	userRepo UserRepo,
 	tokenRepo TokenRepo,
 	connectionRepo ConnectionRepo,
 	ocs *oauth.ClientStore,
+	keyring *Keyring,
+	frontend *Frontend,
 ) net.Handler {
-	return func(w http.ResponseWriter, r *http.Request) error {
-		pName := getProvider(r)
-		provider, err := ocs.GetProvider(pName)
+	callback := func(w http.ResponseWriter, r *http.Request, pName string, res *oauth.CallbackResult, opts oauth.AuthOptions) error {
+		id, linking, err := linkingUser(r, opts)
 		if err != nil {
 			return err
 		}
-
-		res, err := provider.GetCallbackResult(r)
-		if err != nil {
-			return err
+		if linking {
+			return linkConnection(r.Context(), userRepo, connectionRepo, tokenRepo, id, pName, res)
 		}
 
-		// TODO: make sure emails are verified from providers
-		/*
-			if !res.EmailVerified {
-				http.Error(w, errors.New("email not verified").Error(), http.StatusForbidden)
-				return
-			}
-		*/
-
-		// create new user, continue if exists
-		// TODO: this should return the created user
-		user, err := userRepo.CreateUser(r.Context(), &userStore.UserParams{
-			Username: codename.Generate(codenameRNG, 4),
-			Email:    res.Email,
-		})
+		user, err := findOrCreateUser(r.Context(), userRepo, connectionRepo, tokenRepo, pName, res)
 		if err != nil {
 			return err
 		}
 
-		if _, err := connectionRepo.CreateConnection(r.Context(), &userStore.ConnectionParams{
-			ID:       res.Issuer + ":" + res.UserID,
-			UserID:   user.ID,
-			Provider: pName,
-		}); err != nil {
-			return err
+		// every sign in starts a new family of refresh tokens
+		return setTokens(w, r, keyring, tokenRepo, user.ID.String(), user.Email, uuid.NewString())
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		pName := getProvider(r)
+		res, opts, err := ocs.GetCallbackResult(w, r, pName)
+		if err == nil {
+			err = callback(w, r, pName, res, opts)
 		}
 
-		if err := setToken(w, nil, "rmx_at", user.ID.String(), res.Email, accessTokenExpiry); err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return err
+		if err != nil {
+			reason := callbackReason(err)
+			if reason == reasonServerError {
+				slog.Error("sign in failed", "provider", pName, "err", err)
+			}
+
+			http.Redirect(w, r, frontend.Error(opts.ReturnTo, reason), http.StatusFound)
+			return nil
 		}
 
-		if err := setToken(w, tokenRepo, "rmx_rt", user.ID.String(), res.Email, refreshTokenExpiry); err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
+		// the state of the sign in has the validated return_to
+		returnTo, err := frontend.ReturnTo(opts.ReturnTo)
+		if err != nil {
 			return err
 		}
 
+		http.Redirect(w, r, returnTo, http.StatusFound)
 		return nil
 	}
 }
 
-func handleRefresh(tokenRepo TokenRepo) net.Handler {
+// callbackReason returns the reason of a failed callback for the error page.
+func callbackReason(err error) string {
+	switch {
+	case errors.Is(err, oauth.ErrInvalidState):
+		return reasonInvalidState
+	case errors.Is(err, oauth.ErrAuthorizationDenied):
+		return reasonAccessDenied
+	case errors.Is(err, oauth.ErrProviderUnavailable):
+		return reasonProviderUnavailable
+	case errors.Is(err, oauth.ErrUnknownProvider):
+		return reasonInvalidProvider
+	case errors.Is(err, ErrAccountConflict), errors.Is(err, userStore.ErrConnectionExists):
+		return reasonAccountConflict
+	case errors.Is(err, net.ErrUnauthenticated):
+		return reasonUnauthenticated
+	}
+
+	return reasonServerError
+}
+
+func handleRefresh(tokenRepo TokenRepo, keyring *Keyring) net.Handler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		rt, err := r.Cookie("rmx_rt")
+		rt, err := r.Cookie(refreshTokenCookie)
 		if err != nil {
-			return err
-		}
-		if err := rt.Valid(); err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return err
+			return net.HandlerError{Err: err, Msg: "refresh token not found", Code: http.StatusUnauthorized}
 		}
 
-		isValid, err := tokenRepo.IsValid(
-			userStore.ListRefreshToken,
-			rt.Value,
-		)
+		claims, err := keyring.Parse(rt.Value, token.Refresh)
 		if err != nil {
-			return err
-		}
-		if !isValid {
-			http.Error(w, "refresh token reuse detected", http.StatusForbidden)
-			return nil
-		}
-
-		if err := tokenRepo.List(userStore.ListRefreshToken, rt.Value, refreshTokenExpiry); err != nil {
-			return err
+			return net.HandlerError{Err: err, Msg: "invalid refresh token", Code: http.StatusUnauthorized}
 		}
 
-		parsed, err := token.Parse(rt.Value)
+		revoked, err := tokenRepo.IsRevoked(claims.ID, claims.UserID, claims.IssuedAt)
 		if err != nil {
 			return err
 		}
-		userID, err := parsed.GetSubject()
-		if err != nil {
-			return err
-		}
-		email, ok := parsed.Claims()["email"]
-		if !ok {
-			http.Error(w, "email not found", http.StatusForbidden)
-			return nil
-		}
-		emailStr := email.(string)
-
-		if err := setToken(w, nil, "rmx_at", userID, emailStr, accessTokenExpiry); err != nil {
-			return err
+		if revoked {
+			clearTokens(w)
+			return net.HandlerError{Err: userStore.ErrTokenRevoked, Msg: "invalid refresh token", Code: http.StatusUnauthorized}
 		}
 
-		if err := setToken(w, tokenRepo, "rmx_rt", userID, emailStr, refreshTokenExpiry); err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
+		err = tokenRepo.UseRefreshToken(hashToken(rt.Value), claims.Family, refreshTokenExpiry)
+		switch {
+		case err == nil:
+		case errors.Is(err, userStore.ErrTokenReused):
+			slog.Warn("refresh token reuse detected, its family is revoked", "user", claims.UserID, "family", claims.Family)
+			if err := tokenRepo.DeleteSession(claims.UserID, claims.Family, refreshTokenExpiry); err != nil && !errors.Is(err, userStore.ErrSessionNotFound) {
+				return err
+			}
+			clearTokens(w)
+			return net.HandlerError{Err: err, Msg: "refresh token reuse detected", Code: http.StatusUnauthorized}
+		case errors.Is(err, userStore.ErrTokenNotFound), errors.Is(err, userStore.ErrTokenRevoked):
+			clearTokens(w)
+			return net.HandlerError{Err: err, Msg: "invalid refresh token", Code: http.StatusUnauthorized}
+		default:
 			return err
 		}
 
-		return nil
+		return setTokens(w, r, keyring, tokenRepo, claims.UserID, claims.Email, claims.Family)
 	}
 }
 
-func setToken(
-	w http.ResponseWriter,
-	tokenRepo TokenRepo,
-	name, userID, email string,
-	expiry time.Duration,
-) error {
-	token, err := token.New(userID, email, expiry)
-	if err != nil {
-		return err
-	}
-
-	// store the hash of the token
-	if tokenRepo != nil {
-		h := fnv.New32a()
-		if _, err := h.Write([]byte(token)); err != nil {
-			return err
-		}
-
-		if err = tokenRepo.List(userStore.ListRefreshToken, strconv.FormatUint(uint64(h.Sum32()), 10), expiry); err != nil {
-			return err
-		}
+// oauthError responds to the invalid states and the unavailable providers
+// with their status, the others are unexpected.
+func oauthError(err error) error {
+	switch {
+	case errors.Is(err, oauth.ErrInvalidState):
+		return net.HandlerError{Err: err, Msg: "invalid or expired authorization, sign in again", Code: http.StatusBadRequest}
+	case errors.Is(err, oauth.ErrProviderUnavailable):
+		return net.HandlerError{Err: err, Msg: "provider unavailable", Code: http.StatusServiceUnavailable}
+	case errors.Is(err, oauth.ErrUnknownProvider):
+		return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusBadRequest}
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    token,
-		MaxAge:   int(expiry),
-		Secure:   true, // TODO: use false only for debugging
-		HttpOnly: true,
-	})
-
-	return nil
+	return err
 }
 
 func getProvider(r *http.Request) string {
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/services/user/internal/token"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+// handleLogout ends the session of the refresh token and revokes the access
+// token of the request, a Bearer token or the cookie. The cookies are cleared
+// even if they're invalid.
+func handleLogout(tokenRepo TokenRepo, keyring *Keyring) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		clearTokens(w)
+
+		if rt, err := r.Cookie(refreshTokenCookie); err == nil {
+			if claims, err := keyring.Parse(rt.Value, token.Refresh); err == nil {
+				err := tokenRepo.DeleteSession(claims.UserID, claims.Family, refreshTokenExpiry)
+				if err != nil && !errors.Is(err, userStore.ErrSessionNotFound) {
+					return err
+				}
+			}
+		}
+
+		// the access token the request was authenticated with, a Bearer token
+		// or the cookie, and the one in the cookie if it's another
+		var tokens []string
+		if p, ok := net.PrincipalFrom(r.Context()); ok {
+			tokens = append(tokens, p.AccessToken)
+		}
+		if at, err := r.Cookie(net.AccessTokenCookie); err == nil {
+			tokens = append(tokens, at.Value)
+		}
+
+		// revoked for as long as the access token is valid
+		for _, at := range tokens {
+			if claims, err := keyring.Parse(at, token.Access); err == nil {
+				if exp := time.Until(claims.Expiration); exp > 0 {
+					if err := tokenRepo.Revoke(claims.ID, exp); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// handleListSessions returns the sessions of the user, the last used first.
+func handleListSessions(tokenRepo TokenRepo) net.Handler {
+	type res struct {
+		Sessions []userStore.SessionDTO `json:"sessions"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		sessions, err := tokenRepo.ListSessions(p.UserID.String())
+		if err != nil {
+			return err
+		}
+
+		slices.SortFunc(sessions, func(a, b userStore.SessionDTO) int {
+			return b.LastUsedAt.Compare(a.LastUsedAt)
+		})
+
+		return net.WriteJSON(w, http.StatusOK, &res{Sessions: sessions})
+	}
+}
+
+// handleDeleteSession revokes a session of the user, its device is signed out
+// once its access token expires.
+func handleDeleteSession(tokenRepo TokenRepo) net.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		p, ok := net.PrincipalFrom(r.Context())
+		if !ok {
+			return net.HandlerError{Err: net.ErrUnauthenticated, Msg: net.ErrUnauthenticated.Error(), Code: http.StatusUnauthorized}
+		}
+
+		if err := tokenRepo.DeleteSession(p.UserID.String(), r.PathValue("id"), refreshTokenExpiry); err != nil {
+			if errors.Is(err, userStore.ErrSessionNotFound) {
+				return net.HandlerError{Err: err, Msg: err.Error(), Code: http.StatusNotFound}
+			}
+
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/services/user/internal/token"
+	userStore "github.com/pmoieni/rmx/internal/store/user"
+)
+
+const (
+	refreshTokenCookie = "rmx_rt"
+	// the refresh token is only sent to the auth endpoints
+	refreshTokenPath = "/users/auth"
+)
+
+// setTokens sets the cookies of a new access token and a new refresh token of
+// family, the session of family is saved with the device and the IP of r.
+func setTokens(w http.ResponseWriter, r *http.Request, keyring *Keyring, tokenRepo TokenRepo, userID, email, family string) error {
+	at, err := keyring.New(&token.Claims{Type: token.Access, UserID: userID, Email: email}, accessTokenExpiry)
+	if err != nil {
+		return err
+	}
+
+	rt, err := keyring.New(&token.Claims{Type: token.Refresh, UserID: userID, Email: email, Family: family}, refreshTokenExpiry)
+	if err != nil {
+		return err
+	}
+
+	// only the hash of the refresh token is stored
+	if err := tokenRepo.SaveRefreshToken(hashToken(rt), refreshTokenExpiry); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if err := tokenRepo.SaveSession(&userStore.SessionDTO{
+		ID:         family,
+		UserID:     userID,
+		Device:     r.UserAgent(),
+		IP:         clientIP(r),
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}, refreshTokenExpiry); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, tokenCookie(net.AccessTokenCookie, "/", at, int(accessTokenExpiry.Seconds())))
+	http.SetCookie(w, tokenCookie(refreshTokenCookie, refreshTokenPath, rt, int(refreshTokenExpiry.Seconds())))
+
+	return nil
+}
+
+// clearTokens removes the cookies of the tokens.
+func clearTokens(w http.ResponseWriter) {
+	http.SetCookie(w, tokenCookie(net.AccessTokenCookie, "/", "", -1))
+	http.SetCookie(w, tokenCookie(refreshTokenCookie, refreshTokenPath, "", -1))
+}
+
+func tokenCookie(name, path, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   true, // TODO: use false only for debugging
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func clientIP(r *http.Request) string {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return addr.Addr().Unmap().String()
+}
+
+func hashToken(t string) string {
+	h := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(h[:])
+}
@@ -29,8 +29,12 @@ type Connection struct {
 type UserRepo interface {
 	GetUserByID(context.Context, uuid.UUID) (*userStore.UserDTO, error)
 	GetUserByEmail(context.Context, string) (*userStore.UserDTO, error)
+	GetVerifiedUserByEmail(context.Context, string) (*userStore.UserDTO, error)
 	CreateUser(context.Context, *userStore.UserParams) (*userStore.UserDTO, error)
+	CreateGuest(ctx context.Context, username string) (*userStore.UserDTO, error)
+	UpgradeGuest(ctx context.Context, id uuid.UUID, email string, emailVerified bool) (*userStore.UserDTO, error)
 	UpdateUser(context.Context, uuid.UUID, *userStore.UserParams) (*userStore.UserDTO, error)
+	MergeUsers(ctx context.Context, into, from uuid.UUID) error
 	DeleteUser(context.Context, uuid.UUID) error
 }
 
@@ -40,9 +44,21 @@ type ConnectionRepo interface {
 	CreateConnection(context.Context, *userStore.ConnectionParams) (*userStore.ConnectionDTO, error)
 	UpdateConnection(context.Context, string, *userStore.ConnectionParams) error
 	DeleteConnection(context.Context, string) error
+	UnlinkProvider(ctx context.Context, userID uuid.UUID, provider string) error
 }
 
 type TokenRepo interface {
 	List(userStore.CacheType, string, time.Duration) error
 	IsValid(userStore.CacheType, string) (bool, error)
+
+	SaveRefreshToken(hash string, exp time.Duration) error
+	UseRefreshToken(hash, family string, exp time.Duration) error
+
+	Revoke(id string, exp time.Duration) error
+	RevokeAllForUser(userID string, exp time.Duration) error
+	IsRevoked(id, userID string, issuedAt time.Time) (bool, error)
+
+	SaveSession(*userStore.SessionDTO, time.Duration) error
+	ListSessions(userID string) ([]userStore.SessionDTO, error)
+	DeleteSession(userID, id string, exp time.Duration) error
 }
@@ -3,6 +3,7 @@ package jam
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -24,6 +25,9 @@ var (
 	minBPM        uint = 15
 )
 
+// ErrTooManyJams is returned by CreateJam once the owner has MaxOwned Jams.
+var ErrTooManyJams = errors.New("too many jams")
+
 type JamRepo struct {
 	db *sqlx.DB
 }
@@ -37,12 +41,14 @@ type JamDTO struct {
 	Name     string    `db:"name"`
 	Capacity uint      `db:"capacity"`
 	BPM      uint      `db:"bpm"`
+	Approval bool      `db:"approval"`
+	Locked   bool      `db:"locked"`
 	Owner    struct {
-		ID       uuid.UUID `json:"owner_id"`
-		Username string    `json:"owner_username"`
-		Email    string    `json:"owner_email"`
+		ID       uuid.UUID `db:"id"`
+		Username string    `db:"username"`
+		Email    string    `db:"email"`
 	} `db:"owner"`
-	CreatedAt time.Time    `db:"create_at"`
+	CreatedAt time.Time    `db:"created_at"`
 	UpdatedAt time.Time    `db:"updated_at"`
 	DeletedAt sql.NullTime `db:"deleted_at"`
 }
@@ -51,7 +57,10 @@ type JamParams struct {
 	Name     string
 	Capacity uint
 	BPM      uint
+	Approval bool
 	OwnerID  uuid.UUID
+	// MaxOwned is how many Jams the owner can have, 0 is unlimited.
+	MaxOwned int
 }
 
 func (p *JamParams) Validate(nullable bool) *store.StoreErr {
@@ -100,16 +109,14 @@ func (p *JamParams) trim() {
 
 func (r *JamRepo) GetJam(ctx context.Context, id uuid.UUID) (*JamDTO, error) {
 	j := &JamDTO{}
-	query := `SELECT jams.id, jams.name, jams.capacity, jams.bpm,
-        json_build_object(
-            'owner_id', users.id,
-            'owner_username', users.username,
-            'owner_email', users.email
-        ) AS owner
+	query := `SELECT jams.id, jams.name, jams.capacity, jams.bpm, jams.approval, jams.locked,
+        users.id AS "owner.id",
+        users.username AS "owner.username",
+        COALESCE(users.email, '') AS "owner.email"
         FROM jams
         INNER JOIN users ON jams.owner_id = users.id
         WHERE jams.id = $1
-        AND deleted_at IS NULL`
+        AND jams.deleted_at IS NULL`
 	if err := r.db.GetContext(ctx, j, query, id.String()); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, net.HandlerError{
@@ -129,16 +136,40 @@ func (r *JamRepo) GetJam(ctx context.Context, id uuid.UUID) (*JamDTO, error) {
 	return j, nil
 }
 
+// CreateJam creates the Jam of p, ErrTooManyJams is returned if its owner
+// already has p.MaxOwned of them.
 func (r *JamRepo) CreateJam(ctx context.Context, p *JamParams) (*JamDTO, error) {
 	if err := p.Validate(false); err != nil {
 		return nil, *err
 	}
 
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, store.StoreErr{Err: err, Msg: "unexpected error trying to insert Jam", Code: http.StatusInternalServerError}
+	}
+	defer tx.Rollback()
+
+	if p.MaxOwned > 0 {
+		// locks the owner so concurrent creations can't go past MaxOwned
+		if _, err := tx.ExecContext(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, p.OwnerID); err != nil {
+			return nil, store.StoreErr{Err: err, Msg: "unexpected error trying to insert Jam", Code: http.StatusInternalServerError}
+		}
+
+		n, err := countJamsByOwner(ctx, tx, p.OwnerID)
+		if err != nil {
+			return nil, err
+		}
+		if n >= p.MaxOwned {
+			return nil, ErrTooManyJams
+		}
+	}
+
 	newJam := &JamDTO{}
 	query := `INSERT INTO jams
-        (name, capacity, bpm, owner_id)
-        VALUES ($1, $2, $3, $4);`
-	if err := r.db.QueryRowxContext(ctx, query, p.Name, p.Capacity, p.BPM, p.OwnerID).StructScan(newJam); err != nil {
+        (name, capacity, bpm, approval, owner_id)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, name, capacity, bpm, approval, locked, created_at, updated_at, deleted_at`
+	if err := tx.QueryRowxContext(ctx, query, p.Name, p.Capacity, p.BPM, p.Approval, p.OwnerID).StructScan(newJam); err != nil {
 		return nil, store.StoreErr{
 			Err:  err,
 			Msg:  "unexpected error trying to insert Jam",
@@ -146,9 +177,35 @@ func (r *JamRepo) CreateJam(ctx context.Context, p *JamParams) (*JamDTO, error)
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, store.StoreErr{Err: err, Msg: "unexpected error trying to insert Jam", Code: http.StatusInternalServerError}
+	}
+
 	return newJam, nil
 }
 
+// CountJamsByOwner returns how many Jams the user owns.
+func (r *JamRepo) CountJamsByOwner(ctx context.Context, ownerID uuid.UUID) (int, error) {
+	return countJamsByOwner(ctx, r.db, ownerID)
+}
+
+func countJamsByOwner(ctx context.Context, q sqlx.QueryerContext, ownerID uuid.UUID) (int, error) {
+	var n int
+	query := `SELECT count(*)
+        FROM jams
+        WHERE owner_id = $1
+        AND deleted_at IS NULL`
+	if err := sqlx.GetContext(ctx, q, &n, query, ownerID); err != nil {
+		return 0, store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to count the Jams of user [%s]", ownerID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return n, nil
+}
+
 func (r *JamRepo) UpdateJam(ctx context.Context, id uuid.UUID, p *JamParams) (*JamDTO, error) {
 	if err := p.Validate(true); err != nil {
 		return nil, err
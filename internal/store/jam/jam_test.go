@@ -0,0 +1,184 @@
+package jam_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jmoiron/sqlx"
+	"github.com/pmoieni/rmx/internal/net"
+	"github.com/pmoieni/rmx/internal/store"
+	"github.com/pmoieni/rmx/internal/store/jam"
+	"github.com/pmoieni/rmx/internal/store/user"
+)
+
+// newDB migrates a schema of its own in the database of RMX_TEST_DSN, the
+// tests are skipped without one.
+func newDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	dsn := os.Getenv("RMX_TEST_DSN")
+	if dsn == "" {
+		t.Skip("RMX_TEST_DSN isn't set")
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("rmx_test_%d", time.Now().UnixNano())
+
+	admin, err := store.NewPool(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(admin.Close)
+
+	if _, err := admin.Exec(ctx, `CREATE SCHEMA "`+schema+`"`); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(context.Background(), `DROP SCHEMA "`+schema+`" CASCADE`) })
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	migrations, err := filepath.Glob("../migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		bs, err := os.ReadFile(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.Exec(ctx, string(bs)); err != nil {
+			t.Fatalf("migrating %s: %v", filepath.Base(m), err)
+		}
+	}
+
+	return store.NewDB(pool)
+}
+
+func TestGetJam(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+
+	users := user.NewUserRepo(db)
+	jams := jam.NewJamRepo(db)
+
+	owner, err := users.CreateUser(ctx, &user.UserParams{Username: "alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest, err := users.CreateGuest(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		owner     *user.UserDTO
+		wantEmail string
+	}{
+		{"user", owner, "alice@example.com"},
+		{"guest", guest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created, err := jams.CreateJam(ctx, &jam.JamParams{Name: "jam", Capacity: 5, BPM: 120, OwnerID: tt.owner.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			j, err := jams.GetJam(ctx, created.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if j.ID != created.ID || j.Name != "jam" || j.Capacity != 5 || j.BPM != 120 {
+				t.Errorf("GetJam = %+v, want the created Jam %+v", j, created)
+			}
+			if j.Owner.ID != tt.owner.ID || j.Owner.Username != tt.owner.Username || j.Owner.Email != tt.wantEmail {
+				t.Errorf("Owner = %+v, want %s (%s, %q)", j.Owner, tt.owner.ID, tt.owner.Username, tt.wantEmail)
+			}
+		})
+	}
+
+	t.Run("deleted", func(t *testing.T) {
+		created, err := jams.CreateJam(ctx, &jam.JamParams{Name: "jam", Capacity: 5, BPM: 120, OwnerID: owner.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE jams SET deleted_at = now() WHERE id = $1`, created.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		assertNotFound(t, jams, created.ID)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		assertNotFound(t, jams, uuid.New())
+	})
+}
+
+func assertNotFound(t *testing.T, jams *jam.JamRepo, id uuid.UUID) {
+	t.Helper()
+
+	_, err := jams.GetJam(context.Background(), id)
+
+	var herr net.HandlerError
+	if !errors.As(err, &herr) || herr.Code != http.StatusNotFound {
+		t.Errorf("GetJam = %v, want a %d", err, http.StatusNotFound)
+	}
+}
+
+func TestCreateJamMaxOwned(t *testing.T) {
+	db := newDB(t)
+	ctx := context.Background()
+
+	guest, err := user.NewUserRepo(db).CreateGuest(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jams := jam.NewJamRepo(db)
+
+	// the creations racing each other can't go past MaxOwned
+	const n = 8
+	errs := make(chan error, n)
+	for range n {
+		go func() {
+			_, err := jams.CreateJam(ctx, &jam.JamParams{Name: "jam", Capacity: 4, BPM: 120, OwnerID: guest.ID, MaxOwned: 1})
+			errs <- err
+		}()
+	}
+
+	created := 0
+	for range n {
+		switch err := <-errs; {
+		case err == nil:
+			created++
+		case !errors.Is(err, jam.ErrTooManyJams):
+			t.Errorf("CreateJam = %v, want %v", err, jam.ErrTooManyJams)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d Jams were created, want 1", created)
+	}
+
+	if owned, err := jams.CountJamsByOwner(ctx, guest.ID); err != nil || owned != 1 {
+		t.Errorf("CountJamsByOwner = %d (%v), want 1", owned, err)
+	}
+}
@@ -0,0 +1,125 @@
+package jam
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/store"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+type MessageDTO struct {
+	ID         uuid.UUID     `db:"id"`
+	JamID      uuid.UUID     `db:"jam_id"`
+	AuthorID   uuid.NullUUID `db:"author_id"`
+	AuthorConn string        `db:"author_conn"`
+	AuthorName string        `db:"author_name"`
+	Text       string        `db:"text"`
+	CreatedAt  time.Time     `db:"created_at"`
+	EditedAt   sql.NullTime  `db:"edited_at"`
+}
+
+// MessageAuthor is who edits or deletes a message, the messages of signed in
+// users are matched by AuthorID and the others by their connection.
+type MessageAuthor struct {
+	ID   uuid.NullUUID
+	Conn string
+}
+
+const (
+	messageColumns = `id, jam_id, author_id, author_conn, author_name, text, created_at, edited_at`
+	// $3 is the id of the author and $4 their connection
+	authorCondition = `(author_id = $3 OR ($3::uuid IS NULL AND author_id IS NULL AND author_conn = $4))`
+)
+
+func (r *JamRepo) CreateMessage(ctx context.Context, m *MessageDTO) error {
+	query := `INSERT INTO jam_messages
+        (id, jam_id, author_id, author_conn, author_name, text, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := r.db.ExecContext(ctx, query, m.ID, m.JamID, m.AuthorID, m.AuthorConn, m.AuthorName, m.Text, m.CreatedAt); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to insert a message of Jam [%s]", m.JamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+// ListMessages returns up to limit messages of the Jam sent before the message
+// with the id before, or the last ones if it's not valid. They're newest first.
+func (r *JamRepo) ListMessages(ctx context.Context, jamID uuid.UUID, before uuid.NullUUID, limit int) ([]MessageDTO, error) {
+	messages := []MessageDTO{}
+	query := `SELECT ` + messageColumns + `
+        FROM jam_messages
+        WHERE jam_id = $1
+        AND deleted_at IS NULL
+        AND ($2::uuid IS NULL OR (created_at, id) < (SELECT created_at, id FROM jam_messages WHERE id = $2))
+        ORDER BY created_at DESC, id DESC
+        LIMIT $3`
+	if err := r.db.SelectContext(ctx, &messages, query, jamID, before, limit); err != nil {
+		return nil, store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to find the messages of Jam [%s]", jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return messages, nil
+}
+
+// EditMessage changes the text of a message sent by author, it returns ErrMessageNotFound if there's none.
+func (r *JamRepo) EditMessage(ctx context.Context, jamID, id uuid.UUID, author MessageAuthor, text string) (*MessageDTO, error) {
+	m := &MessageDTO{}
+	query := `UPDATE jam_messages
+        SET text = $5, edited_at = now()
+        WHERE id = $1
+        AND jam_id = $2
+        AND deleted_at IS NULL
+        AND ` + authorCondition + `
+        RETURNING ` + messageColumns
+	if err := r.db.GetContext(ctx, m, query, id, jamID, author.ID, author.Conn, text); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+
+		return nil, store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to edit message [%s]", id.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return m, nil
+}
+
+// DeleteMessage deletes a message sent by author, it returns ErrMessageNotFound if there's none.
+func (r *JamRepo) DeleteMessage(ctx context.Context, jamID, id uuid.UUID, author MessageAuthor) error {
+	query := `UPDATE jam_messages
+        SET deleted_at = now()
+        WHERE id = $1
+        AND jam_id = $2
+        AND deleted_at IS NULL
+        AND ` + authorCondition
+	res, err := r.db.ExecContext(ctx, query, id, jamID, author.ID, author.Conn)
+	if err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to delete message [%s]", id.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
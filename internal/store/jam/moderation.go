@@ -0,0 +1,170 @@
+package jam
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pmoieni/rmx/internal/store"
+)
+
+// ModerationParams is an entry of the audit trail of a Jam.
+type ModerationParams struct {
+	JamID     uuid.UUID
+	Action    string
+	ActorID   uuid.NullUUID
+	ActorName string
+	// Target is the connection id of the member.
+	Target       string
+	TargetUserID uuid.NullUUID
+	Reason       string
+}
+
+func (r *JamRepo) BanUser(ctx context.Context, jamID, userID uuid.UUID, reason string, bannedBy uuid.NullUUID) error {
+	query := `INSERT INTO jam_bans
+        (jam_id, user_id, reason, banned_by)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (jam_id, user_id) DO UPDATE
+        SET reason = EXCLUDED.reason, banned_by = EXCLUDED.banned_by`
+	if _, err := r.db.ExecContext(ctx, query, jamID, userID, reason, bannedBy); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to ban user [%s] from Jam [%s]", userID.String(), jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+func (r *JamRepo) IsBanned(ctx context.Context, jamID, userID uuid.UUID) (bool, error) {
+	var banned bool
+	query := `SELECT EXISTS (SELECT 1 FROM jam_bans WHERE jam_id = $1 AND user_id = $2)`
+	if err := r.db.GetContext(ctx, &banned, query, jamID, userID); err != nil {
+		return false, store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to find the bans of Jam [%s]", jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return banned, nil
+}
+
+func (r *JamRepo) MuteUser(ctx context.Context, jamID, userID uuid.UUID, mutedBy uuid.NullUUID) error {
+	query := `INSERT INTO jam_mutes
+        (jam_id, user_id, muted_by)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (jam_id, user_id) DO UPDATE
+        SET muted_by = EXCLUDED.muted_by`
+	if _, err := r.db.ExecContext(ctx, query, jamID, userID, mutedBy); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to mute user [%s] in Jam [%s]", userID.String(), jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+func (r *JamRepo) UnmuteUser(ctx context.Context, jamID, userID uuid.UUID) error {
+	query := `DELETE FROM jam_mutes WHERE jam_id = $1 AND user_id = $2`
+	if _, err := r.db.ExecContext(ctx, query, jamID, userID); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to unmute user [%s] in Jam [%s]", userID.String(), jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+func (r *JamRepo) IsMuted(ctx context.Context, jamID, userID uuid.UUID) (bool, error) {
+	var muted bool
+	query := `SELECT EXISTS (SELECT 1 FROM jam_mutes WHERE jam_id = $1 AND user_id = $2)`
+	if err := r.db.GetContext(ctx, &muted, query, jamID, userID); err != nil {
+		return false, store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to find the mutes of Jam [%s]", jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return muted, nil
+}
+
+// AddModerator lets the user moderate the Jam from their next connection.
+func (r *JamRepo) AddModerator(ctx context.Context, jamID, userID uuid.UUID) error {
+	query := `INSERT INTO jam_moderators
+        (jam_id, user_id)
+        VALUES ($1, $2)
+        ON CONFLICT (jam_id, user_id) DO NOTHING`
+	if _, err := r.db.ExecContext(ctx, query, jamID, userID); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to add user [%s] to the moderators of Jam [%s]", userID.String(), jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+func (r *JamRepo) RemoveModerator(ctx context.Context, jamID, userID uuid.UUID) error {
+	query := `DELETE FROM jam_moderators WHERE jam_id = $1 AND user_id = $2`
+	if _, err := r.db.ExecContext(ctx, query, jamID, userID); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to remove user [%s] from the moderators of Jam [%s]", userID.String(), jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+func (r *JamRepo) IsModerator(ctx context.Context, jamID, userID uuid.UUID) (bool, error) {
+	var moderator bool
+	query := `SELECT EXISTS (SELECT 1 FROM jam_moderators WHERE jam_id = $1 AND user_id = $2)`
+	if err := r.db.GetContext(ctx, &moderator, query, jamID, userID); err != nil {
+		return false, store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to find the moderators of Jam [%s]", jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return moderator, nil
+}
+
+func (r *JamRepo) SetLocked(ctx context.Context, jamID uuid.UUID, locked bool) error {
+	query := `UPDATE jams SET locked = $2, updated_at = now() WHERE id = $1`
+	if _, err := r.db.ExecContext(ctx, query, jamID, locked); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to lock Jam [%s]", jamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
+
+// LogModeration adds p to the audit trail of the Jam.
+func (r *JamRepo) LogModeration(ctx context.Context, p *ModerationParams) error {
+	query := `INSERT INTO jam_moderation_log
+        (jam_id, action, actor_id, actor_name, target, target_user_id, reason)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := r.db.ExecContext(ctx, query, p.JamID, p.Action, p.ActorID, p.ActorName, p.Target, p.TargetUserID, p.Reason); err != nil {
+		return store.StoreErr{
+			Err:  err,
+			Msg:  fmt.Sprintf("unexpected error trying to log a moderation of Jam [%s]", p.JamID.String()),
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	return nil
+}
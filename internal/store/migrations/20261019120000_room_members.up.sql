@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "room_members" (
+    "room" text NOT NULL,
+    "member" text NOT NULL,
+    "instance" text NOT NULL,
+    "joined_at" timestamptz NOT NULL DEFAULT (now()),
+    "seen_at" timestamptz NOT NULL DEFAULT (now()),
+    PRIMARY KEY ("room", "member")
+);
+
+CREATE INDEX IF NOT EXISTS "room_members_instance_idx" ON "room_members" ("instance");
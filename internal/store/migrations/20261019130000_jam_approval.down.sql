@@ -0,0 +1 @@
+ALTER TABLE "jams" DROP COLUMN IF EXISTS "approval";
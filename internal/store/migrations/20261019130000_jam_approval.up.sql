@@ -0,0 +1 @@
+ALTER TABLE "jams" ADD COLUMN IF NOT EXISTS "approval" BOOLEAN NOT NULL DEFAULT (false);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS "jam_moderation_log";
+DROP TABLE IF EXISTS "jam_bans";
+ALTER TABLE "jams" DROP COLUMN IF EXISTS "locked";
@@ -0,0 +1,24 @@
+ALTER TABLE "jams" ADD COLUMN IF NOT EXISTS "locked" BOOLEAN NOT NULL DEFAULT (false);
+
+CREATE TABLE IF NOT EXISTS "jam_bans" (
+    "jam_id" uuid NOT NULL REFERENCES "jams" (id) ON DELETE CASCADE,
+    "user_id" uuid NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+    "reason" text NOT NULL DEFAULT '',
+    "banned_by" uuid REFERENCES "users" (id) ON DELETE SET NULL,
+    "created_at" timestamptz NOT NULL DEFAULT (now()),
+    PRIMARY KEY ("jam_id", "user_id")
+);
+
+CREATE TABLE IF NOT EXISTS "jam_moderation_log" (
+    "id" bigserial PRIMARY KEY,
+    "jam_id" uuid NOT NULL REFERENCES "jams" (id) ON DELETE CASCADE,
+    "action" text NOT NULL,
+    "actor_id" uuid REFERENCES "users" (id) ON DELETE SET NULL,
+    "actor_name" text NOT NULL DEFAULT '',
+    "target" text NOT NULL DEFAULT '',
+    "target_user_id" uuid REFERENCES "users" (id) ON DELETE SET NULL,
+    "reason" text NOT NULL DEFAULT '',
+    "created_at" timestamptz NOT NULL DEFAULT (now())
+);
+
+CREATE INDEX IF NOT EXISTS "jam_moderation_log_jam_idx" ON "jam_moderation_log" ("jam_id", "created_at");
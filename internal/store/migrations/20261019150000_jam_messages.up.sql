@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS "jam_messages" (
+    "id" uuid PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    "jam_id" uuid NOT NULL REFERENCES "jams" (id) ON DELETE CASCADE,
+    "author_id" uuid REFERENCES "users" (id) ON DELETE SET NULL,
+    "author_conn" text NOT NULL,
+    "author_name" text NOT NULL,
+    "text" text NOT NULL CHECK (text <> ''),
+    "created_at" timestamptz NOT NULL DEFAULT (now()),
+    "edited_at" timestamptz,
+    "deleted_at" timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS "jam_messages_jam_idx" ON "jam_messages" ("jam_id", "created_at" DESC, "id" DESC);
@@ -0,0 +1,4 @@
+DELETE FROM "users" WHERE "guest" AND "email" IS NULL;
+ALTER TABLE "users" DROP CONSTRAINT IF EXISTS "users_email_guest";
+ALTER TABLE "users" DROP COLUMN IF EXISTS "guest";
+ALTER TABLE "users" ALTER COLUMN "email" SET NOT NULL;
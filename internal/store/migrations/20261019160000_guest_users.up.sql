@@ -0,0 +1,4 @@
+-- guests don't have an email until they sign in
+ALTER TABLE "users" ALTER COLUMN "email" DROP NOT NULL;
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "guest" BOOLEAN NOT NULL DEFAULT (false);
+ALTER TABLE "users" ADD CONSTRAINT "users_email_guest" CHECK (guest OR email IS NOT NULL);
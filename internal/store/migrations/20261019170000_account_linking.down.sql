@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS "connections_user_idx";
+DROP INDEX IF EXISTS "users_email_idx";
+
+ALTER TABLE "users" DROP COLUMN IF EXISTS "email_verified";
@@ -0,0 +1,5 @@
+-- users are only merged by email when it's verified on both sides
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "email_verified" BOOLEAN NOT NULL DEFAULT (false);
+
+CREATE INDEX IF NOT EXISTS "users_email_idx" ON "users" ("email") WHERE "deleted_at" IS NULL;
+CREATE INDEX IF NOT EXISTS "connections_user_idx" ON "connections" ("user_id");
@@ -0,0 +1,7 @@
+-- members the owner trusted with the moderation of the Jam
+CREATE TABLE IF NOT EXISTS "jam_moderators" (
+    "jam_id" uuid NOT NULL REFERENCES "jams" (id) ON DELETE CASCADE,
+    "user_id" uuid NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+    "created_at" timestamptz NOT NULL DEFAULT (now()),
+    PRIMARY KEY ("jam_id", "user_id")
+);
@@ -0,0 +1,8 @@
+-- signed in members stay muted when they reconnect
+CREATE TABLE IF NOT EXISTS "jam_mutes" (
+    "jam_id" uuid NOT NULL REFERENCES "jams" (id) ON DELETE CASCADE,
+    "user_id" uuid NOT NULL REFERENCES "users" (id) ON DELETE CASCADE,
+    "muted_by" uuid REFERENCES "users" (id) ON DELETE SET NULL,
+    "created_at" timestamptz NOT NULL DEFAULT (now()),
+    PRIMARY KEY ("jam_id", "user_id")
+);
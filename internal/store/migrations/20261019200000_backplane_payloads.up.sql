@@ -0,0 +1,8 @@
+-- messages of the backplane too big for NOTIFY, the notification has their id
+CREATE TABLE IF NOT EXISTS "backplane_payloads" (
+    "id" uuid PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    "data" bytea NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT (now())
+);
+
+CREATE INDEX IF NOT EXISTS "backplane_payloads_created_at_idx" ON "backplane_payloads" ("created_at");
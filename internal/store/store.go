@@ -17,12 +17,12 @@ type StoreErr struct {
 
 func (e StoreErr) Error() string { return e.Err.Error() }
 
-func NewDB(ctx context.Context, dsn string) (*sqlx.DB, error) {
-	pool, err := pgxpool.New(ctx, dsn)
-	if err != nil {
-		return nil, err
-	}
+func NewPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+	return pgxpool.New(ctx, dsn)
+}
 
+// NewDB wraps pool so it can be shared by sqlx and the parts using pgx directly.
+func NewDB(pool *pgxpool.Pool) *sqlx.DB {
 	pgxdb := stdlib.OpenDBFromPool(pool)
-	return sqlx.NewDb(pgxdb, "pgx"), nil
+	return sqlx.NewDb(pgxdb, "pgx")
 }
@@ -0,0 +1,335 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenReused   = errors.New("token reused")
+	ErrTokenRevoked  = errors.New("token revoked")
+
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+type TokenRepo struct {
+	cache *badger.DB
+}
+
+func NewTokenRepo(cache *badger.DB) *TokenRepo {
+	return &TokenRepo{cache}
+}
+
+type CacheType uint
+
+const (
+	BlacklistIPAddress CacheType = iota
+	ListRefreshToken
+	RevokedTokenFamily
+	RevokedToken
+	RevokedUser
+	Session
+)
+
+// states of the refresh tokens, used ones are kept until they expire to detect their reuse
+var (
+	tokenUnused = []byte("unused")
+	tokenUsed   = []byte("used")
+)
+
+// List caches val until exp.
+func (r *TokenRepo) List(
+	typ CacheType,
+	val string,
+	exp time.Duration,
+) error {
+	return r.cache.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(getPrefix(typ)+val), nil).WithTTL(exp))
+	})
+}
+
+// IsValid reports whether val is cached and hasn't expired.
+func (r *TokenRepo) IsValid(typ CacheType, val string) (bool, error) {
+	err := r.cache.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(getPrefix(typ) + val))
+		return err
+	})
+
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SaveRefreshToken stores the hash of a new refresh token until it expires.
+func (r *TokenRepo) SaveRefreshToken(hash string, exp time.Duration) error {
+	return r.cache.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(getPrefix(ListRefreshToken)+hash), tokenUnused).WithTTL(exp))
+	})
+}
+
+// maxConflictRetries bounds the attempts of UseRefreshToken, the conflict is
+// returned after that.
+const maxConflictRetries = 3
+
+/*
+UseRefreshToken marks the refresh token with hash as used, a token can only be used once.
+
+It returns ErrTokenReused if it was already used and revokes the family of the
+token with the same transaction, the tokens of a revoked family return
+ErrTokenRevoked. exp is how long the family stays revoked, i.e. the expiry of
+the refresh tokens.
+*/
+func (r *TokenRepo) UseRefreshToken(hash, family string, exp time.Duration) error {
+	var reused bool
+	use := func(txn *badger.Txn) error {
+		reused = false
+
+		if _, err := txn.Get([]byte(getPrefix(RevokedTokenFamily) + family)); err == nil {
+			return ErrTokenRevoked
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		key := []byte(getPrefix(ListRefreshToken) + hash)
+		item, err := txn.Get(key)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return ErrTokenNotFound
+			}
+
+			return err
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(val, tokenUsed) {
+			reused = true
+			return txn.SetEntry(badger.NewEntry([]byte(getPrefix(RevokedTokenFamily)+family), nil).WithTTL(exp))
+		}
+
+		// the used token expires with the token
+		return txn.SetEntry(badger.NewEntry(key, tokenUsed).WithTTL(time.Until(time.Unix(int64(item.ExpiresAt()), 0))))
+	}
+
+	// concurrent uses of the same token conflict, the retry finds it used
+	var err error
+	for range maxConflictRetries {
+		if err = r.cache.Update(use); !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+	}
+	if err == nil && reused {
+		return ErrTokenReused
+	}
+
+	return err
+}
+
+// SessionDTO is a sign in of a user, its ID is the family of its refresh tokens.
+type SessionDTO struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+func sessionKey(userID, id string) []byte {
+	return []byte(getPrefix(Session) + userID + ":" + id)
+}
+
+// SaveSession creates the session s or updates it, it expires after exp
+// unless it's saved again. The creation time of a session is kept.
+func (r *TokenRepo) SaveSession(s *SessionDTO, exp time.Duration) error {
+	return r.cache.Update(func(txn *badger.Txn) error {
+		key := sessionKey(s.UserID, s.ID)
+
+		item, err := txn.Get(key)
+		switch {
+		case err == nil:
+			var old SessionDTO
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &old)
+			}); err != nil {
+				return err
+			}
+
+			s.CreatedAt = old.CreatedAt
+		case !errors.Is(err, badger.ErrKeyNotFound):
+			return err
+		}
+
+		bs, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		return txn.SetEntry(badger.NewEntry(key, bs).WithTTL(exp))
+	})
+}
+
+// ListSessions returns the sessions of the user that haven't expired.
+func (r *TokenRepo) ListSessions(userID string) ([]SessionDTO, error) {
+	sessions := []SessionDTO{}
+	err := r.cache.View(func(txn *badger.Txn) error {
+		prefix := sessionKey(userID, "")
+
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 10})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var s SessionDTO
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &s)
+			}); err != nil {
+				return err
+			}
+
+			sessions = append(sessions, s)
+		}
+
+		return nil
+	})
+
+	return sessions, err
+}
+
+// DeleteSession deletes a session of the user and revokes its refresh tokens,
+// exp is how long they're still valid for. It returns ErrSessionNotFound if
+// there's no such session.
+func (r *TokenRepo) DeleteSession(userID, id string, exp time.Duration) error {
+	return r.cache.Update(func(txn *badger.Txn) error {
+		key := sessionKey(userID, id)
+		if _, err := txn.Get(key); err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return ErrSessionNotFound
+			}
+
+			return err
+		}
+
+		if err := txn.SetEntry(badger.NewEntry([]byte(getPrefix(RevokedTokenFamily)+id), nil).WithTTL(exp)); err != nil {
+			return err
+		}
+
+		return txn.Delete(key)
+	})
+}
+
+// Revoke revokes the token with the id (jti), exp is how long it's still valid for.
+func (r *TokenRepo) Revoke(id string, exp time.Duration) error {
+	return r.List(RevokedToken, id, exp)
+}
+
+// RevokeAllForUser revokes the tokens issued to the user until now, exp is how
+// long the longest lived of them is still valid for.
+func (r *TokenRepo) RevokeAllForUser(userID string, exp time.Duration) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	return r.cache.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(getPrefix(RevokedUser)+userID), []byte(now)).WithTTL(exp))
+	})
+}
+
+// IsRevoked reports whether the token with the id (jti) issued to the user at
+// issuedAt was revoked, by Revoke or by RevokeAllForUser.
+func (r *TokenRepo) IsRevoked(id, userID string, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	err := r.cache.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(getPrefix(RevokedToken) + id)); err == nil {
+			revoked = true
+			return nil
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		item, err := txn.Get([]byte(getPrefix(RevokedUser) + userID))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			revokedAt, err := strconv.ParseInt(string(val), 10, 64)
+			if err != nil {
+				return err
+			}
+
+			// issued at is in seconds, the tokens issued in the second of the revocation are revoked too
+			revoked = issuedAt.Unix() <= revokedAt
+			return nil
+		})
+	})
+
+	return revoked, err
+}
+
+// RunGC rewrites the value log of the cache every interval to reclaim the space
+// of the expired and deleted entries, until ctx is done.
+func (r *TokenRepo) RunGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// a run rewrites at most one file, it's repeated until there's nothing to rewrite
+		var err error
+		for err == nil {
+			err = r.cache.RunValueLogGC(0.5)
+		}
+
+		switch {
+		case errors.Is(err, badger.ErrNoRewrite), errors.Is(err, badger.ErrRejected):
+		case errors.Is(err, badger.ErrGCInMemoryMode):
+			return
+		default:
+			slog.Error("token cache gc", "err", err)
+		}
+	}
+}
+
+func getPrefix(typ CacheType) string {
+	var prefix string
+	switch typ {
+	case BlacklistIPAddress:
+		prefix = "ip:"
+	case ListRefreshToken:
+		prefix = "rt:"
+	case RevokedTokenFamily:
+		prefix = "rf:"
+	case RevokedToken:
+		prefix = "rv:"
+	case RevokedUser:
+		prefix = "ru:"
+	case Session:
+		prefix = "ss:"
+	}
+
+	return prefix
+}
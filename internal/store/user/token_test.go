@@ -0,0 +1,247 @@
+package user_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pmoieni/rmx/internal/store/user"
+)
+
+func newTokenRepo(t *testing.T) *user.TokenRepo {
+	t.Helper()
+
+	cache, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+
+	return user.NewTokenRepo(cache)
+}
+
+func TestTokenRepoList(t *testing.T) {
+	r := newTokenRepo(t)
+
+	if err := r.List(user.BlacklistIPAddress, "127.0.0.1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for val, want := range map[string]bool{"127.0.0.1": true, "127.0.0.2": false} {
+		valid, err := r.IsValid(user.BlacklistIPAddress, val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != want {
+			t.Errorf("IsValid(%q) = %v, want %v", val, valid, want)
+		}
+	}
+}
+
+func TestTokenRepoListExpires(t *testing.T) {
+	r := newTokenRepo(t)
+
+	if err := r.List(user.BlacklistIPAddress, "127.0.0.1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// badger expires entries by the second
+	time.Sleep(2 * time.Second)
+
+	valid, err := r.IsValid(user.BlacklistIPAddress, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Error("IsValid = true after the entry expired")
+	}
+}
+
+func TestTokenRepoUseRefreshToken(t *testing.T) {
+	r := newTokenRepo(t)
+
+	if err := r.SaveRefreshToken("a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveRefreshToken("b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.UseRefreshToken("a", "family", time.Hour); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := r.UseRefreshToken("a", "family", time.Hour); !errors.Is(err, user.ErrTokenReused) {
+		t.Fatalf("second use = %v, want %v", err, user.ErrTokenReused)
+	}
+
+	// the reuse revoked the rest of the family
+	if err := r.UseRefreshToken("b", "family", time.Hour); !errors.Is(err, user.ErrTokenRevoked) {
+		t.Errorf("use after reuse = %v, want %v", err, user.ErrTokenRevoked)
+	}
+
+	if err := r.UseRefreshToken("c", "other", time.Hour); !errors.Is(err, user.ErrTokenNotFound) {
+		t.Errorf("use of unknown token = %v, want %v", err, user.ErrTokenNotFound)
+	}
+}
+
+func TestTokenRepoUseRefreshTokenConcurrently(t *testing.T) {
+	r := newTokenRepo(t)
+
+	if err := r.SaveRefreshToken("a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 8)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.UseRefreshToken("a", "family", time.Hour)
+		}()
+	}
+	wg.Wait()
+
+	var used int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			used++
+		case errors.Is(err, user.ErrTokenReused), errors.Is(err, user.ErrTokenRevoked):
+		// the retries are bounded, some uses may still conflict
+		case errors.Is(err, badger.ErrConflict):
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if used != 1 {
+		t.Errorf("token used %d times, want 1", used)
+	}
+}
+
+func TestTokenRepoRevoke(t *testing.T) {
+	r := newTokenRepo(t)
+	issuedAt := time.Now()
+
+	if err := r.Revoke("jti", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		id, userID string
+		want       bool
+	}{
+		{"revoked", "jti", "user", true},
+		{"other token", "other", "user", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := r.IsRevoked(tt.id, tt.userID, issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != tt.want {
+				t.Errorf("IsRevoked = %v, want %v", revoked, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenRepoRevokeAllForUser(t *testing.T) {
+	r := newTokenRepo(t)
+	issuedAt := time.Now()
+
+	if err := r.RevokeAllForUser("user", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		issuedAt time.Time
+		want     bool
+	}{
+		{"issued before", "user", issuedAt.Add(-time.Minute), true},
+		{"issued in the same second", "user", issuedAt, true},
+		{"issued after", "user", issuedAt.Add(time.Minute), false},
+		{"other user", "other", issuedAt, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := r.IsRevoked("jti", tt.userID, tt.issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != tt.want {
+				t.Errorf("IsRevoked = %v, want %v", revoked, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenRepoSessions(t *testing.T) {
+	r := newTokenRepo(t)
+	createdAt := time.Now().UTC().Add(-time.Hour)
+
+	for _, s := range []user.SessionDTO{
+		{ID: "a", UserID: "user", Device: "firefox", CreatedAt: createdAt, LastUsedAt: createdAt},
+		{ID: "b", UserID: "user", Device: "chrome", CreatedAt: createdAt, LastUsedAt: createdAt},
+		{ID: "c", UserID: "other", Device: "safari", CreatedAt: createdAt, LastUsedAt: createdAt},
+	} {
+		if err := r.SaveSession(&s, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// saving it again updates it but keeps its creation time
+	lastUsedAt := time.Now().UTC()
+	if err := r.SaveSession(&user.SessionDTO{ID: "a", UserID: "user", Device: "firefox", CreatedAt: lastUsedAt, LastUsedAt: lastUsedAt}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := r.ListSessions("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("ListSessions returned %d sessions, want 2", len(sessions))
+	}
+	for _, s := range sessions {
+		if !s.CreatedAt.Equal(createdAt) {
+			t.Errorf("session %s created at %v, want %v", s.ID, s.CreatedAt, createdAt)
+		}
+		if s.ID == "a" && !s.LastUsedAt.Equal(lastUsedAt) {
+			t.Errorf("session a last used at %v, want %v", s.LastUsedAt, lastUsedAt)
+		}
+	}
+
+	if err := r.SaveRefreshToken("rt", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteSession("user", "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteSession("user", "a", time.Hour); !errors.Is(err, user.ErrSessionNotFound) {
+		t.Errorf("second delete = %v, want %v", err, user.ErrSessionNotFound)
+	}
+	if err := r.DeleteSession("other", "b", time.Hour); !errors.Is(err, user.ErrSessionNotFound) {
+		t.Errorf("delete of another user's session = %v, want %v", err, user.ErrSessionNotFound)
+	}
+
+	// the refresh tokens of a deleted session are revoked
+	if err := r.UseRefreshToken("rt", "a", time.Hour); !errors.Is(err, user.ErrTokenRevoked) {
+		t.Errorf("use after delete = %v, want %v", err, user.ErrTokenRevoked)
+	}
+
+	if sessions, err = r.ListSessions("user"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "b" {
+		t.Errorf("ListSessions = %v, want session b", sessions)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/dgraph-io/badger/v4"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
@@ -17,6 +16,11 @@ var (
 	maxUsernameLength = 30
 	minUsernameLength = 1
 
+	ErrUserNotFound       = errors.New("user not found")
+	ErrConnectionNotFound = errors.New("connection not found")
+	ErrConnectionExists   = errors.New("connection is linked to a user")
+	ErrLastConnection     = errors.New("the last connection of a user can't be unlinked")
+
 	errInvalidUsernameError = errors.New("invalid value for Username in UserParams")
 	errInvalidEmailError    = errors.New("invalid value for Email in UserParams")
 )
@@ -30,17 +34,24 @@ func NewUserRepo(db *sqlx.DB) *UserRepo {
 }
 
 type UserDTO struct {
-	ID        uuid.UUID    `db:"id"`
-	Username  string       `db:"username"`
-	Email     string       `db:"email"`
-	CreatedAt time.Time    `db:"created_at"`
-	UpdatedAt time.Time    `db:"updated_at"`
-	DeletedAt sql.NullTime `db:"deleted_at"`
+	ID       uuid.UUID `db:"id"`
+	Username string    `db:"username"`
+	Email    string    `db:"email"`
+	// EmailVerified is whether the provider the user signed up with verified their email.
+	EmailVerified bool         `db:"email_verified"`
+	Guest         bool         `db:"guest"`
+	CreatedAt     time.Time    `db:"created_at"`
+	UpdatedAt     time.Time    `db:"updated_at"`
+	DeletedAt     sql.NullTime `db:"deleted_at"`
 }
 
+// the email of the guests is null
+const userColumns = `id, username, COALESCE(email, '') AS email, email_verified, guest, created_at, updated_at, deleted_at`
+
 type UserParams struct {
-	Username string
-	Email    string
+	Username      string
+	Email         string
+	EmailVerified bool
 }
 
 func (p *UserParams) Validate() error {
@@ -64,13 +75,13 @@ func (p *UserParams) trim() {
 
 func (r *UserRepo) GetUserByID(ctx context.Context, id uuid.UUID) (*UserDTO, error) {
 	var u UserDTO
-	query := `SELECT id, username, email, created_at, updated_at, deleted_at
+	query := `SELECT ` + userColumns + `
         FROM users
         WHERE id = $1
         AND deleted_at IS NULL`
 	if err := r.db.GetContext(ctx, &u, query, id.String()); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 
 		return nil, err
@@ -81,13 +92,35 @@ func (r *UserRepo) GetUserByID(ctx context.Context, id uuid.UUID) (*UserDTO, err
 
 func (r *UserRepo) GetUserByEmail(ctx context.Context, email string) (*UserDTO, error) {
 	var u UserDTO
-	query := `SELECT id, username, email, created_at, updated_at, deleted_at
+	query := `SELECT ` + userColumns + `
         FROM users
         WHERE email = $1
         AND deleted_at IS NULL`
 	if err := r.db.GetContext(ctx, &u, query, email); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
+		}
+
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// GetVerifiedUserByEmail returns the oldest user with the verified email.
+func (r *UserRepo) GetVerifiedUserByEmail(ctx context.Context, email string) (*UserDTO, error) {
+	var u UserDTO
+	query := `SELECT ` + userColumns + `
+        FROM users
+        WHERE email = $1
+        AND email_verified
+        AND NOT guest
+        AND deleted_at IS NULL
+        ORDER BY created_at
+        LIMIT 1`
+	if err := r.db.GetContext(ctx, &u, query, email); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
 		}
 
 		return nil, err
@@ -103,16 +136,55 @@ func (r *UserRepo) CreateUser(ctx context.Context, u *UserParams) (*UserDTO, err
 
 	newUser := &UserDTO{}
 	query := `INSERT INTO users
-        (username, email)
-        VALUES ($1, $2)
-        RETURNING *`
-	if err := r.db.QueryRowxContext(ctx, query, u.Username, u.Email).StructScan(newUser); err != nil {
+        (username, email, email_verified)
+        VALUES ($1, $2, $3)
+        RETURNING ` + userColumns
+	if err := r.db.QueryRowxContext(ctx, query, u.Username, u.Email, u.EmailVerified).StructScan(newUser); err != nil {
 		return nil, err
 	}
 
 	return newUser, nil
 }
 
+// CreateGuest creates a guest user, they have no email until they're upgraded.
+func (r *UserRepo) CreateGuest(ctx context.Context, username string) (*UserDTO, error) {
+	guest := &UserDTO{}
+	query := `INSERT INTO users
+        (username, guest)
+        VALUES ($1, true)
+        RETURNING ` + userColumns
+	if err := r.db.QueryRowxContext(ctx, query, username).StructScan(guest); err != nil {
+		return nil, err
+	}
+
+	return guest, nil
+}
+
+// UpgradeGuest turns the guest with the id into a user with email, it keeps
+// everything of the guest. It returns ErrUserNotFound if there's no such guest.
+func (r *UserRepo) UpgradeGuest(ctx context.Context, id uuid.UUID, email string, emailVerified bool) (*UserDTO, error) {
+	if _, err := mail.ParseAddress(email); err != nil {
+		return nil, errInvalidEmailError
+	}
+
+	u := &UserDTO{}
+	query := `UPDATE users
+        SET email = $2, email_verified = $3, guest = false, updated_at = now()
+        WHERE id = $1
+        AND guest
+        AND deleted_at IS NULL
+        RETURNING ` + userColumns
+	if err := r.db.QueryRowxContext(ctx, query, id, strings.TrimSpace(email), emailVerified).StructScan(u); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+
+		return nil, err
+	}
+
+	return u, nil
+}
+
 func (r *UserRepo) UpdateUser(ctx context.Context, id uuid.UUID, u *UserParams) (*UserDTO, error) {
 	if err := u.Validate(); err != nil {
 		return nil, err
@@ -129,6 +201,45 @@ func (r *UserRepo) UpdateUser(ctx context.Context, id uuid.UUID, u *UserParams)
 	return updatedUser, nil
 }
 
+/*
+MergeUsers moves the connections, the Jams and the memberships of the user from
+to the user into and deletes from, in a single transaction.
+
+The bans of from are kept on into, the messages and the moderations made by
+from are attributed to into.
+*/
+func (r *UserRepo) MergeUsers(ctx context.Context, into, from uuid.UUID) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		{`UPDATE connections SET user_id = $1, updated_at = now() WHERE user_id = $2`, []any{into, from}},
+		{`UPDATE jams SET owner_id = $1, updated_at = now() WHERE owner_id = $2`, []any{into, from}},
+		{`INSERT INTO jam_bans (jam_id, user_id, reason, banned_by, created_at)
+            SELECT jam_id, $1::uuid, reason, banned_by, created_at FROM jam_bans WHERE user_id = $2
+            ON CONFLICT DO NOTHING`, []any{into, from}},
+		{`DELETE FROM jam_bans WHERE user_id = $1`, []any{from}},
+		{`UPDATE jam_bans SET banned_by = $1 WHERE banned_by = $2`, []any{into, from}},
+		{`UPDATE jam_messages SET author_id = $1 WHERE author_id = $2`, []any{into, from}},
+		{`UPDATE jam_moderation_log SET actor_id = $1 WHERE actor_id = $2`, []any{into, from}},
+		{`UPDATE jam_moderation_log SET target_user_id = $1 WHERE target_user_id = $2`, []any{into, from}},
+		{`UPDATE users SET deleted_at = now(), updated_at = now() WHERE id = $1`, []any{from}},
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q.query, q.args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (r *UserRepo) DeleteUser(ctx context.Context, id uuid.UUID) error {
 	query := `UPDATE users
         SET (deleted_at = $2)
@@ -172,7 +283,7 @@ func (r *ConnectionRepo) GetConnectionByConnectionID(
         AND deleted_at IS NULL`
 	if err := r.db.GetContext(ctx, &c, query, id); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, ErrConnectionNotFound
 		}
 
 		return nil, err
@@ -185,10 +296,21 @@ func (r *ConnectionRepo) GetConnectionsByUserID(
 	ctx context.Context,
 	id uuid.UUID,
 ) ([]ConnectionDTO, error) {
-	return []ConnectionDTO{}, nil
+	connections := []ConnectionDTO{}
+	query := `SELECT id, user_id, provider, created_at, updated_at, deleted_at
+        FROM connections
+        WHERE user_id = $1
+        AND deleted_at IS NULL
+        ORDER BY created_at`
+	if err := r.db.SelectContext(ctx, &connections, query, id); err != nil {
+		return nil, err
+	}
+
+	return connections, nil
 }
 
-// TODO: if duplicate, remove old
+// CreateConnection links a connection to a user, the unlinked connections are
+// linked again. It returns ErrConnectionExists if it's linked to a user.
 func (r *ConnectionRepo) CreateConnection(
 	ctx context.Context,
 	c *ConnectionParams,
@@ -197,14 +319,63 @@ func (r *ConnectionRepo) CreateConnection(
 	query := `INSERT INTO connections
         (id, user_id, provider)
         VALUES ($1, $2, $3)
+        ON CONFLICT (id) DO UPDATE
+        SET user_id = EXCLUDED.user_id, provider = EXCLUDED.provider, created_at = now(), updated_at = now(), deleted_at = NULL
+        WHERE connections.deleted_at IS NOT NULL
         RETURNING *`
 	if err := r.db.QueryRowxContext(ctx, query, c.ID, c.UserID, c.Provider).StructScan(newConnection); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrConnectionExists
+		}
+
 		return nil, err
 	}
 
 	return newConnection, nil
 }
 
+// UnlinkProvider unlinks the connections of the user to provider. It returns
+// ErrConnectionNotFound if there are none and ErrLastConnection if the user
+// has no connection to another provider.
+func (r *ConnectionRepo) UnlinkProvider(ctx context.Context, userID uuid.UUID, provider string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// locks the user so concurrent unlinks can't remove all of their connections
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return err
+	}
+
+	var linked, others int
+	query := `SELECT count(*) FILTER (WHERE provider = $2), count(*) FILTER (WHERE provider <> $2)
+        FROM connections
+        WHERE user_id = $1
+        AND deleted_at IS NULL`
+	if err := tx.QueryRowxContext(ctx, query, userID, provider).Scan(&linked, &others); err != nil {
+		return err
+	}
+	if linked == 0 {
+		return ErrConnectionNotFound
+	}
+	if others == 0 {
+		return ErrLastConnection
+	}
+
+	query = `UPDATE connections
+        SET deleted_at = now(), updated_at = now()
+        WHERE user_id = $1
+        AND provider = $2
+        AND deleted_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, userID, provider); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (r *ConnectionRepo) UpdateConnection(
 	ctx context.Context,
 	id string,
@@ -220,66 +391,9 @@ func (r *ConnectionRepo) UpdateConnection(
 
 func (r *ConnectionRepo) DeleteConnection(ctx context.Context, id string) error {
 	query := `UPDATE connections
-        SET (deleted_at = $2)
-        WHERE id==$1`
+        SET deleted_at = $2
+        WHERE id = $1`
 	_, err := r.db.ExecContext(ctx, query, id, time.Now().UTC())
 
 	return err
 }
-
-type TokenRepo struct {
-	cache *badger.DB
-}
-
-func NewTokenRepo(cache *badger.DB) *TokenRepo {
-	return &TokenRepo{cache}
-}
-
-type CacheType uint
-
-const (
-	BlacklistIPAddress CacheType = iota
-	ListRefreshToken
-)
-
-func (r *TokenRepo) List(
-	typ CacheType,
-	val string,
-	exp time.Duration,
-) error {
-	return r.cache.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(getPrefix(typ)+val), []byte(""))
-	})
-}
-
-// if token is cached -> valid
-// token must be removed upon first use
-// otherwise will lead to token reuse
-func (r *TokenRepo) IsValid(typ CacheType, val string) (bool, error) {
-	err := r.cache.View(func(txn *badger.Txn) error {
-		_, err := txn.Get([]byte(getPrefix(typ) + val))
-		return err
-	})
-
-	if err != nil {
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			return false, err
-		}
-
-		return false, err
-	}
-
-	return true, nil
-}
-
-func getPrefix(typ CacheType) string {
-	var prefix string
-	switch typ {
-	case BlacklistIPAddress:
-		prefix = "ip:"
-	case ListRefreshToken:
-		prefix = "rt:"
-	}
-
-	return prefix
-}